@@ -0,0 +1,89 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// AccessDir in a metadata store records when every entry was last used, as the mtime of an empty file
+	AccessDir = ".access"
+	// PinsDir in a metadata store holds an empty file for every entry exempt from eviction
+	PinsDir = ".pins"
+)
+
+// Touch records that the entry of store was used now, stores other than local directories are not tracked
+func Touch(store CacheStore, name string) {
+	b, ok := localStore(store)
+	if !ok || b.readOnly {
+		return
+	}
+	path := filepath.Join(b.path, AccessDir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		if os.MkdirAll(filepath.Join(b.path, AccessDir), 0755) != nil {
+			return
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return
+		}
+		file.Close()
+	}
+	// set explicitly, the filesystem clock may lag behind
+	now := time.Now()
+	os.Chtimes(path, now, now)
+}
+
+// LastAccess returns when the entry of store was last used, entries never touched were last used when written
+func LastAccess(store CacheStore, name string) time.Time {
+	b, ok := localStore(store)
+	if !ok {
+		return time.Time{}
+	}
+	if info, err := os.Stat(filepath.Join(b.path, AccessDir, name)); err == nil {
+		return info.ModTime()
+	}
+	if info, err := os.Stat(filepath.Join(b.path, name)); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// Pin exempts the entry of store from eviction, or makes it evictable again
+func Pin(store CacheStore, name string, pinned bool) error {
+	b, ok := localStore(store)
+	if !ok {
+		return nil
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	path := filepath.Join(b.path, PinsDir, name)
+	if !pinned {
+		err := os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	err := os.MkdirAll(filepath.Join(b.path, PinsDir), 0755)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// IsPinned returns true if the entry of store is exempt from eviction
+func IsPinned(store CacheStore, name string) bool {
+	b, ok := localStore(store)
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(b.path, PinsDir, name))
+	return err == nil
+}
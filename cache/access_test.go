@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessAndPins(t *testing.T) {
+	store, err := NewMetadataStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old", "new"} {
+		if err := WriteEntry(store, name, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now()
+	Touch(store, "new")
+	if LastAccess(store, "new").Before(start) {
+		t.Fatalf("access not recorded")
+	}
+	if !LastAccess(store, "old").Before(start) {
+		t.Fatalf("untouched entry reported as used")
+	}
+	if entries := store.List(); len(entries) != 2 {
+		t.Fatalf("access records listed as entries: %v", entries)
+	}
+
+	if err := Pin(store, "old", true); err != nil {
+		t.Fatal(err)
+	}
+	if !IsPinned(store, "old") || IsPinned(store, "new") {
+		t.Fatalf("unexpected pins")
+	}
+	if err := Pin(store, "old", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pin(store, "old", false); err != nil {
+		t.Fatal(err)
+	}
+	if IsPinned(store, "old") {
+		t.Fatalf("entry still pinned")
+	}
+
+	// removed entries lose their records
+	Pin(store, "new", true)
+	store.Del("new")
+	if IsPinned(store, "new") || !LastAccess(store, "new").IsZero() {
+		t.Fatalf("records of a removed entry kept")
+	}
+}
@@ -1,18 +1,27 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"sync"
-
-	"github.com/2DFS/2dfs-builder/compress"
 )
 
+// ReadOnly opens the stores read-only, for stores shared by several machines or mounted into containers:
+// entries can't be added nor removed and nothing is written to the store directory
+var ReadOnly = false
+
+// ErrReadOnly is returned when adding entries to a read-only store
+var ErrReadOnly = errors.New("the store is read-only")
+
 type cachestore struct {
 	path string // path to the blobstore directory
-	mtx  sync.Mutex
+	// verify is set on content addressed stores, whose entries are named after the sha256 of their content
+	verify   bool
+	readOnly bool
+	mtx      sync.Mutex
 }
 
 type CacheStore interface {
@@ -20,35 +29,109 @@ type CacheStore interface {
 	Get(digest string) (io.ReadCloser, error)
 	//
 	GetSize(digest string) (int64, error)
-	// Add generates the empty cache entry and returns its writer
-	Add(digest string) (io.WriteCloser, error)
-	// Del removes the entry from the store
-	Del(digest string)
+	// Add returns the writer of a new cache entry, the entry replaces any previous one when committed
+	Add(digest string) (EntryWriter, error)
+	// Del removes the entry from the store, removing a missing entry is not an error
+	Del(digest string) error
 	// Check integrity based on digest
 	Check(digest string) bool
 	// List all entries in the store
 	List() []string
 }
 
+// wrapper is implemented by the stores layered over another store
+type wrapper interface {
+	// Unwrap returns the store the wrapper is layered over
+	Unwrap() CacheStore
+}
+
+// unwrap returns the innermost store under the wrappers of store
+func unwrap(store CacheStore) CacheStore {
+	for {
+		w, ok := store.(wrapper)
+		if !ok {
+			return store
+		}
+		store = w.Unwrap()
+	}
+}
+
+// localStore returns the local directory store under the wrappers of store
+func localStore(store CacheStore) (*cachestore, bool) {
+	b, ok := unwrap(store).(*cachestore)
+	return b, ok
+}
+
+// NewCacheStore opens the content addressed store at path: entries are named after the sha256 of their content.
+// If Remote is set, the store reads through and writes through the remote store.
 func NewCacheStore(path string) (CacheStore, error) {
-	storedir, err := os.Open(path)
-	defer storedir.Close()
+	store, err := NewLocalStore(path)
 	if err != nil {
 		return nil, err
 	}
-	info, err := storedir.Stat()
+	if Remote != "" {
+		return NewTieredStore(store, NewHTTPStore(Remote)), nil
+	}
+	return store, nil
+}
+
+// NewLocalStore opens the content addressed store at path without the remote store, for the commands
+// walking or serving what this machine holds
+func NewLocalStore(path string) (CacheStore, error) {
+	err := checkStoreDir(path)
 	if err != nil {
 		return nil, err
 	}
-	if !info.IsDir() {
-		return nil, fmt.Errorf("blobstore path must be a directory")
+	if isChunked(path) {
+		cleanStaleTemp(filepath.Join(path, ChunksDir))
+		cleanStaleTemp(filepath.Join(path, RecipesDir))
+		return &chunkedstore{
+			path:     path,
+			readOnly: ReadOnly,
+			mtx:      sync.Mutex{},
+		}, nil
 	}
+	cleanStaleTemp(filepath.Join(path, VerifiedDir))
 	return &cachestore{
-		path: path,
-		mtx:  sync.Mutex{},
+		path:     path,
+		verify:   true,
+		readOnly: ReadOnly,
+		mtx:      sync.Mutex{},
 	}, nil
 }
 
+// NewMetadataStore opens the store at path whose entries are named by the caller, like the image indexes
+func NewMetadataStore(path string) (CacheStore, error) {
+	err := checkStoreDir(path)
+	if err != nil {
+		return nil, err
+	}
+	cleanStaleTemp(filepath.Join(path, RecordsDir))
+	return &cachestore{
+		path:     path,
+		readOnly: ReadOnly,
+		mtx:      sync.Mutex{},
+	}, nil
+}
+
+// checkStoreDir checks that path is a directory and removes the leftovers of interrupted writes
+func checkStoreDir(path string) error {
+	storedir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer storedir.Close()
+	info, err := storedir.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("blobstore path must be a directory")
+	}
+	cleanStaleTemp(path)
+	return nil
+}
+
 func (b *cachestore) Get(digest string) (io.ReadCloser, error) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
@@ -71,36 +154,69 @@ func (b *cachestore) GetSize(digest string) (int64, error) {
 	return stat.Size(), nil
 }
 
-func (b *cachestore) Add(digest string) (io.WriteCloser, error) {
-	b.mtx.Lock()
-	defer b.mtx.Unlock()
-	dest := filepath.Join(b.path, digest)
-	blobfile, err := os.Create(dest)
-	if err != nil {
-		return nil, err
+func (b *cachestore) Add(digest string) (EntryWriter, error) {
+	if b.readOnly {
+		return nil, ErrReadOnly
 	}
-	return blobfile, nil
+	dest := filepath.Join(b.path, digest)
+	return newEntryWriter(b.path, digest, b.verify, func(tmpPath string) error {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		err := os.Rename(tmpPath, dest)
+		if err != nil {
+			return err
+		}
+		// the digest was checked while writing
+		if b.verify {
+			if info, err := os.Stat(dest); err == nil {
+				recordVerified(b.path, b.readOnly, digest, info)
+			}
+		}
+		return nil
+	})
 }
 
-func (b *cachestore) Del(digest string) {
+func (b *cachestore) Del(digest string) error {
+	if b.readOnly {
+		return ErrReadOnly
+	}
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
 	dest := filepath.Join(b.path, digest)
-	os.Remove(dest)
+	err := os.Remove(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// the records of the entry are only worth a stale file if left behind
+	os.Remove(recordPath(b.path, digest))
+	os.Remove(filepath.Join(b.path, AccessDir, digest))
+	os.Remove(filepath.Join(b.path, PinsDir, digest))
+	os.Remove(filepath.Join(b.path, RecordsDir, digest))
+	return nil
 }
 
+// Check verifies the digest of the entry, entries unchanged since their last check are not rehashed
 func (b *cachestore) Check(digest string) bool {
 	dest := filepath.Join(b.path, digest)
+	info, err := os.Stat(dest)
+	if err != nil {
+		return false
+	}
+	if isVerified(b.path, digest, info) {
+		return true
+	}
 	file, err := os.Open(dest)
 	if err != nil {
 		return false
 	}
-	calculatedDigest := compress.CalculateSha256Digest(file)
-	if calculatedDigest != digest {
+	calculatedDigest, err := hashEntry(file)
+	file.Close()
+	if err != nil || calculatedDigest != digest {
 		fmt.Printf("Invalidated cache entry %s\n", digest)
 		b.Del(digest)
 		return false
 	}
+	recordVerified(b.path, b.readOnly, digest, info)
 	return true
 }
 
@@ -109,7 +225,13 @@ func (b *cachestore) List() []string {
 	defer b.mtx.Unlock()
 	var entries []string
 	filepath.Walk(b.path, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() && path != b.path && isTemp(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && !isTemp(info.Name()) {
 			entries = append(entries, info.Name())
 		}
 		return nil
@@ -0,0 +1,614 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const (
+	// ChunksDir holds the chunks of a chunked store, its presence enables chunking
+	ChunksDir = "chunks"
+	// RecipesDir holds the list of chunks of every chunked blob
+	RecipesDir = "recipes"
+
+	// content defined chunking parameters, the average chunk size is 64KiB
+	minChunkSize = 16 << 10
+	maxChunkSize = 256 << 10
+	chunkMask    = (1 << 16) - 1
+)
+
+// gearTable maps every byte to a pseudo random value for the rolling hash
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x2df5)
+	for i := range table {
+		// splitmix64
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunkRecipe lists the chunks of a blob in order
+type chunkRecipe struct {
+	Size   int64        `json:"size"`
+	Chunks []chunkEntry `json:"chunks"`
+}
+
+type chunkEntry struct {
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+}
+
+// chunkedstore splits the blobs with content defined chunking and stores every chunk once.
+// Blobs stored as whole files before chunking was enabled are still served.
+type chunkedstore struct {
+	path     string // path to the blobstore directory
+	readOnly bool
+	mtx      sync.Mutex
+}
+
+// EnableChunking turns the store at path into a chunked store, existing blobs are split into chunks
+func EnableChunking(path string) error {
+	for _, dir := range []string{ChunksDir, RecipesDir} {
+		if err := os.MkdirAll(filepath.Join(path, dir), 0755); err != nil {
+			return err
+		}
+	}
+	store := &chunkedstore{path: path}
+	for _, digest := range wholeBlobs(path) {
+		if err := store.convert(digest); err != nil {
+			return fmt.Errorf("unable to chunk %s: %w", digest, err)
+		}
+	}
+	return nil
+}
+
+// DisableChunking reassembles the chunked blobs of the store at path as whole files
+func DisableChunking(path string) error {
+	store := &chunkedstore{path: path}
+	recipes, _ := os.ReadDir(filepath.Join(path, RecipesDir))
+	for _, recipe := range recipes {
+		digest := recipe.Name()
+		if isTemp(digest) {
+			continue
+		}
+		reader, err := store.Get(digest)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(filepath.Join(path, digest), reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(path, RecipesDir)); err != nil {
+		return err
+	}
+	return os.RemoveAll(filepath.Join(path, ChunksDir))
+}
+
+// isChunked returns true if chunking is enabled on the store at path
+func isChunked(path string) bool {
+	info, err := os.Stat(filepath.Join(path, ChunksDir))
+	return err == nil && info.IsDir()
+}
+
+// wholeBlobs lists the blobs stored as whole files
+func wholeBlobs(path string) []string {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil
+	}
+	blobs := []string{}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !isTemp(entry.Name()) {
+			blobs = append(blobs, entry.Name())
+		}
+	}
+	return blobs
+}
+
+func (b *chunkedstore) recipePath(digest string) string {
+	return filepath.Join(b.path, RecipesDir, digest)
+}
+
+func (b *chunkedstore) chunkPath(digest string) string {
+	return filepath.Join(b.path, ChunksDir, digest)
+}
+
+func (b *chunkedstore) readRecipe(digest string) (chunkRecipe, error) {
+	recipe := chunkRecipe{}
+	recipeBytes, err := os.ReadFile(b.recipePath(digest))
+	if err != nil {
+		return recipe, err
+	}
+	err = json.Unmarshal(recipeBytes, &recipe)
+	return recipe, err
+}
+
+func (b *chunkedstore) Get(digest string) (io.ReadCloser, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	recipe, err := b.readRecipe(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.Open(filepath.Join(b.path, digest))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return newChunkReader(b, recipe), nil
+}
+
+func (b *chunkedstore) GetSize(digest string) (int64, error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	recipe, err := b.readRecipe(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		stat, err := os.Stat(filepath.Join(b.path, digest))
+		if err != nil {
+			return 0, err
+		}
+		return stat.Size(), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return recipe.Size, nil
+}
+
+// Add returns a writer to a temporary file, the blob is split into chunks on Commit
+func (b *chunkedstore) Add(digest string) (EntryWriter, error) {
+	if b.readOnly {
+		return nil, ErrReadOnly
+	}
+	return newEntryWriter(filepath.Join(b.path, ChunksDir), digest, true, func(tmpPath string) error {
+		tmp, err := os.Open(tmpPath)
+		if err != nil {
+			return err
+		}
+		defer tmp.Close()
+		err = b.store(digest, tmp)
+		if err != nil {
+			return err
+		}
+		// the digest was checked while writing
+		if info, err := b.entryInfo(digest); err == nil {
+			recordVerified(b.path, b.readOnly, digest, info)
+		}
+		return nil
+	})
+}
+
+// convert splits a blob stored as a whole file into chunks
+func (b *chunkedstore) convert(digest string) error {
+	blob, err := os.Open(filepath.Join(b.path, digest))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	return b.store(digest, blob)
+}
+
+// store splits the content of reader into chunks and writes the recipe of digest.
+// The lock is held while chunking so that Del never removes a chunk about to be referenced.
+func (b *chunkedstore) store(digest string, reader io.Reader) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	recipe := chunkRecipe{Chunks: []chunkEntry{}}
+	err := splitChunks(reader, func(chunk []byte) error {
+		chunkDigest := fmt.Sprintf("%x", sha256.Sum256(chunk))
+		recipe.Chunks = append(recipe.Chunks, chunkEntry{Digest: chunkDigest, Size: int64(len(chunk))})
+		recipe.Size += int64(len(chunk))
+		if _, err := os.Stat(b.chunkPath(chunkDigest)); err == nil {
+			return nil
+		}
+		return writeFileAtomic(b.chunkPath(chunkDigest), bytes.NewReader(chunk))
+	})
+	if err != nil {
+		return err
+	}
+	recipeBytes, err := json.Marshal(recipe)
+	if err != nil {
+		return err
+	}
+
+	// the whole file is replaced by the chunks
+	os.Remove(filepath.Join(b.path, digest))
+	return writeFileAtomic(b.recipePath(digest), bytes.NewReader(recipeBytes))
+}
+
+// Del removes the blob and the chunks no other blob references
+func (b *chunkedstore) Del(digest string) error {
+	return b.delAll([]string{digest})[digest]
+}
+
+// delAll removes the blobs, then the chunks no other blob references. The recipes left are read once for the whole batch.
+func (b *chunkedstore) delAll(digests []string) map[string]error {
+	failures := map[string]error{}
+	if b.readOnly {
+		for _, digest := range digests {
+			failures[digest] = ErrReadOnly
+		}
+		return failures
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	// chunks of the removed recipes, with the blob they are removed with
+	released := map[string]string{}
+	for _, digest := range digests {
+		err := b.removeEntry(digest, released)
+		if err != nil {
+			failures[digest] = err
+		}
+	}
+	if len(released) == 0 {
+		return failures
+	}
+	referenced := b.referencedChunks()
+	for chunk, digest := range released {
+		if referenced[chunk] {
+			continue
+		}
+		err := os.Remove(b.chunkPath(chunk))
+		if err != nil && !os.IsNotExist(err) && failures[digest] == nil {
+			failures[digest] = err
+		}
+	}
+	return failures
+}
+
+// removeEntry removes the blob, its record and its recipe, and adds the chunks of the recipe to released
+func (b *chunkedstore) removeEntry(digest string, released map[string]string) error {
+	err := os.Remove(filepath.Join(b.path, digest))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	os.Remove(recordPath(b.path, digest))
+	recipe, err := b.readRecipe(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	// an unreadable recipe is removed all the same, the chunks it listed are unknown and stay in the store
+	removeErr := os.Remove(b.recipePath(digest))
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return removeErr
+	}
+	if err != nil {
+		return nil
+	}
+	for _, chunk := range recipe.Chunks {
+		released[chunk.Digest] = digest
+	}
+	return nil
+}
+
+// DelEntries removes the entries of store and returns the failures by entry. Chunked stores look for the chunks
+// still referenced once for the whole batch instead of once per entry.
+func DelEntries(store CacheStore, digests []string) map[string]error {
+	if b, ok := unwrap(store).(*chunkedstore); ok {
+		return b.delAll(digests)
+	}
+	failures := map[string]error{}
+	for _, digest := range digests {
+		err := store.Del(digest)
+		if err != nil {
+			failures[digest] = err
+		}
+	}
+	return failures
+}
+
+// referencedChunks returns the chunks referenced by at least one recipe
+func (b *chunkedstore) referencedChunks() map[string]bool {
+	referenced := make(map[string]bool)
+	recipes, _ := os.ReadDir(filepath.Join(b.path, RecipesDir))
+	for _, entry := range recipes {
+		recipe, err := b.readRecipe(entry.Name())
+		if err != nil {
+			continue
+		}
+		for _, chunk := range recipe.Chunks {
+			referenced[chunk.Digest] = true
+		}
+	}
+	return referenced
+}
+
+// entryInfo describes the file a blob is stored in: its recipe, or the whole file if it is not chunked
+func (b *chunkedstore) entryInfo(digest string) (os.FileInfo, error) {
+	info, err := os.Stat(b.recipePath(digest))
+	if os.IsNotExist(err) {
+		return os.Stat(filepath.Join(b.path, digest))
+	}
+	return info, err
+}
+
+// hasChunks returns true if every chunk of a verified recipe is still in the store
+func (b *chunkedstore) hasChunks(digest string) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	recipe, err := b.readRecipe(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	for _, chunk := range recipe.Chunks {
+		if _, err := os.Stat(b.chunkPath(chunk.Digest)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Check trusts the verification record of an unchanged recipe, as the plain store does for unchanged blobs.
+// Chunks are content addressed and never rewritten, only their presence is checked then.
+func (b *chunkedstore) Check(digest string) bool {
+	info, err := b.entryInfo(digest)
+	if err != nil {
+		return false
+	}
+	if isVerified(b.path, digest, info) && b.hasChunks(digest) {
+		return true
+	}
+	reader, err := b.Get(digest)
+	if err != nil {
+		return false
+	}
+	calculatedDigest, err := hashEntry(reader)
+	reader.Close()
+	if err != nil || calculatedDigest != digest {
+		fmt.Printf("Invalidated cache entry %s\n", digest)
+		b.Del(digest)
+		return false
+	}
+	recordVerified(b.path, b.readOnly, digest, info)
+	return true
+}
+
+func (b *chunkedstore) List() []string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	entries := wholeBlobs(b.path)
+	recipes, _ := os.ReadDir(filepath.Join(b.path, RecipesDir))
+	for _, recipe := range recipes {
+		if !isTemp(recipe.Name()) {
+			entries = append(entries, recipe.Name())
+		}
+	}
+	return entries
+}
+
+// splitChunks cuts the content of reader at content defined boundaries using a gear rolling hash
+func splitChunks(reader io.Reader, emit func(chunk []byte) error) error {
+	bufferedReader := bufio.NewReaderSize(reader, 1024*1024)
+	chunk := make([]byte, 0, maxChunkSize)
+	var hash uint64
+	for {
+		c, err := bufferedReader.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, c)
+		hash = (hash << 1) + gearTable[c]
+		if (len(chunk) >= minChunkSize && hash&chunkMask == 0) || len(chunk) >= maxChunkSize {
+			if err := emit(chunk); err != nil {
+				return err
+			}
+			chunk = chunk[:0]
+			hash = 0
+		}
+	}
+	if len(chunk) > 0 {
+		return emit(chunk)
+	}
+	return nil
+}
+
+// chunkReader reassembles a chunked blob, it supports sequential and random access
+type chunkReader struct {
+	store   *chunkedstore
+	chunks  []chunkEntry
+	offsets []int64 // offset of every chunk in the blob
+	size    int64
+	offset  int64
+
+	current int // chunk index of file
+	file    *os.File
+	mtx     sync.Mutex
+}
+
+func newChunkReader(store *chunkedstore, recipe chunkRecipe) *chunkReader {
+	offsets := make([]int64, len(recipe.Chunks))
+	offset := int64(0)
+	for i, chunk := range recipe.Chunks {
+		offsets[i] = offset
+		offset += chunk.Size
+	}
+	return &chunkReader{store: store, chunks: recipe.Chunks, offsets: offsets, size: recipe.Size, current: -1}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.offset)
+	r.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *chunkReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		if off >= r.size {
+			return n, io.EOF
+		}
+		i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+		if i != r.current {
+			if r.file != nil {
+				r.file.Close()
+				r.file = nil
+			}
+			file, err := os.Open(r.store.chunkPath(r.chunks[i].Digest))
+			if err != nil {
+				return n, err
+			}
+			r.file = file
+			r.current = i
+		}
+		end := min(int64(len(p)-n), r.chunks[i].Size-(off-r.offsets[i]))
+		read, err := r.file.ReadAt(p[n:n+int(end)], off-r.offsets[i])
+		n += read
+		off += int64(read)
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if int64(read) < end {
+			return n, fmt.Errorf("chunk %s is truncated", r.chunks[i].Digest)
+		}
+	}
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative offset")
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.file != nil {
+		err := r.file.Close()
+		r.file = nil
+		return err
+	}
+	return nil
+}
+
+// Stats summarizes the content of a blob store
+type Stats struct {
+	// Blobs is the number of entries of the store
+	Blobs int `json:"blobs"`
+	// ChunkedBlobs is the number of entries stored as chunks
+	ChunkedBlobs int `json:"chunked_blobs"`
+	// Chunks is the number of distinct chunks
+	Chunks int `json:"chunks"`
+	// LogicalSize is the total size of the entries
+	LogicalSize int64 `json:"logical_size"`
+	// StoredSize is the space used on disk by whole files and chunks
+	StoredSize int64 `json:"stored_size"`
+}
+
+// Savings returns the bytes saved by deduplication
+func (s Stats) Savings() int64 {
+	return s.LogicalSize - s.StoredSize
+}
+
+// GetStats computes the statistics of the blob store at path
+func GetStats(path string) (Stats, error) {
+	stats := Stats{}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return stats, err
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || isTemp(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return stats, err
+		}
+		stats.Blobs++
+		stats.LogicalSize += info.Size()
+		stats.StoredSize += info.Size()
+	}
+	if !isChunked(path) {
+		return stats, nil
+	}
+
+	store := &chunkedstore{path: path}
+	recipes, _ := os.ReadDir(filepath.Join(path, RecipesDir))
+	for _, entry := range recipes {
+		if isTemp(entry.Name()) {
+			continue
+		}
+		recipe, err := store.readRecipe(entry.Name())
+		if err != nil {
+			return stats, err
+		}
+		stats.Blobs++
+		stats.ChunkedBlobs++
+		stats.LogicalSize += recipe.Size
+	}
+	chunks, _ := os.ReadDir(filepath.Join(path, ChunksDir))
+	for _, entry := range chunks {
+		if !entry.Type().IsRegular() || isTemp(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return stats, err
+		}
+		stats.Chunks++
+		stats.StoredSize += info.Size()
+	}
+	return stats, nil
+}
+
+// writeFileAtomic writes the content of reader to dst through a temporary file in the same directory
+func writeFileAtomic(dst string, reader io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.CopyBuffer(tmp, reader, make([]byte, 1024*1024)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
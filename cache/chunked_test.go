@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func addBlob(t *testing.T, store CacheStore, content []byte) string {
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	writer, err := store.Add(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return digest
+}
+
+func TestChunkedStore(t *testing.T) {
+	dir := t.TempDir()
+	random := rand.New(rand.NewSource(1))
+	first := make([]byte, 2<<20)
+	random.Read(first)
+	second := bytes.Clone(first)
+	copy(second[1<<20:], []byte("patched weights"))
+
+	// blobs added before chunking are converted
+	plain, err := NewCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstDigest := addBlob(t, plain, first)
+	if err := EnableChunking(dir); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.(*chunkedstore); !ok {
+		t.Fatalf("expected a chunked store")
+	}
+	secondDigest := addBlob(t, store, second)
+
+	for digest, content := range map[string][]byte{firstDigest: first, secondDigest: second} {
+		size, err := store.GetSize(digest)
+		if err != nil || size != int64(len(content)) {
+			t.Fatalf("size of %s: %d, %v", digest, size, err)
+		}
+		reader, err := store.Get(digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		read, err := io.ReadAll(reader)
+		if err != nil || !bytes.Equal(read, content) {
+			t.Fatalf("content of %s differs: %v", digest, err)
+		}
+		part := make([]byte, 100000)
+		if _, err := reader.(io.ReaderAt).ReadAt(part, 1<<20-50000); err != nil || !bytes.Equal(part, content[1<<20-50000:1<<20+50000]) {
+			t.Fatalf("random access of %s differs: %v", digest, err)
+		}
+		reader.Close()
+		if !store.Check(digest) {
+			t.Fatalf("check of %s failed", digest)
+		}
+	}
+	if len(store.List()) != 2 {
+		t.Fatalf("expected 2 entries, found %v", store.List())
+	}
+
+	stats, err := GetStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ChunkedBlobs != 2 || stats.LogicalSize != int64(len(first)+len(second)) {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.Savings() < int64(len(first))*3/4 {
+		t.Fatalf("expected the blobs to share most chunks, saved %d bytes", stats.Savings())
+	}
+
+	// shared chunks survive the removal of one blob
+	if err := store.Del(firstDigest); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Check(secondDigest) {
+		t.Fatalf("second blob corrupted by the removal of the first")
+	}
+	if err := store.Del(firstDigest); err != nil {
+		t.Fatalf("removing a missing blob failed: %v", err)
+	}
+
+	if err := DisableChunking(dir); err != nil {
+		t.Fatal(err)
+	}
+	read, err := os.ReadFile(filepath.Join(dir, secondDigest))
+	if err != nil || !bytes.Equal(read, second) {
+		t.Fatalf("blob not reassembled: %v", err)
+	}
+	if isChunked(dir) {
+		t.Fatalf("chunks left after disabling chunking")
+	}
+}
+
+func TestChunkedDelEntries(t *testing.T) {
+	dir := t.TempDir()
+	if err := EnableChunking(dir); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random := rand.New(rand.NewSource(2))
+	shared := make([]byte, 2<<20)
+	random.Read(shared)
+	kept := addBlob(t, store, shared)
+	removed := []string{}
+	for _, patch := range []string{"first patch", "second patch"} {
+		content := bytes.Clone(shared)
+		copy(content[1<<20:], []byte(patch))
+		removed = append(removed, addBlob(t, store, content))
+	}
+	unique := make([]byte, 1<<20)
+	random.Read(unique)
+	removed = append(removed, addBlob(t, store, unique))
+
+	failures := DelEntries(store, append(removed, fmt.Sprintf("%x", sha256.Sum256([]byte("missing")))))
+	if len(failures) != 0 {
+		t.Fatalf("unexpected failures %v", failures)
+	}
+	if entries := store.List(); len(entries) != 1 || entries[0] != kept {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+	// the chunks of the kept blob survive the batch, the others are removed
+	if err := Verify(store, kept); err != nil {
+		t.Fatal(err)
+	}
+	recipe, err := store.(*chunkedstore).readRecipe(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	referenced := map[string]bool{}
+	for _, chunk := range recipe.Chunks {
+		referenced[chunk.Digest] = true
+	}
+	chunks, err := os.ReadDir(filepath.Join(dir, ChunksDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range chunks {
+		if !referenced[chunk.Name()] {
+			t.Errorf("chunk %s of a removed blob left in the store", chunk.Name())
+		}
+	}
+}
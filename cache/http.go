@@ -0,0 +1,219 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Remote is the URL of a store served by tdfs cache serve. If set, content addressed stores read through
+// and write through it, so that blobs are shared across machines.
+var Remote = ""
+
+// digestPattern is the name of an entry of a content addressed store
+var digestPattern = regexp.MustCompile(`^[a-f0-9]{64}$`)
+
+// httpstore is a content addressed store reached over HTTP: GET, HEAD and PUT /<digest>, GET / lists the entries
+type httpstore struct {
+	url    string
+	client *http.Client
+}
+
+// NewHTTPStore opens the store served at url
+func NewHTTPStore(url string) CacheStore {
+	return &httpstore{
+		url:    strings.TrimSuffix(url, "/"),
+		client: &http.Client{Timeout: 10 * time.Minute},
+	}
+}
+
+// statusError maps the status of a response to the errors of a local store
+func statusError(digest string, resp *http.Response) error {
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("%s: %w", digest, os.ErrNotExist)
+	case http.StatusForbidden:
+		return ErrReadOnly
+	default:
+		return fmt.Errorf("%s: remote store replied %s", digest, resp.Status)
+	}
+}
+
+func (h *httpstore) Get(digest string) (io.ReadCloser, error) {
+	resp, err := h.client.Get(h.url + "/" + digest)
+	if err != nil {
+		return nil, err
+	}
+	if err := statusError(digest, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (h *httpstore) GetSize(digest string) (int64, error) {
+	resp, err := h.client.Head(h.url + "/" + digest)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if err := statusError(digest, resp); err != nil {
+		return 0, err
+	}
+	return resp.ContentLength, nil
+}
+
+// Add buffers the entry in a temporary file, it is uploaded on Commit once its digest is verified
+func (h *httpstore) Add(digest string) (EntryWriter, error) {
+	return newEntryWriter(os.TempDir(), digest, true, func(tmpPath string) error {
+		tmp, err := os.Open(tmpPath)
+		if err != nil {
+			return err
+		}
+		defer tmp.Close()
+		info, err := tmp.Stat()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPut, h.url+"/"+digest, tmp)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = info.Size()
+		resp, err := h.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return statusError(digest, resp)
+	})
+}
+
+// Del does nothing: the entries of a shared store are removed by the machine serving it
+func (h *httpstore) Del(digest string) error {
+	return nil
+}
+
+// Check returns true if the remote store has the entry, entries are verified by the server when uploaded
+func (h *httpstore) Check(digest string) bool {
+	_, err := h.GetSize(digest)
+	return err == nil
+}
+
+func (h *httpstore) List() []string {
+	resp, err := h.client.Get(h.url + "/")
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	entries := []string{}
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if entry := strings.TrimSpace(scanner.Text()); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Handler serves store with the protocol of NewHTTPStore. Uploaded entries are verified against their digest,
+// uploads larger than maxUploadSize bytes are rejected. A maxUploadSize of 0 does not limit uploads.
+func Handler(store CacheStore, maxUploadSize int64) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, entry := range store.List() {
+			fmt.Fprintln(w, entry)
+		}
+	})
+	mux.HandleFunc("HEAD /{digest}", func(w http.ResponseWriter, r *http.Request) {
+		digest := r.PathValue("digest")
+		if !digestPattern.MatchString(digest) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		size, err := store.GetSize(digest)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+	})
+	mux.HandleFunc("GET /{digest}", func(w http.ResponseWriter, r *http.Request) {
+		digest := r.PathValue("digest")
+		if !digestPattern.MatchString(digest) {
+			http.NotFound(w, r)
+			return
+		}
+		size, err := store.GetSize(digest)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		reader, err := store.Get(digest)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer reader.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(size))
+		io.CopyBuffer(w, reader, make([]byte, 1024*1024))
+	})
+	mux.HandleFunc("PUT /{digest}", func(w http.ResponseWriter, r *http.Request) {
+		digest := r.PathValue("digest")
+		if !digestPattern.MatchString(digest) {
+			http.Error(w, "invalid digest", http.StatusBadRequest)
+			return
+		}
+		if store.Check(digest) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writer, err := store.Add(digest)
+		if errors.Is(err, ErrReadOnly) {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body := r.Body
+		if maxUploadSize > 0 {
+			body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+		}
+		_, err = io.CopyBuffer(writer, body, make([]byte, 1024*1024))
+		if err != nil {
+			writer.Abort()
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = writer.Commit()
+		if err != nil {
+			// the content does not match the digest
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("%s [STORED]", digest)
+		w.WriteHeader(http.StatusCreated)
+	})
+	return mux
+}
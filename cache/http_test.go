@@ -0,0 +1,110 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTieredHTTPStore(t *testing.T) {
+	served, err := NewCacheStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(Handler(served, 64))
+	defer server.Close()
+	remote := NewHTTPStore(server.URL)
+
+	shared := []byte("base layer pulled by a teammate")
+	sharedDigest := fmt.Sprintf("%x", sha256.Sum256(shared))
+	if err := WriteEntry(served, sharedDigest, shared); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := remote.GetSize(sharedDigest); err != nil || size != int64(len(shared)) {
+		t.Fatalf("unexpected remote size %d, %v", size, err)
+	}
+	if remote.Check(fmt.Sprintf("%x", sha256.Sum256([]byte("unknown")))) {
+		t.Fatalf("remote store reports an unknown entry")
+	}
+
+	local, err := NewCacheStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered := NewTieredStore(local, remote)
+
+	// read through, checking an entry does not fetch it
+	if !tiered.Check(sharedDigest) || local.Check(sharedDigest) {
+		t.Fatalf("entry fetched from the remote store by a check")
+	}
+	reader, err := tiered.Get(sharedDigest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(reader)
+	reader.Close()
+	if string(content) != string(shared) {
+		t.Fatalf("unexpected content %q", content)
+	}
+	if !local.Check(sharedDigest) {
+		t.Fatalf("entry not fetched from the remote store")
+	}
+	if err := Verify(tiered, sharedDigest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(recordPath(local.(*cachestore).path, sharedDigest)); err != nil {
+		t.Fatalf("verification of the tiered store not recorded locally: %v", err)
+	}
+
+	// write through
+	built := []byte("allotment compressed by this machine")
+	builtDigest := fmt.Sprintf("%x", sha256.Sum256(built))
+	if err := WriteEntry(tiered, builtDigest, built); err != nil {
+		t.Fatal(err)
+	}
+	if !served.Check(builtDigest) {
+		t.Fatalf("entry not uploaded to the remote store")
+	}
+	if entries := remote.List(); len(entries) != 2 {
+		t.Fatalf("unexpected remote entries %v", entries)
+	}
+
+	// the server rejects content not matching its digest
+	forged := fmt.Sprintf("%x", sha256.Sum256([]byte("forged")))
+	req, _ := http.NewRequest(http.MethodPut, server.URL+"/"+forged, strings.NewReader("forged content"))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest || served.Check(forged) {
+		t.Fatalf("forged entry accepted by the server: %s", resp.Status)
+	}
+	large := []byte(strings.Repeat("x", 65))
+	largeDigest := fmt.Sprintf("%x", sha256.Sum256(large))
+	req, _ = http.NewRequest(http.MethodPut, server.URL+"/"+largeDigest, strings.NewReader(string(large)))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || served.Check(largeDigest) {
+		t.Fatalf("upload over the size limit accepted by the server: %s", resp.Status)
+	}
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		req, _ = http.NewRequest(method, server.URL+"/..%2f..%2fetc%2fpasswd", nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("invalid digest served on %s: %s", method, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package cache
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// LockFile in the store root is locked shared by the commands using the store and exclusive by the ones deleting from it
+	LockFile = "lock"
+	// LeasesDir in the store root holds the digests pinned by running builds, one file per build
+	LeasesDir = "leases"
+)
+
+// StoreLock is a file lock on a store root, held across processes
+type StoreLock struct {
+	file *os.File
+}
+
+// LockShared waits until no process holds the exclusive lock of the store at root, then locks it shared
+func LockShared(root string) (*StoreLock, error) {
+	return lockStore(root, syscall.LOCK_SH)
+}
+
+// LockExclusive waits until no other process uses the store at root, then locks it exclusively
+func LockExclusive(root string) (*StoreLock, error) {
+	return lockStore(root, syscall.LOCK_EX)
+}
+
+func lockStore(root string, how int) (*StoreLock, error) {
+	file, err := os.OpenFile(filepath.Join(root, LockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		fmt.Printf("Waiting for other tdfs processes using %s [LOCKED]\n", root)
+		err = flockRetry(file, how)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("unable to lock store %s: %w", root, err)
+	}
+	return &StoreLock{file: file}, nil
+}
+
+// flockRetry blocks on the lock, retrying when interrupted by a signal
+func flockRetry(file *os.File, how int) error {
+	for {
+		err := syscall.Flock(int(file.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
+
+// ErrStoreBusy is returned by TryLockExclusive when other processes use the store
+var ErrStoreBusy = errors.New("store in use by other tdfs processes")
+
+// TryLockExclusive locks the store at root exclusively without waiting, it returns ErrStoreBusy if other processes use it
+func TryLockExclusive(root string) (*StoreLock, error) {
+	file, err := os.OpenFile(filepath.Join(root, LockFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrStoreBusy
+		}
+		return nil, fmt.Errorf("unable to lock store %s: %w", root, err)
+	}
+	return &StoreLock{file: file}, nil
+}
+
+// Unlock releases the lock, it is also released when the process exits
+func (l *StoreLock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	defer l.file.Close()
+	err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file = nil
+	return err
+}
+
+// Lease pins the entries a running build is about to reference, so that a prune does not remove them
+// before the build writes its index. The lease file stays locked while the build runs.
+// A build does not hold the store lock while it runs: every entry is pinned and accessed under a short shared lock,
+// so a prune, holding the exclusive lock while it marks and sweeps, either sees the pin or ran before the access.
+type Lease struct {
+	root   string
+	path   string
+	file   *os.File
+	mtx    sync.Mutex
+	pinned map[string]bool
+}
+
+// NewLease creates a lease in the store at root
+func NewLease(root string) (*Lease, error) {
+	if ReadOnly {
+		return nil, ErrReadOnly
+	}
+	dir := filepath.Join(root, LeasesDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	// locked under a temporary name, a prune would otherwise take the lease of a starting build for a stale one
+	file, err := os.CreateTemp(dir, fmt.Sprintf(".%d-*", os.Getpid()))
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, strings.TrimPrefix(filepath.Base(file.Name()), "."))
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		err = os.Rename(file.Name(), path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &Lease{root: root, path: path, file: file, pinned: map[string]bool{}}, nil
+}
+
+// Pin records the digests in the lease
+func (l *Lease) Pin(digests ...string) error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return fmt.Errorf("lease already released")
+	}
+	lines := strings.Builder{}
+	for _, digest := range digests {
+		if digest == "" || l.pinned[digest] {
+			continue
+		}
+		l.pinned[digest] = true
+		lines.WriteString(digest + "\n")
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+	_, err := l.file.WriteString(lines.String())
+	return err
+}
+
+// Release removes the lease, the pinned entries are kept only if referenced by an index
+func (l *Lease) Release() error {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Close()
+	l.file = nil
+	return os.Remove(l.path)
+}
+
+// Store wraps store so that every entry added, read or checked through it is pinned by the lease
+func (l *Lease) Store(store CacheStore) CacheStore {
+	return &leasedstore{CacheStore: store, lease: l}
+}
+
+// Locked wraps store so that its entries are read, added and removed under a shared lock of the store,
+// without pinning them: the entries of the index store are kept by their name, not by the blobs referencing them
+func (l *Lease) Locked(store CacheStore) CacheStore {
+	return &lockedstore{CacheStore: store, root: l.root}
+}
+
+// LeasedDigests returns the digests pinned by the running builds of the store at root.
+// If removeStale is set, the leases left behind by builds that are no longer running are removed:
+// only a command holding the exclusive lock of the store may remove them.
+func LeasedDigests(root string, removeStale bool) (map[string]bool, error) {
+	leased := map[string]bool{}
+	dir := filepath.Join(root, LeasesDir)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return leased, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if removeStale {
+		cleanStaleTemp(dir)
+	}
+	for _, entry := range entries {
+		if isTemp(entry.Name()) {
+			// a lease being created
+			continue
+		}
+		err := readLease(filepath.Join(dir, entry.Name()), removeStale, leased)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return leased, nil
+}
+
+// readLease adds the digests of the lease at path to leased, or removes the lease if its build is gone and removeStale is set
+func readLease(path string, removeStale bool, leased map[string]bool) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		// nobody holds the lease anymore
+		if ReadOnly || !removeStale {
+			return nil
+		}
+		return os.Remove(path)
+	}
+	if !errors.Is(err, syscall.EWOULDBLOCK) {
+		return err
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if digest := strings.TrimSpace(scanner.Text()); digest != "" {
+			leased[digest] = true
+		}
+	}
+	return scanner.Err()
+}
+
+// leasedstore pins the entries it serves, under a shared lock of the store
+type leasedstore struct {
+	CacheStore
+	lease *Lease
+}
+
+func (s *leasedstore) Unwrap() CacheStore {
+	return s.CacheStore
+}
+
+func (s *leasedstore) Get(digest string) (io.ReadCloser, error) {
+	lock, err := LockShared(s.lease.root)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	s.lease.Pin(digest)
+	return s.CacheStore.Get(digest)
+}
+
+func (s *leasedstore) Add(digest string) (EntryWriter, error) {
+	lock, err := LockShared(s.lease.root)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	// pinned before the entry becomes visible
+	err = s.lease.Pin(digest)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := s.CacheStore.Add(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &leasedWriter{EntryWriter: writer, root: s.lease.root}, nil
+}
+
+func (s *leasedstore) Check(digest string) bool {
+	lock, err := LockShared(s.lease.root)
+	if err != nil {
+		return false
+	}
+	defer lock.Unlock()
+	s.lease.Pin(digest)
+	return s.CacheStore.Check(digest)
+}
+
+// lockedstore accesses its entries under a shared lock of the store
+type lockedstore struct {
+	CacheStore
+	root string
+}
+
+func (s *lockedstore) Unwrap() CacheStore {
+	return s.CacheStore
+}
+
+func (s *lockedstore) Get(digest string) (io.ReadCloser, error) {
+	lock, err := LockShared(s.root)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+	return s.CacheStore.Get(digest)
+}
+
+func (s *lockedstore) Add(digest string) (EntryWriter, error) {
+	writer, err := s.CacheStore.Add(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &leasedWriter{EntryWriter: writer, root: s.root}, nil
+}
+
+func (s *lockedstore) Del(digest string) error {
+	lock, err := LockShared(s.root)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	return s.CacheStore.Del(digest)
+}
+
+// leasedWriter commits under a shared lock of the store, so that the entry is never moved into place while
+// a command holding the exclusive lock rewrites the store
+type leasedWriter struct {
+	EntryWriter
+	root string
+}
+
+func (w *leasedWriter) Commit() error {
+	lock, err := LockShared(w.root)
+	if err != nil {
+		w.EntryWriter.Abort()
+		return err
+	}
+	defer lock.Unlock()
+	return w.EntryWriter.Commit()
+}
+
+func (w *leasedWriter) Close() error {
+	lock, err := LockShared(w.root)
+	if err != nil {
+		w.EntryWriter.Abort()
+		return err
+	}
+	defer lock.Unlock()
+	return w.EntryWriter.Close()
+}
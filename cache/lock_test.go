@@ -0,0 +1,163 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoreLock(t *testing.T) {
+	root := t.TempDir()
+	first, err := LockShared(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LockShared(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan *StoreLock)
+	go func() {
+		exclusive, err := LockExclusive(root)
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- exclusive
+	}()
+	first.Unlock()
+	select {
+	case <-locked:
+		t.Fatalf("exclusive lock acquired while a shared lock is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+	second.Unlock()
+	select {
+	case exclusive := <-locked:
+		exclusive.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatalf("exclusive lock not acquired once the shared locks were released")
+	}
+}
+
+func TestLease(t *testing.T) {
+	root := t.TempDir()
+	blobs := filepath.Join(root, "blobs")
+	if err := os.Mkdir(blobs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCacheStore(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := NewLease(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("allotment")
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	if err := WriteEntry(lease.Store(store), digest, content); err != nil {
+		t.Fatal(err)
+	}
+	lease.Store(store).Check("base")
+
+	// a lease whose build is gone
+	stale := filepath.Join(root, LeasesDir, "stale")
+	if err := os.WriteFile(stale, []byte("orphan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a lease not locked yet by the build creating it
+	starting := filepath.Join(root, LeasesDir, ".starting")
+	if err := os.WriteFile(starting, []byte("pending\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// commands without the exclusive lock leave stale leases in place
+	if _, err := LeasedDigests(root, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatalf("stale lease removed while only reading leases: %v", err)
+	}
+
+	leased, err := LeasedDigests(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leased[digest] || !leased["base"] || leased["orphan"] || len(leased) != 2 {
+		t.Fatalf("unexpected leased digests %v", leased)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale lease not removed")
+	}
+	if _, err := os.Stat(starting); err != nil {
+		t.Fatalf("lease being created removed: %v", err)
+	}
+
+	if err := lease.Release(); err != nil {
+		t.Fatal(err)
+	}
+	leased, err = LeasedDigests(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leased) != 0 {
+		t.Fatalf("released lease still pins %v", leased)
+	}
+	if err := lease.Pin(digest); err == nil {
+		t.Fatalf("released lease accepted a pin")
+	}
+}
+
+func TestLeaseWaitsForExclusiveLock(t *testing.T) {
+	root := t.TempDir()
+	blobs := filepath.Join(root, "blobs")
+	if err := os.Mkdir(blobs, 0755); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCacheStore(blobs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lease, err := NewLease(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+
+	// a prune holding the store: the build must not pin behind its back
+	prune, err := LockExclusive(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checked := make(chan bool)
+	go func() {
+		checked <- lease.Store(store).Check("base")
+	}()
+	select {
+	case <-checked:
+		t.Fatalf("leased check ran while the store was locked exclusively")
+	case <-time.After(100 * time.Millisecond):
+	}
+	leased, err := LeasedDigests(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leased["base"] {
+		t.Fatalf("digest pinned while the store was locked exclusively")
+	}
+	if err := prune.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	<-checked
+	leased, err = LeasedDigests(root, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leased["base"] {
+		t.Fatalf("digest not pinned after the exclusive lock was released")
+	}
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RecordsDir in a metadata store holds a JSON record describing every entry, removed along with the entry
+const RecordsDir = ".records"
+
+// WriteRecord replaces the record of the entry of store atomically, stores other than local directories keep no records
+func WriteRecord(store CacheStore, name string, record any) error {
+	b, ok := localStore(store)
+	if !ok {
+		return nil
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(b.path, RecordsDir)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	writer, err := newEntryWriter(dir, name, false, func(tmpPath string) error {
+		return os.Rename(tmpPath, filepath.Join(dir, name))
+	})
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(recordBytes)
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
+}
+
+// ReadRecord decodes the record of the entry of store into record, it returns os.ErrNotExist if there is none
+func ReadRecord(store CacheStore, name string, record any) error {
+	b, ok := localStore(store)
+	if !ok {
+		return os.ErrNotExist
+	}
+	recordBytes, err := os.ReadFile(filepath.Join(b.path, RecordsDir, name))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(recordBytes, record)
+}
+
+// DelRecord removes the record of the entry of store, the entry is left in the store
+func DelRecord(store CacheStore, name string) error {
+	b, ok := localStore(store)
+	if !ok {
+		return nil
+	}
+	if b.readOnly {
+		return ErrReadOnly
+	}
+	err := os.Remove(filepath.Join(b.path, RecordsDir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// ModTime returns when the entry of store was last written
+func ModTime(store CacheStore, name string) time.Time {
+	b, ok := localStore(store)
+	if !ok {
+		return time.Time{}
+	}
+	info, err := os.Stat(filepath.Join(b.path, name))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestRecords(t *testing.T) {
+	store, err := NewMetadataStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEntry(store, "app", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	type record struct {
+		Name string `json:"name"`
+	}
+	read := record{}
+	if err := ReadRecord(store, "app", &read); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected record of a new entry: %v", err)
+	}
+	if err := WriteRecord(store, "app", record{Name: "v1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteRecord(store, "app", record{Name: "v2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadRecord(store, "app", &read); err != nil || read.Name != "v2" {
+		t.Fatalf("unexpected record %v, %v", read, err)
+	}
+	if entries := store.List(); len(entries) != 1 {
+		t.Fatalf("records listed as entries: %v", entries)
+	}
+
+	if err := DelRecord(store, "app"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetSize("app"); err != nil {
+		t.Fatalf("record removal touched the entry: %v", err)
+	}
+	if err := DelRecord(store, "app"); err != nil {
+		t.Fatal(err)
+	}
+	WriteRecord(store, "app", record{Name: "v3"})
+	store.Del("app")
+	if err := ReadRecord(store, "app", &read); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("record left behind by the removed entry: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+)
+
+// tieredstore reads through and writes through a remote store: missing entries are fetched from the remote
+// store into the local one, new entries are uploaded to the remote store once committed locally
+type tieredstore struct {
+	local  CacheStore
+	remote CacheStore
+}
+
+// NewTieredStore layers remote behind local, removals and listings only concern local
+func NewTieredStore(local CacheStore, remote CacheStore) CacheStore {
+	return &tieredstore{local: local, remote: remote}
+}
+
+// fetch copies the entry from the remote store into the local one
+func (t *tieredstore) fetch(digest string) error {
+	reader, err := t.remote.Get(digest)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	writer, err := t.local.Add(digest)
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyBuffer(writer, reader, make([]byte, 1024*1024))
+	if err != nil {
+		writer.Abort()
+		return err
+	}
+	err = writer.Commit()
+	if err != nil {
+		return err
+	}
+	log.Printf("%s [FETCHED FROM REMOTE CACHE]", digest)
+	return nil
+}
+
+// push uploads a local entry to the remote store, failures only cost sharing the entry
+func (t *tieredstore) push(digest string) {
+	if t.remote.Check(digest) {
+		return
+	}
+	err := func() error {
+		reader, err := t.local.Get(digest)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		writer, err := t.remote.Add(digest)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyBuffer(writer, reader, make([]byte, 1024*1024))
+		if err != nil {
+			writer.Abort()
+			return err
+		}
+		return writer.Commit()
+	}()
+	if err != nil {
+		log.Printf("Remote cache upload of %s [SKIPPED]: %v", digest, err)
+	}
+}
+
+func (t *tieredstore) Get(digest string) (io.ReadCloser, error) {
+	reader, err := t.local.Get(digest)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return reader, err
+	}
+	fetchErr := t.fetch(digest)
+	if errors.Is(fetchErr, ErrReadOnly) {
+		// nothing can be cached locally, the entry is streamed from the remote store
+		return t.remote.Get(digest)
+	}
+	if fetchErr != nil {
+		return nil, err
+	}
+	return t.local.Get(digest)
+}
+
+func (t *tieredstore) GetSize(digest string) (int64, error) {
+	size, err := t.local.GetSize(digest)
+	if err == nil {
+		return size, nil
+	}
+	return t.remote.GetSize(digest)
+}
+
+func (t *tieredstore) Add(digest string) (EntryWriter, error) {
+	writer, err := t.local.Add(digest)
+	if err != nil {
+		return nil, err
+	}
+	return &writeThrough{EntryWriter: writer, store: t, digest: digest}, nil
+}
+
+func (t *tieredstore) Del(digest string) error {
+	return t.local.Del(digest)
+}
+
+// Check asks the remote store about missing entries without fetching them, they are fetched when read
+func (t *tieredstore) Check(digest string) bool {
+	return t.local.Check(digest) || t.remote.Check(digest)
+}
+
+func (t *tieredstore) Unwrap() CacheStore {
+	return t.local
+}
+
+func (t *tieredstore) List() []string {
+	return t.local.List()
+}
+
+// writeThrough uploads the entry to the remote store once committed locally
+type writeThrough struct {
+	EntryWriter
+	store  *tieredstore
+	digest string
+}
+
+func (w *writeThrough) Commit() error {
+	err := w.EntryWriter.Commit()
+	if err != nil {
+		return err
+	}
+	w.store.push(w.digest)
+	return nil
+}
+
+func (w *writeThrough) Close() error {
+	return w.Commit()
+}
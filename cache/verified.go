@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// VerifiedDir in a content addressed store holds the record of the last integrity check of every entry
+const VerifiedDir = ".verified"
+
+var (
+	// ErrMissing is returned by Verify for entries that are not in the store
+	ErrMissing = errors.New("missing")
+	// ErrCorrupt is returned by Verify for entries whose content does not match their digest
+	ErrCorrupt = errors.New("corrupt")
+)
+
+// verifiedRecord is the state of an entry when its digest was last checked, the entry is not rehashed while unchanged
+type verifiedRecord struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"mtime"`
+	VerifiedAt time.Time `json:"verifiedAt"`
+}
+
+// hashEntry streams the content of reader through sha256
+func hashEntry(reader io.Reader) (string, error) {
+	hash := sha256.New()
+	_, err := io.CopyBuffer(hash, reader, make([]byte, 1024*1024))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// recordPath is where the store rooted at path keeps the verification record of an entry
+func recordPath(path string, digest string) string {
+	return filepath.Join(path, VerifiedDir, digest)
+}
+
+// isVerified returns true if the entry of the store rooted at path did not change since its digest was last checked.
+// info describes the file the entry is stored in: the blob itself, or the recipe of a chunked blob.
+func isVerified(path string, digest string, info os.FileInfo) bool {
+	recordBytes, err := os.ReadFile(recordPath(path, digest))
+	if err != nil {
+		return false
+	}
+	record := verifiedRecord{}
+	if json.Unmarshal(recordBytes, &record) != nil {
+		return false
+	}
+	return record.Size == info.Size() && record.ModTime.Equal(info.ModTime())
+}
+
+// recordVerified persists the state of an entry whose digest was just checked, failures only cost a rehash later
+func recordVerified(path string, readOnly bool, digest string, info os.FileInfo) {
+	if readOnly {
+		return
+	}
+	recordBytes, err := json.Marshal(verifiedRecord{Size: info.Size(), ModTime: info.ModTime(), VerifiedAt: time.Now()})
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(path, VerifiedDir)
+	if os.MkdirAll(dir, 0755) != nil {
+		return
+	}
+	writer, err := newEntryWriter(dir, digest, false, func(tmpPath string) error {
+		return os.Rename(tmpPath, recordPath(path, digest))
+	})
+	if err != nil {
+		return
+	}
+	if _, err := writer.Write(recordBytes); err != nil {
+		writer.Abort()
+		return
+	}
+	writer.Commit()
+}
+
+// Verify rehashes the entry, ignoring the record of previous checks, and returns ErrMissing or ErrCorrupt.
+// The entry is left in the store.
+func Verify(store CacheStore, digest string) error {
+	reader, err := store.Get(digest)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%s %w", digest, ErrMissing)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	actual, err := hashEntry(reader)
+	if errors.Is(err, os.ErrNotExist) {
+		// a chunk of the entry is missing
+		return fmt.Errorf("%s %w: %v", digest, ErrCorrupt, err)
+	}
+	if err != nil {
+		return err
+	}
+	if actual != digest {
+		return fmt.Errorf("%s %w: the content digest is %s", digest, ErrCorrupt, actual)
+	}
+	switch b := unwrap(store).(type) {
+	case *cachestore:
+		if info, err := os.Stat(filepath.Join(b.path, digest)); err == nil {
+			recordVerified(b.path, b.readOnly, digest, info)
+		}
+	case *chunkedstore:
+		if info, err := b.entryInfo(digest); err == nil {
+			recordVerified(b.path, b.readOnly, digest, info)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifiedRecord(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("base layer")
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+	if err := WriteEntry(store, digest, content); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, VerifiedDir, digest)); err != nil {
+		t.Fatalf("committed entry not recorded as verified: %v", err)
+	}
+	if entries := store.List(); len(entries) != 1 || entries[0] != digest {
+		t.Fatalf("unexpected entries %v", entries)
+	}
+
+	// same size and mtime: the record is trusted by Check, but not by Verify
+	blob := filepath.Join(dir, digest)
+	info, _ := os.Stat(blob)
+	if err := os.WriteFile(blob, []byte("BASE LAYER"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(blob, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Check(digest) {
+		t.Fatalf("unchanged entry rehashed")
+	}
+	if err := Verify(store, digest); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected a corrupt entry, got %v", err)
+	}
+
+	// a changed mtime invalidates the record
+	later := info.ModTime().Add(time.Minute)
+	if err := os.Chtimes(blob, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if store.Check(digest) {
+		t.Fatalf("corrupt entry accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, VerifiedDir, digest)); !os.IsNotExist(err) {
+		t.Fatalf("record of an invalidated entry kept")
+	}
+	if err := Verify(store, digest); !errors.Is(err, ErrMissing) {
+		t.Fatalf("expected a missing entry, got %v", err)
+	}
+}
+
+func TestChunkedVerifiedRecord(t *testing.T) {
+	dir := t.TempDir()
+	if err := EnableChunking(dir); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := addBlob(t, store, bytes.Repeat([]byte("model weights "), 100000))
+	if _, err := os.Stat(filepath.Join(dir, VerifiedDir, digest)); err != nil {
+		t.Fatalf("committed blob not recorded as verified: %v", err)
+	}
+	recipe, err := store.(*chunkedstore).readRecipe(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same recipe: the record is trusted by Check, but not by Verify
+	chunk := filepath.Join(dir, ChunksDir, recipe.Chunks[0].Digest)
+	if err := os.WriteFile(chunk, bytes.Repeat([]byte("x"), int(recipe.Chunks[0].Size)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Check(digest) {
+		t.Fatalf("unchanged blob rehashed")
+	}
+	if err := Verify(store, digest); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected a corrupt blob, got %v", err)
+	}
+
+	// a missing chunk invalidates the record
+	if err := os.Remove(chunk); err != nil {
+		t.Fatal(err)
+	}
+	if store.Check(digest) {
+		t.Fatalf("blob with a missing chunk accepted")
+	}
+	if _, err := os.Stat(filepath.Join(dir, VerifiedDir, digest)); !os.IsNotExist(err) {
+		t.Fatalf("record of an invalidated blob kept")
+	}
+}
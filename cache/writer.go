@@ -0,0 +1,136 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// tempPrefix marks the files of entries being written, they are not listed nor served until committed
+	tempPrefix = ".add-"
+	// temporary files untouched for longer than staleTempAge were left behind by interrupted writes
+	staleTempAge = time.Hour
+)
+
+// EntryWriter writes a cache entry to a temporary file, the entry becomes visible only once committed
+type EntryWriter interface {
+	Write(p []byte) (int, error)
+	// Commit verifies the digest of the content, if the store is content addressed, and atomically moves the entry into place
+	Commit() error
+	// Abort discards the content written so far
+	Abort() error
+	// Close commits the entry, unless it was already committed or aborted
+	Close() error
+}
+
+// entryWriter hashes the content while writing it to a temporary file
+type entryWriter struct {
+	file   *os.File
+	hash   hash.Hash
+	digest string
+	// verify rejects content whose sha256 is not digest
+	verify bool
+	// commit moves the complete temporary file into the store
+	commit func(tmpPath string) error
+	done   bool
+	err    error
+}
+
+// newEntryWriter creates the temporary file of an entry in dir
+func newEntryWriter(dir string, digest string, verify bool, commit func(tmpPath string) error) (*entryWriter, error) {
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &entryWriter{file: tmp, hash: sha256.New(), digest: digest, verify: verify, commit: commit}, nil
+}
+
+func (w *entryWriter) Write(p []byte) (int, error) {
+	if w.done {
+		return 0, fmt.Errorf("cache entry %s already closed", w.digest)
+	}
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *entryWriter) Commit() error {
+	if w.done {
+		return w.err
+	}
+	w.done = true
+	defer os.Remove(w.file.Name())
+	w.err = func() error {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+		if w.verify {
+			if actual := fmt.Sprintf("%x", w.hash.Sum(nil)); actual != w.digest {
+				return fmt.Errorf("cache entry %s rejected, the content digest is %s", w.digest, actual)
+			}
+		}
+		if err := os.Chmod(w.file.Name(), 0644); err != nil {
+			return err
+		}
+		return w.commit(w.file.Name())
+	}()
+	return w.err
+}
+
+func (w *entryWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	w.err = fmt.Errorf("cache entry %s aborted", w.digest)
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+func (w *entryWriter) Close() error {
+	return w.Commit()
+}
+
+// isTemp returns true for the temporary files of the store
+func isTemp(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// cleanStaleTemp removes the temporary files left in dir by interrupted writes
+func cleanStaleTemp(dir string) {
+	if ReadOnly {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !isTemp(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempAge {
+			continue
+		}
+		os.Remove(filepath.Join(dir, entry.Name()))
+	}
+}
+
+// WriteEntry stores content as the entry digest of store
+func WriteEntry(store CacheStore, digest string, content []byte) error {
+	writer, err := store.Add(digest)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(content); err != nil {
+		writer.Abort()
+		return err
+	}
+	return writer.Commit()
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEntryWriter(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewCacheStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("layer content")
+	digest := fmt.Sprintf("%x", sha256.Sum256(content))
+
+	// entries are invisible until committed
+	writer, err := store.Add(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := writer.Write(content[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(digest); err == nil || len(store.List()) != 0 {
+		t.Fatalf("uncommitted entry visible")
+	}
+	if err := writer.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Commit(); err == nil {
+		t.Fatalf("aborted entry committed")
+	}
+
+	// truncated content is rejected
+	writer, err = store.Add(digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer.Write(content[:5])
+	if err := writer.Commit(); err == nil {
+		t.Fatalf("truncated entry committed")
+	}
+	if _, err := store.Get(digest); err == nil {
+		t.Fatalf("truncated entry stored")
+	}
+
+	if err := WriteEntry(store, digest, content); err != nil {
+		t.Fatal(err)
+	}
+	if !store.Check(digest) || len(store.List()) != 1 {
+		t.Fatalf("committed entry not stored: %v", store.List())
+	}
+	leftovers, _ := filepath.Glob(filepath.Join(dir, tempPrefix+"*"))
+	if len(leftovers) != 0 {
+		t.Fatalf("temporary files left: %v", leftovers)
+	}
+
+	// metadata stores accept entries named by the caller
+	metadata, err := NewMetadataStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEntry(metadata, "index", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteEntry(metadata, "index", []byte(`{"manifests":[]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := metadata.GetSize("index"); err != nil || size != 16 {
+		t.Fatalf("entry not replaced: %d, %v", size, err)
+	}
+}
+
+func TestCleanStaleTemp(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, tempPrefix+"stale")
+	fresh := filepath.Join(dir, tempPrefix+"fresh")
+	for _, p := range []string{stale, fresh} {
+		if err := os.WriteFile(p, []byte("partial"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * staleTempAge)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCacheStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale temporary file not removed")
+	}
+	if _, err := os.Stat(fresh); err != nil {
+		t.Fatalf("temporary file of a running write removed")
+	}
+}
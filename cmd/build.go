@@ -2,12 +2,18 @@ package cmd
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/sha256"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/2DFS/2dfs-builder/cache"
 	"github.com/2DFS/2dfs-builder/filesystem"
 	"github.com/2DFS/2dfs-builder/oci"
 	"github.com/spf13/cobra"
@@ -18,6 +24,11 @@ func init() {
 	buildCmd.Flags().StringVar(&exportFormat, "as", "", "export format, supported formats: tar")
 	buildCmd.Flags().BoolVar(&forcePull, "force-pull", false, "force pull the base image")
 	buildCmd.Flags().BoolVar(&forceHttp, "force-http", false, "force pull via http")
+	buildCmd.Flags().BoolVar(&estargz, "estargz", false, "generate lazy-pullable allotment layers in eStargz format")
+	buildCmd.Flags().StringVar(&deltaFrom, "delta-from", "", "previous local image: changed allotments reference a binary delta from the same cell of this image")
+	buildCmd.Flags().StringArrayVar(&encryptRecipients, "encrypt-recipient", []string{}, "X25519 public key (PEM) the allotments marked encrypt are encrypted for, can be repeated")
+	buildCmd.Flags().StringVar(&signKey, "sign-key", "", "ed25519 or ECDSA private key (PEM) signing the field and its allotments")
+	buildCmd.Flags().StringVar(&owner, "owner", "", "publisher identity stored in the field. Default: the fingerprint of the signing key")
 	buildCmd.Flags().StringArrayVarP(&platfrorms, "platforms", "p", []string{}, "Filter the build platoforms. E.g. linux/amd64,linux/arm64. By default all the available platforms are used")
 	rootCmd.AddCommand(buildCmd)
 }
@@ -27,10 +38,17 @@ var forcePull bool
 var forceHttp bool
 var exportFormat string
 var platfrorms []string
+var estargz bool
+var deltaFrom string
+var encryptRecipients []string
+var signKey string
+var owner string
 var buildCmd = &cobra.Command{
 	Use:   "build [base image] [target image]",
 	Short: "Build a 2dfs field from an oci image link",
 	Args:  cobra.ExactArgs(2),
+	// the lease protects the blobs of the build, a prune can run while it pulls and compresses
+	Annotations: map[string]string{storeLockAnnotation: leaseLock},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return build(args[0], args[1])
 	},
@@ -58,11 +76,43 @@ func build(imgFrom string, imgTarget string) error {
 	}
 	log.Default().Println("Manifest parsed")
 
+	recipients := []*ecdh.PublicKey{}
+	for _, recipient := range encryptRecipients {
+		key, err := oci.ReadPublicKey(recipient)
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, key)
+	}
+
+	buildOptions := oci.BuildOptions{EStargz: estargz, DeltaFrom: deltaFrom, Recipients: recipients, Owner: owner}
+	buildOptions.Provenance = oci.ProvenanceOptions{
+		BuilderVersion: Version,
+		ManifestPath:   buildFile,
+		ManifestDigest: fmt.Sprintf("%x", sha256.Sum256(bytes)),
+		Parameters:     buildParameters(imgFrom, imgTarget),
+	}
+	if signKey != "" {
+		buildOptions.SignKey, err = oci.ReadSigningKey(signKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	// pin the blobs used by the build until its index is written
+	lease, err := cache.NewLease(basePath)
+	if err != nil {
+		return err
+	}
+	defer lease.Release()
+
 	// build the 2dfs field
 	ctx := context.Background()
 	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
 	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
 	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	ctx = context.WithValue(ctx, oci.BuildOptionsContextKey, buildOptions)
+	ctx = context.WithValue(ctx, oci.LeaseContextKey, lease)
 	log.Default().Println("Getting Image")
 	oci.PullPushProtocol = "https"
 	if forceHttp {
@@ -98,6 +148,12 @@ func build(imgFrom string, imgTarget string) error {
 		}
 	}
 
+	// keep the store within its size limit, the built image was just used and is not evicted
+	err = enforceStoreLimit()
+	if err != nil {
+		return err
+	}
+
 	timeend := time.Now().UnixMilli()
 	totTime := timeend - timestart
 	buildTime := timeend - buildstart
@@ -108,3 +164,27 @@ func build(imgFrom string, imgTarget string) error {
 	log.Default().Printf("Done!  ✅ (%fs)\n", timeS)
 	return nil
 }
+
+// buildParameters returns the build flags recorded in the provenance statement, private keys are recorded by path only
+func buildParameters(imgFrom string, imgTarget string) map[string]string {
+	parameters := map[string]string{
+		"base":      imgFrom,
+		"target":    imgTarget,
+		"file":      buildFile,
+		"estargz":   strconv.FormatBool(estargz),
+		"forcePull": strconv.FormatBool(forcePull),
+	}
+	optional := map[string]string{
+		"deltaFrom":         deltaFrom,
+		"owner":             owner,
+		"signKey":           signKey,
+		"platforms":         strings.Join(platfrorms, ","),
+		"encryptRecipients": strings.Join(encryptRecipients, ","),
+	}
+	for name, value := range optional {
+		if value != "" {
+			parameters[name] = value
+		}
+	}
+	return parameters
+}
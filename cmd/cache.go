@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheStatsCmd.Flags().StringVar(&outputFormat, "format", "table", "output format, supported formats: table, json")
+	cacheCmd.AddCommand(cacheChunkingCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	cacheVerifyCmd.Flags().BoolVar(&repair, "repair", false, "remove corrupt blobs, stale cache keys and the images referencing missing or corrupt blobs")
+	cacheCmd.AddCommand(cacheGcCmd)
+	cacheCmd.AddCommand(cacheServeCmd)
+	cacheServeCmd.Flags().StringVar(&listenAddress, "listen", "127.0.0.1:7000", "address the store is served on, e.g. :7000 to serve every interface")
+	cacheServeCmd.Flags().StringVar(&maxUploadSize, "max-upload-size", "10GiB", "largest blob accepted on upload, e.g. 2GB. 0 does not limit uploads")
+	cacheGcCmd.Flags().StringVar(&targetSize, "target-size", "", "size the store is reduced to, e.g. 10GB. Default: --max-store-size")
+}
+
+var repair bool
+var targetSize string
+var listenAddress string
+var maxUploadSize string
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "Commands to manage the local blob store",
+}
+
+var cacheStatsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "show the size of the blob store and the space saved by chunk deduplication",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cacheStats()
+	},
+}
+
+var cacheChunkingCmd = &cobra.Command{
+	Use:       "chunking [enable|disable]",
+	Short:     "store blobs as deduplicated content-defined chunks, or reassemble them as whole files",
+	Args:      cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	ValidArgs: []string{"enable", "disable"},
+	// blobs are rewritten in place
+	Annotations: map[string]string{storeLockAnnotation: exclusiveLock},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if args[0] == "enable" {
+			err := cache.EnableChunking(BlobStorePath)
+			if err != nil {
+				return err
+			}
+			fmt.Println("Chunking [ENABLED]")
+			return nil
+		}
+		err := cache.DisableChunking(BlobStorePath)
+		if err != nil {
+			return err
+		}
+		fmt.Println("Chunking [DISABLED]")
+		return nil
+	},
+}
+
+var cacheVerifyCmd = &cobra.Command{
+	Use:         "verify",
+	Short:       "rehash every blob referenced by the local images and report the missing or corrupt ones",
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{storeLockAnnotation: "repair"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cacheVerify()
+	},
+}
+
+var cacheGcCmd = &cobra.Command{
+	Use:         "gc",
+	Short:       "evict the least recently used images, except the pinned ones, until the store fits the target size",
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{storeLockAnnotation: exclusiveLock},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		size := targetSize
+		if size == "" {
+			size = maxStoreSize
+		}
+		if size == "" {
+			return fmt.Errorf("no --target-size given and no --max-store-size set")
+		}
+		target, err := filesystem.ParseSize(size)
+		if err != nil {
+			return err
+		}
+		return evictImages(target, commandStart)
+	},
+}
+
+var cacheServeCmd = &cobra.Command{
+	Use:         "serve",
+	Short:       "serve the local blob store over HTTP, to be used by other machines with --remote-cache",
+	Args:        cobra.NoArgs,
+	Annotations: map[string]string{storeLockAnnotation: requestLock},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return cacheServe()
+	},
+}
+
+func cacheStats() error {
+	stats, err := cache.GetStats(BlobStorePath)
+	if err != nil {
+		return err
+	}
+	switch outputFormat {
+	case "json":
+		statsBytes, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(statsBytes))
+	case "table":
+		savings := 0.0
+		if stats.LogicalSize > 0 {
+			savings = float64(stats.Savings()) * 100 / float64(stats.LogicalSize)
+		}
+		statsTable := table.NewWriter()
+		statsTable.SetOutputMirror(os.Stdout)
+		statsTable.AppendHeader(table.Row{"Blobs", "Chunked", "Chunks", "Size", "On Disk", "Saved"})
+		statsTable.AppendSeparator()
+		statsTable.AppendRow([]interface{}{stats.Blobs, stats.ChunkedBlobs, stats.Chunks, formatBytes(stats.LogicalSize), formatBytes(stats.StoredSize), fmt.Sprintf("%s (%.1f%%)", formatBytes(stats.Savings()), savings)})
+		statsTable.SetStyle(tableStyle)
+		statsTable.Render()
+	default:
+		return fmt.Errorf("unsupported output format %s", outputFormat)
+	}
+	return nil
+}
+
+// cacheVerify walks every index down to the allotments and rehashes the blobs it references
+func cacheVerify() error {
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
+	if err != nil {
+		return err
+	}
+	blobCacheStore, err := cache.NewLocalStore(BlobStorePath)
+	if err != nil {
+		return err
+	}
+	blobDigestCacheStore, err := cache.NewMetadataStore(KeysStorePath)
+	if err != nil {
+		return err
+	}
+
+	// every blob is hashed once, even if shared by several images
+	results := map[string]error{}
+	verify := func(digest string) error {
+		if err, ok := results[digest]; ok {
+			return err
+		}
+		results[digest] = cache.Verify(blobCacheStore, digest)
+		return results[digest]
+	}
+
+	problems := 0
+	graph := oci.WalkReferences(indexCacheStore, blobCacheStore)
+	for _, image := range graph.Images {
+		name := image.Name
+		if name == "" {
+			name = image.IndexHash
+		}
+		broken := false
+		for _, blob := range image.Blobs {
+			err := verify(blob.Digest)
+			switch {
+			case errors.Is(err, cache.ErrMissing):
+				fmt.Printf("%s %s %s [MISSING]\n", name, blob.Kind, blob.Digest)
+			case errors.Is(err, cache.ErrCorrupt):
+				fmt.Printf("%s %s %s [CORRUPT]\n", name, blob.Kind, blob.Digest)
+			case err != nil:
+				return err
+			default:
+				continue
+			}
+			broken = true
+		}
+		// unreadable blobs with a valid digest
+		if !broken && len(image.Errors) > 0 {
+			for _, e := range image.Errors {
+				fmt.Printf("%s %s [UNREADABLE]\n", name, e)
+			}
+			broken = true
+		}
+		if !broken {
+			continue
+		}
+		problems++
+		if repair {
+			indexCacheStore.Del(image.IndexHash)
+			fmt.Printf("%s [REMOVED], pull or build it again\n", name)
+		}
+	}
+
+	// cache keys pointing to missing or corrupt layers are rebuilt by the next build, they are only reported
+	for _, key := range blobDigestCacheStore.List() {
+		reader, err := blobDigestCacheStore.Get(key)
+		if err != nil {
+			return err
+		}
+		cachekeys, err := oci.ParseCacheKey(reader)
+		reader.Close()
+		if err != nil {
+			fmt.Printf("cache key %s [UNREADABLE]\n", key)
+			if repair {
+				blobDigestCacheStore.Del(key)
+			}
+			continue
+		}
+		validKeys := []oci.FileCacheKey{}
+		for _, k := range cachekeys.Keys {
+			if k.CompressedSha != "" && verify(k.CompressedSha) != nil {
+				fmt.Printf("cache key %s %s [STALE]\n", key, k.CompressedSha)
+				continue
+			}
+			validKeys = append(validKeys, k)
+		}
+		if !repair || len(validKeys) == len(cachekeys.Keys) {
+			continue
+		}
+		if len(validKeys) == 0 {
+			blobDigestCacheStore.Del(key)
+			continue
+		}
+		keyBytes, err := json.Marshal(oci.CacheKeys{Keys: validKeys})
+		if err != nil {
+			return err
+		}
+		err = cache.WriteEntry(blobDigestCacheStore, key, keyBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	if repair {
+		corrupt := []string{}
+		for digest, err := range results {
+			if errors.Is(err, cache.ErrCorrupt) {
+				corrupt = append(corrupt, digest)
+			}
+		}
+		failures := cache.DelEntries(blobCacheStore, corrupt)
+		for _, digest := range corrupt {
+			if err := failures[digest]; err != nil {
+				fmt.Printf("%s [NOT REMOVED]: %v\n", digest, err)
+				continue
+			}
+			fmt.Printf("%s [REMOVED]\n", digest)
+		}
+	}
+
+	fmt.Printf("Verified %d blobs of %d images\n", len(results), len(graph.Images))
+	if problems > 0 && !repair {
+		return fmt.Errorf("%d images reference missing or corrupt blobs, run tdfs cache verify --repair to remove them", problems)
+	}
+	return nil
+}
+
+// enforceStoreLimit evicts images if a build left the store larger than --max-store-size
+func enforceStoreLimit() error {
+	if maxStoreSize == "" {
+		return nil
+	}
+	limit, err := filesystem.ParseSize(maxStoreSize)
+	if err != nil {
+		return err
+	}
+	stats, err := cache.GetStats(BlobStorePath)
+	if err != nil {
+		return err
+	}
+	if stats.StoredSize <= limit {
+		return nil
+	}
+	// the shared lock is upgraded, eviction is left to a later command if other processes use the store
+	storeLock.Unlock()
+	storeLock, err = cache.TryLockExclusive(basePath)
+	if errors.Is(err, cache.ErrStoreBusy) {
+		fmt.Printf("Store size %s exceeds %s, eviction [SKIPPED]: %v\n", formatBytes(stats.StoredSize), formatBytes(limit), err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return evictImages(limit, commandStart)
+}
+
+// evictImages removes the least recently used images until the blob store fits target.
+// Pinned images and images used since the given time are kept.
+func evictImages(target int64, usedBefore time.Time) error {
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
+	if err != nil {
+		return err
+	}
+	blobCacheStore, err := cache.NewLocalStore(BlobStorePath)
+	if err != nil {
+		return err
+	}
+
+	for {
+		stats, err := cache.GetStats(BlobStorePath)
+		if err != nil {
+			return err
+		}
+		if stats.StoredSize <= target {
+			fmt.Printf("Store size %s fits %s\n", formatBytes(stats.StoredSize), formatBytes(target))
+			return nil
+		}
+
+		graph := oci.WalkReferences(indexCacheStore, blobCacheStore)
+		if walkErrors := graph.Errors(); len(walkErrors) > 0 {
+			return fmt.Errorf("unable to read the references of the local images, run tdfs cache verify: %s", strings.Join(walkErrors, "; "))
+		}
+		candidates := []oci.ImageReferences{}
+		for _, image := range graph.Images {
+			if cache.IsPinned(indexCacheStore, image.IndexHash) || !cache.LastAccess(indexCacheStore, image.IndexHash).Before(usedBefore) {
+				continue
+			}
+			candidates = append(candidates, image)
+		}
+		if len(candidates) == 0 {
+			fmt.Printf("[WARNING] Store size %s exceeds %s, but every image is pinned or in use\n", formatBytes(stats.StoredSize), formatBytes(target))
+			return nil
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return cache.LastAccess(indexCacheStore, candidates[i].IndexHash).Before(cache.LastAccess(indexCacheStore, candidates[j].IndexHash))
+		})
+
+		// evict until the blobs left without references cover the excess
+		references := graph.Referenced()
+		excess := stats.StoredSize - target
+		freed := int64(0)
+		for _, image := range candidates {
+			if freed >= excess {
+				break
+			}
+			err := indexCacheStore.Del(image.IndexHash)
+			if err != nil {
+				return fmt.Errorf("unable to evict %s: %w", image.Name, err)
+			}
+			for _, blob := range image.Blobs {
+				references[blob.Digest]--
+				if references[blob.Digest] == 0 {
+					size, err := blobCacheStore.GetSize(blob.Digest)
+					if err == nil {
+						freed += size
+					}
+				}
+			}
+			fmt.Printf("%s [EVICTED]\n", image.Name)
+		}
+		err = pruneBlobs()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// cacheServe serves the local blob store, the store is locked shared while serving each request so that prune can run in between
+func cacheServe() error {
+	// the served store never reads through another one
+	blobCacheStore, err := cache.NewLocalStore(BlobStorePath)
+	if err != nil {
+		return err
+	}
+	maxUpload, err := filesystem.ParseSize(maxUploadSize)
+	if err != nil {
+		return err
+	}
+	handler := cache.Handler(blobCacheStore, maxUpload)
+	log.Printf("Serving %s on %s", BlobStorePath, listenAddress)
+	return http.ListenAndServe(listenAddress, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !readOnly {
+			lock, err := cache.LockShared(basePath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			defer lock.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+}
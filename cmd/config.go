@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/2DFS/2dfs-builder/cache"
+)
+
+// StoreConfig locates a local store. Blobs, Index and Keys default to directories of Root.
+type StoreConfig struct {
+	Root  string `json:"root,omitempty"`
+	Blobs string `json:"blobs,omitempty"`
+	Index string `json:"index,omitempty"`
+	Keys  string `json:"keys,omitempty"`
+	// ReadOnly uses a pre-populated store without writing to it
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// MaxStoreSize is the default of --max-store-size
+	MaxStoreSize string `json:"maxStoreSize,omitempty"`
+	// Remote is the URL of a store served by tdfs cache serve, shared by the team
+	Remote string `json:"remote,omitempty"`
+}
+
+// Config is the content of the tdfs config file: the default store, and named stores selected with --store
+type Config struct {
+	StoreConfig
+	// Store is the named store used when --store is not given
+	Store  string                 `json:"store,omitempty"`
+	Stores map[string]StoreConfig `json:"stores,omitempty"`
+}
+
+var (
+	configFile  string
+	storeRoot   string
+	storeName   string
+	readOnly    bool
+	remoteCache string
+)
+
+// defaultConfigFile is $XDG_CONFIG_HOME/tdfs/config.json, or its platform equivalent
+func defaultConfigFile() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(configDir, "tdfs", "config.json")
+}
+
+// readConfig parses the config file, a missing default config file is an empty config
+func readConfig() (Config, error) {
+	config := Config{}
+	file := configFile
+	if file == "" {
+		file = os.Getenv("TDFS_CONFIG")
+	}
+	explicit := file != ""
+	if !explicit {
+		file = defaultConfigFile()
+	}
+	if file == "" {
+		return config, nil
+	}
+	configBytes, err := os.ReadFile(file)
+	if os.IsNotExist(err) && !explicit {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(configBytes, &config)
+	if err != nil {
+		return config, fmt.Errorf("invalid config file %s: %w", file, err)
+	}
+	return config, nil
+}
+
+// selectStore resolves the store paths out of the flags, the environment and the config file, in this order
+func selectStore() error {
+	config, err := readConfig()
+	if err != nil {
+		return err
+	}
+
+	store := config.StoreConfig
+	name := firstOf(storeName, os.Getenv("TDFS_STORE"), config.Store)
+	if name != "" {
+		named, ok := config.Stores[name]
+		if !ok {
+			return fmt.Errorf("store %s not found in the config file", name)
+		}
+		store = named
+	}
+	// an explicit root relocates the whole store
+	if root := firstOf(storeRoot, os.Getenv("TDFS_ROOT")); root != "" {
+		store = StoreConfig{Root: root, ReadOnly: store.ReadOnly, MaxStoreSize: store.MaxStoreSize, Remote: store.Remote}
+	}
+	if store.Root == "" {
+		store.Root = path.Join(homeDir, ".2dfs")
+	}
+
+	basePath = store.Root
+	BlobStorePath = firstOf(store.Blobs, path.Join(basePath, "blobs"))
+	IndexStorePath = firstOf(store.Index, path.Join(basePath, "index"))
+	KeysStorePath = firstOf(store.Keys, path.Join(basePath, "uncompressed-keys"))
+
+	if !readOnly {
+		readOnly, _ = strconv.ParseBool(os.Getenv("TDFS_READ_ONLY"))
+		readOnly = readOnly || store.ReadOnly
+	}
+	cache.ReadOnly = readOnly
+	if maxStoreSize == "" {
+		maxStoreSize = store.MaxStoreSize
+	}
+	cache.Remote = firstOf(remoteCache, os.Getenv("TDFS_REMOTE_CACHE"), store.Remote)
+	return nil
+}
+
+// createStoreDirs creates the directories of the store on first use
+func createStoreDirs() error {
+	if _, err := os.Stat(basePath); os.IsNotExist(err) {
+		fmt.Print("Creating base path: " + basePath + "\n")
+	}
+	for _, dir := range []string{basePath, BlobStorePath, IndexStorePath, KeysStorePath} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return fmt.Errorf("error creating store directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// firstOf returns the first non empty value
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2DFS/2dfs-builder/cache"
+)
+
+// useConfig restores the store settings changed by the test, and points the default config file at an empty directory
+func useConfig(t *testing.T) {
+	previousFlags := []string{configFile, storeRoot, storeName, remoteCache, maxStoreSize, homeDir}
+	previousPaths := []string{basePath, BlobStorePath, IndexStorePath, KeysStorePath, cache.Remote}
+	previousReadOnly, previousCacheReadOnly := readOnly, cache.ReadOnly
+	t.Cleanup(func() {
+		configFile, storeRoot, storeName, remoteCache, maxStoreSize, homeDir = previousFlags[0], previousFlags[1], previousFlags[2], previousFlags[3], previousFlags[4], previousFlags[5]
+		basePath, BlobStorePath, IndexStorePath, KeysStorePath, cache.Remote = previousPaths[0], previousPaths[1], previousPaths[2], previousPaths[3], previousPaths[4]
+		readOnly, cache.ReadOnly = previousReadOnly, previousCacheReadOnly
+	})
+	configFile, storeRoot, storeName, remoteCache, maxStoreSize = "", "", "", "", ""
+	readOnly = false
+	homeDir = "/home/dev"
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	for _, env := range []string{"TDFS_CONFIG", "TDFS_ROOT", "TDFS_STORE", "TDFS_READ_ONLY", "TDFS_REMOTE_CACHE"} {
+		t.Setenv(env, "")
+	}
+}
+
+func TestSelectStore(t *testing.T) {
+	config := `{
+		"root": "/config",
+		"stores": {
+			"ci": {"root": "/ci", "blobs": "/shared/blobs", "readOnly": true, "remote": "http://cache:7000"}
+		}
+	}`
+
+	tests := []struct {
+		name   string
+		config string
+		flags  func()
+		env    map[string]string
+		// expected root, blobs, index and keys paths
+		paths    []string
+		readOnly bool
+		remote   string
+	}{
+		{
+			name:  "default",
+			paths: []string{"/home/dev/.2dfs", "/home/dev/.2dfs/blobs", "/home/dev/.2dfs/index", "/home/dev/.2dfs/uncompressed-keys"},
+		},
+		{
+			name:   "config file",
+			config: config,
+			paths:  []string{"/config", "/config/blobs", "/config/index", "/config/uncompressed-keys"},
+		},
+		{
+			name:   "environment over config file",
+			config: config,
+			env:    map[string]string{"TDFS_ROOT": "/env"},
+			paths:  []string{"/env", "/env/blobs", "/env/index", "/env/uncompressed-keys"},
+		},
+		{
+			name:   "flag over environment",
+			config: config,
+			flags:  func() { storeRoot = "/flag" },
+			env:    map[string]string{"TDFS_ROOT": "/env"},
+			paths:  []string{"/flag", "/flag/blobs", "/flag/index", "/flag/uncompressed-keys"},
+		},
+		{
+			name:     "named store with separate blobs",
+			config:   config,
+			flags:    func() { storeName = "ci" },
+			paths:    []string{"/ci", "/shared/blobs", "/ci/index", "/ci/uncompressed-keys"},
+			readOnly: true,
+			remote:   "http://cache:7000",
+		},
+		{
+			name:     "named store from the environment",
+			config:   config,
+			env:      map[string]string{"TDFS_STORE": "ci", "TDFS_REMOTE_CACHE": "http://other:7000"},
+			paths:    []string{"/ci", "/shared/blobs", "/ci/index", "/ci/uncompressed-keys"},
+			readOnly: true,
+			remote:   "http://other:7000",
+		},
+		{
+			// the root relocates the separate paths of the store, its settings are kept
+			name:     "root over named store",
+			config:   config,
+			flags:    func() { storeName = "ci"; storeRoot = "/flag" },
+			paths:    []string{"/flag", "/flag/blobs", "/flag/index", "/flag/uncompressed-keys"},
+			readOnly: true,
+			remote:   "http://cache:7000",
+		},
+		{
+			name:     "read-only from the environment",
+			env:      map[string]string{"TDFS_READ_ONLY": "true"},
+			paths:    []string{"/home/dev/.2dfs", "/home/dev/.2dfs/blobs", "/home/dev/.2dfs/index", "/home/dev/.2dfs/uncompressed-keys"},
+			readOnly: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(t)
+			if tt.config != "" {
+				configFile = filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+			if tt.flags != nil {
+				tt.flags()
+			}
+
+			if err := selectStore(); err != nil {
+				t.Fatal(err)
+			}
+			paths := []string{basePath, BlobStorePath, IndexStorePath, KeysStorePath}
+			for i := range paths {
+				if paths[i] != tt.paths[i] {
+					t.Errorf("unexpected store paths %v, expected %v", paths, tt.paths)
+					break
+				}
+			}
+			if cache.ReadOnly != tt.readOnly {
+				t.Errorf("read-only %t", cache.ReadOnly)
+			}
+			if cache.Remote != tt.remote {
+				t.Errorf("unexpected remote %q", cache.Remote)
+			}
+		})
+	}
+
+	t.Run("unknown store", func(t *testing.T) {
+		useConfig(t)
+		storeName = "missing"
+		if err := selectStore(); err == nil {
+			t.Errorf("unknown store accepted")
+		}
+	})
+	t.Run("missing explicit config file", func(t *testing.T) {
+		useConfig(t)
+		configFile = filepath.Join(t.TempDir(), "missing.json")
+		if err := selectStore(); err == nil {
+			t.Errorf("missing config file accepted")
+		}
+	})
+}
+
+func TestStoreDirsCreatedOnFirstUse(t *testing.T) {
+	useConfig(t)
+	storeRoot = filepath.Join(t.TempDir(), "store")
+	if err := selectStore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(basePath); !os.IsNotExist(err) {
+		t.Fatalf("store created while selecting it")
+	}
+	if err := createStoreDirs(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{basePath, BlobStorePath, IndexStorePath, KeysStorePath} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			t.Errorf("store directory %s not created: %v", dir, err)
+		}
+	}
+}
+
+func TestReadOnlyStore(t *testing.T) {
+	useConfig(t)
+	storeRoot = filepath.Join(t.TempDir(), "store")
+	for _, dir := range []string{"blobs", "index", "uncompressed-keys"} {
+		if err := os.MkdirAll(filepath.Join(storeRoot, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readOnly = true
+
+	// commands removing entries are refused, the others run without locking nor writing the store
+	if err := rootCmd.PersistentPreRunE(prune, nil); err == nil {
+		t.Fatalf("prune accepted on a read-only store")
+	}
+	if err := rootCmd.PersistentPreRunE(imageListCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(storeRoot, cache.LockFile)); !os.IsNotExist(err) {
+		t.Errorf("read-only store locked")
+	}
+
+	blobStore, err := cache.NewCacheStore(BlobStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.WriteEntry(blobStore, "digest", []byte("content")); !errors.Is(err, cache.ErrReadOnly) {
+		t.Errorf("write to a read-only store: %v", err)
+	}
+	if _, err := cache.NewLease(basePath); !errors.Is(err, cache.ErrReadOnly) {
+		t.Errorf("lease on a read-only store: %v", err)
+	}
+	entries, err := os.ReadDir(BlobStorePath)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("read-only store written: %v %v", entries, err)
+	}
+}
@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	imageCmd.AddCommand(lsFilesCmd)
+	lsFilesCmd.Flags().StringVar(&outputFormat, "format", "table", "output format, supported formats: table, json")
+	imageCmd.AddCommand(whichCmd)
+	whichCmd.Flags().StringVar(&outputFormat, "format", "table", "output format, supported formats: table, json")
+}
+
+var lsFilesCmd = &cobra.Command{
+	Use:   "ls-files [reference] [row col]",
+	Short: "list the files of the allotments, or of the allotment at row col, without downloading the layers",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 && len(args) != 3 {
+			return fmt.Errorf("accepts a reference optionally followed by row and col, received %d args", len(args))
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cells := []filesystem.Cell{}
+		if len(args) == 3 {
+			row, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid row %s", args[1])
+			}
+			col, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid col %s", args[2])
+			}
+			cells = append(cells, filesystem.Cell{Row: row, Col: col})
+		}
+		return listFiles(args[0], cells)
+	},
+}
+
+var whichCmd = &cobra.Command{
+	Use:   "which [reference] [path]",
+	Short: "show the allotments providing or removing a path. E.g. which mytdfs:v1 /opt/models/x.bin",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return whichFile(args[0], args[1])
+	},
+}
+
+// localImageContext returns a context pointing to the local stores
+func localImageContext() context.Context {
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	return ctx
+}
+
+func listFiles(reference string, cells []filesystem.Cell) error {
+	allotments, err := oci.ListFiles(localImageContext(), reference, cells...)
+	if err != nil {
+		return err
+	}
+	return renderAllotmentFiles(allotments)
+}
+
+func whichFile(reference string, path string) error {
+	allotments, err := oci.WhichFile(localImageContext(), reference, path)
+	if err != nil {
+		return err
+	}
+	if len(allotments) == 0 {
+		return fmt.Errorf("%s is not provided by any allotment", path)
+	}
+	return renderAllotmentFiles(allotments)
+}
+
+func renderAllotmentFiles(allotments []oci.AllotmentFiles) error {
+	switch outputFormat {
+	case "json":
+		filesBytes, err := json.MarshalIndent(allotments, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(filesBytes))
+	case "table":
+		filesTable := table.NewWriter()
+		filesTable.SetOutputMirror(os.Stdout)
+		filesTable.AppendHeader(table.Row{"Row", "Col", "Path", "Type", "Size", "Mode", "Digest"})
+		filesTable.AppendSeparator()
+		for _, a := range allotments {
+			for _, f := range a.Files {
+				filesTable.AppendRow([]interface{}{a.Row, a.Col, f.Path, f.Type, formatBytes(f.Size), fmt.Sprintf("%04o", f.Mode), f.Digest})
+			}
+		}
+		filesTable.SetStyle(tableStyle)
+		filesTable.Render()
+	default:
+		return fmt.Errorf("unsupported output format %s", outputFormat)
+	}
+	return nil
+}
@@ -2,12 +2,13 @@ package cmd
 
 import (
 	"context"
-	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
 	"os"
+	"path"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
@@ -22,19 +23,49 @@ func init() {
 	rootCmd.AddCommand(imageCmd)
 	imageCmd.AddCommand(imageListCmd)
 	imageListCmd.Flags().BoolVarP(&showHash, "reference", "q", false, "returns only the refrerence list")
+	imageListCmd.Flags().StringVar(&listSort, "sort", "", "order images by name, created (newest first) or size (largest first)")
+	imageListCmd.Flags().StringArrayVar(&listFilters, "filter", []string{}, "keep the images matching key=value, keys: name, base, type, kind, platform, parent. Can be repeated")
 	imageCmd.AddCommand(rm)
 	rm.Flags().BoolVarP(&removeAll, "all", "a", false, "removes all images")
 	imageCmd.AddCommand(prune)
+	prune.Flags().BoolVar(&dryRun, "dry-run", false, "list the blobs and cache keys that would be removed, with their size, without removing them")
+	imageCmd.AddCommand(pin)
+	imageCmd.AddCommand(unpin)
+	imageCmd.AddCommand(tag)
 	imageCmd.AddCommand(export)
 	export.Flags().StringVar(&exportFormat, "as", "", "export format, supported formats: tar")
 	export.Flags().StringVar(&platform, "platform", "", "select platform, e.g., linux/amd64 or linux/arm64. Default: multiplatform image")
+	export.Flags().BoolVar(&squash, "squash", false, "merge the allotments selected by the semantic tag into a single layer")
+	export.Flags().StringVar(&budget, "budget", "", "automatically select the partition that fits the given size, e.g. 500MB")
+	export.Flags().BoolVar(&withDependencies, "with-dependencies", false, "include the cells required by the selected allotments instead of failing")
+	export.Flags().StringArrayVar(&decryptKeys, "decrypt-key", []string{}, "X25519 private key (PEM) decrypting the encrypted allotments of the partition wrapped for it, can be repeated")
+	export.Flags().BoolVar(&requireSignature, "require-signature", false, "reject the image if its field is not signed by --key")
+	export.Flags().StringVar(&signatureKey, "key", "", "ed25519 or ECDSA public key (PEM) verifying the field signature")
+	export.Flags().StringVar(&have, "have", "", "local image the target already has: its blobs are omitted and changed allotments exported as deltas")
+	imageCmd.AddCommand(applyDeltas)
 	imageCmd.AddCommand(push)
 	push.Flags().BoolVar(&forceHttp, "force-http", false, "force pull via http")
+	push.Flags().BoolVar(&squash, "squash", false, "merge the allotments selected by the semantic tag into a single layer")
+	push.Flags().StringVar(&budget, "budget", "", "automatically select the partition that fits the given size, e.g. 500MB")
+	push.Flags().BoolVar(&withDependencies, "with-dependencies", false, "include the cells required by the selected allotments instead of failing")
+	push.Flags().BoolVar(&requireSignature, "require-signature", false, "reject the image if its field is not signed by --key")
+	push.Flags().StringVar(&signatureKey, "key", "", "ed25519 or ECDSA public key (PEM) verifying the field signature")
+	push.Flags().StringVar(&platform, "platform", "", "select platform, e.g., linux/amd64 or linux/arm64. Default: multiplatform image")
 }
 
 var showHash bool
+var listSort string
+var listFilters []string
 var removeAll bool
+var dryRun bool
 var platform string
+var squash bool
+var budget string
+var withDependencies bool
+var have string
+var decryptKeys []string
+var requireSignature bool
+var signatureKey string
 var imageCmd = &cobra.Command{
 	Use:   "image",
 	Short: "Commands to manage images",
@@ -47,22 +78,51 @@ var imageListCmd = &cobra.Command{
 	},
 }
 var rm = &cobra.Command{
-	Use:   "rm [reference]...",
-	Short: "remove local images",
-	Args:  cobra.ArbitraryArgs,
+	Use:         "rm [reference]...",
+	Short:       "remove local images",
+	Annotations: map[string]string{storeLockAnnotation: exclusiveLock},
+	Args:        cobra.ArbitraryArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return removeImages(args)
 	},
 }
 
 var prune = &cobra.Command{
-	Use:   "prune",
-	Short: "clean unreferenced cache entries",
+	Use:         "prune",
+	Short:       "clean unreferenced cache entries",
+	Annotations: map[string]string{storeLockAnnotation: exclusiveLock},
 	RunE: func(cmd *cobra.Command, args []string) error {
 		return pruneBlobs()
 	},
 }
 
+var pin = &cobra.Command{
+	Use:   "pin [reference]...",
+	Short: "exempt local images from eviction when the store exceeds its size limit",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pinImages(args, true)
+	},
+}
+
+var unpin = &cobra.Command{
+	Use:   "unpin [reference]...",
+	Short: "let pinned local images be evicted again",
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return pinImages(args, false)
+	},
+}
+
+var tag = &cobra.Command{
+	Use:   "tag [reference] [targetUrl]",
+	Short: "give a local image another name without rebuilding it. E.g. tag mytdfs:v1 mytdfs:latest",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return tagImage(args[0], args[1])
+	},
+}
+
 var export = &cobra.Command{
 	Use:   "export [reference] [targetFile]",
 	Short: "export image to target file. E.g. export [imgref] MyImage.tar.gz",
@@ -72,6 +132,15 @@ var export = &cobra.Command{
 	},
 }
 
+var applyDeltas = &cobra.Command{
+	Use:   "apply-deltas [bundle] [targetFile]",
+	Short: "rebuild a full OCI archive out of an archive exported with --have. E.g. apply-deltas update.tar.gz MyImage.tar.gz",
+	Args:  cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return oci.ApplyDeltaBundle(localImageContext(), args[0], args[1])
+	},
+}
+
 var push = &cobra.Command{
 	Use:   "push [reference]",
 	Short: "push image to the registry",
@@ -99,71 +168,133 @@ var tableStyle = table.Style{
 
 func listImages() error {
 
-	indexCacheStore, err := cache.NewCacheStore(IndexStorePath)
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
 	if err != nil {
 		return err
 	}
-	indexHashList := indexCacheStore.List()
-	if showHash {
-		for _, hash := range indexHashList {
-			println(hash)
-		}
-		return nil
+	blobCacheStore, err := cache.NewCacheStore(BlobStorePath)
+	if err != nil {
+		return err
 	}
 
-	blobCacheStore, err := cache.NewCacheStore(BlobStorePath)
+	records := []oci.ImageRecord{}
+	// images tagged from one another hold the same content
+	aliases := map[string][]string{}
+	for _, hash := range indexCacheStore.List() {
+		record, err := oci.ReadImageRecord(indexCacheStore, blobCacheStore, hash)
+		if err != nil {
+			return err
+		}
+		aliases[record.Content] = append(aliases[record.Content], record.Name)
+		records = append(records, record)
+	}
+	records, err = filterImages(indexCacheStore, records, listFilters)
+	if err != nil {
+		return err
+	}
+	err = sortImages(records, listSort)
 	if err != nil {
 		return err
 	}
 
+	if showHash {
+		for _, record := range records {
+			println(record.IndexHash)
+		}
+		return nil
+	}
+
 	outTable := table.NewWriter()
 	outTable.SetOutputMirror(os.Stdout)
-	outTable.AppendHeader(table.Row{"#", "Url", "Tag", "Type", "Reference"})
+	outTable.AppendHeader(table.Row{"#", "Url", "Tag", "Type", "Created", "Size", "Reference", "Aliases"})
 	outTable.AppendSeparator()
-
-	for i, hash := range indexHashList {
-		reader, err := indexCacheStore.Get(hash)
-		if err != nil {
-			return err
+	for i, record := range records {
+		others := []string{}
+		for _, alias := range aliases[record.Content] {
+			if alias != record.Name {
+				others = append(others, alias)
+			}
 		}
-		idx, err := oci.ReadIndex(reader)
-		reader.Close()
-		if err != nil {
-			return err
+		created := "-"
+		if !record.Created.IsZero() {
+			created = record.Created.Local().Format("2006-01-02 15:04")
 		}
+		outTable.AppendRow([]interface{}{i, record.Name, record.Tag, record.Type, created, formatBytes(record.Size), record.IndexHash, strings.Join(others, ", ")})
+	}
 
-		imageType := "OCI"
+	outTable.SetStyle(tableStyle)
+	outTable.Render()
 
-		firstManifestDigest := idx.Manifests[0].Digest.Encoded()
-		blobReader, err := blobCacheStore.Get(firstManifestDigest)
-		if err != nil {
-			return err
+	return nil
+}
+
+// filterImages keeps the images matching every filter. Filters are key=value, name and base match glob patterns
+// against the whole url or its last part.
+func filterImages(indexStore cache.CacheStore, records []oci.ImageRecord, filters []string) ([]oci.ImageRecord, error) {
+	for _, filter := range filters {
+		key, value, ok := strings.Cut(filter, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid filter %s, expected key=value", filter)
 		}
-		manifest, _, _, err := oci.ReadManifest(blobReader)
-		blobReader.Close()
-		if err != nil {
-			return err
+		var match func(record oci.ImageRecord) bool
+		switch key {
+		case "name":
+			match = func(record oci.ImageRecord) bool { return matchUrl(value, record.Name) }
+		case "base":
+			match = func(record oci.ImageRecord) bool { return record.Base != "" && matchUrl(value, record.Base) }
+		case "type":
+			match = func(record oci.ImageRecord) bool { return strings.EqualFold(record.Type, value) }
+		case "kind":
+			match = func(record oci.ImageRecord) bool { return record.Kind == value }
+		case "platform":
+			match = func(record oci.ImageRecord) bool { return slices.Contains(record.Platforms, value) }
+		case "parent":
+			parent, err := oci.ResolveIndex(indexStore, value)
+			if err != nil {
+				return nil, err
+			}
+			match = func(record oci.ImageRecord) bool { return record.Parent == parent }
+		default:
+			return nil, fmt.Errorf("unsupported filter %s, supported filters: name, base, type, kind, platform, parent", key)
 		}
-		for _, l := range manifest.Layers {
-			if l.MediaType == oci.TwoDfsMediaType {
-				imageType = "OCI+2DFS"
-				break
+		filtered := []oci.ImageRecord{}
+		for _, record := range records {
+			if match(record) {
+				filtered = append(filtered, record)
 			}
 		}
-		imageUrl := idx.Annotations[oci.ImageNameAnnotation]
-		//keep only last part of the url
-		imageTag := idx.Manifests[0].Annotations["org.opencontainers.image.version"]
-		outTable.AppendRow([]interface{}{i, imageUrl, imageTag, imageType, hash})
+		records = filtered
 	}
+	return records, nil
+}
 
-	outTable.SetStyle(tableStyle)
-	outTable.Render()
+// matchUrl matches pattern against the url, or against its repository and tag only
+func matchUrl(pattern string, url string) bool {
+	if matched, _ := path.Match(pattern, url); matched {
+		return true
+	}
+	matched, _ := path.Match(pattern, url[strings.LastIndex(url, "/")+1:])
+	return matched
+}
 
+// sortImages orders the images by name, or the newest or largest first
+func sortImages(records []oci.ImageRecord, by string) error {
+	switch by {
+	case "":
+	case "name":
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	case "created":
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Created.After(records[j].Created) })
+	case "size":
+		sort.SliceStable(records, func(i, j int) bool { return records[i].Size > records[j].Size })
+	default:
+		return fmt.Errorf("unsupported sort %s, supported: name, created, size", by)
+	}
 	return nil
 }
 
 func removeImages(args []string) error {
-	indexCacheStore, err := cache.NewCacheStore(IndexStorePath)
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
 	if err != nil {
 		return err
 	}
@@ -176,19 +307,38 @@ func removeImages(args []string) error {
 		_ = os.RemoveAll(IndexStorePath)
 		return nil
 	}
-	//remove index
+	// resolve every reference first, nothing is removed if one is unknown
+	indexHashes := []string{}
 	for _, arg := range args {
-		indexCacheStore.Del(arg)
-		indexCacheStore.Del(fmt.Sprintf("%x", sha256.Sum256([]byte(arg))))
+		indexHash, err := oci.ResolveIndex(indexCacheStore, arg)
+		if err != nil {
+			return err
+		}
+		indexHashes = append(indexHashes, indexHash)
 	}
-	pruneBlobs()
-
-	return nil
+	//remove index, along with its record
+	failures := []string{}
+	for i, indexHash := range indexHashes {
+		err := indexCacheStore.Del(indexHash)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", args[i], err))
+			continue
+		}
+		fmt.Printf("%s [REMOVED]\n", args[i])
+	}
+	// the blobs of the removed images are pruned even if some could not be removed
+	err = pruneBlobs()
+	if len(failures) > 0 {
+		if err != nil {
+			return fmt.Errorf("unable to remove %d images: %s; %w", len(failures), strings.Join(failures, "; "), err)
+		}
+		return fmt.Errorf("unable to remove %d images: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return err
 }
 
-// pruneBlobs removes blobs that are not referenced by any index
-func pruneBlobs() error {
-	indexCacheStore, err := cache.NewCacheStore(IndexStorePath)
+func tagImage(reference string, targetUrl string) error {
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
 	if err != nil {
 		return err
 	}
@@ -196,150 +346,271 @@ func pruneBlobs() error {
 	if err != nil {
 		return err
 	}
-	blobDigestCacheStore, err := cache.NewCacheStore(KeysStorePath)
+	indexHash, err := oci.TagImage(indexCacheStore, blobCacheStore, reference, targetUrl)
 	if err != nil {
 		return err
 	}
+	fmt.Printf("%s %s [TAGGED]\n", targetUrl, indexHash)
+	return nil
+}
 
-	//create reference counter for blobs
-	blobs := blobCacheStore.List()
-	digests := blobDigestCacheStore.List()
-	blobreferences := make(map[string]int)
-	digestreferences := make(map[string]int)
-
-	for _, blob := range blobs {
-		blobreferences[blob] = 0
+func pinImages(references []string, pinned bool) error {
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
+	if err != nil {
+		return err
 	}
-	for _, blodigest := range digests {
-		reader, err := blobDigestCacheStore.Get(blodigest)
+	for _, reference := range references {
+		indexHash, err := oci.ResolveIndex(indexCacheStore, reference)
 		if err != nil {
 			return err
 		}
-		cachekeys, err := oci.ParseCacheKey(reader)
+		err = cache.Pin(indexCacheStore, indexHash, pinned)
 		if err != nil {
 			return err
 		}
-		for _, k := range cachekeys.Keys {
-			digestreferences[k.DiffID] = 0
+		if pinned {
+			fmt.Printf("%s [PINNED]\n", reference)
+		} else {
+			fmt.Printf("%s [UNPINNED]\n", reference)
+		}
+	}
+	return nil
+}
+
+// pruneBlobs removes the blobs and cache keys that are not referenced by any index nor by a running build.
+// The whole store is marked before anything is removed.
+func pruneBlobs() error {
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
+	if err != nil {
+		return err
+	}
+	blobCacheStore, err := cache.NewLocalStore(BlobStorePath)
+	if err != nil {
+		return err
+	}
+	blobDigestCacheStore, err := cache.NewMetadataStore(KeysStorePath)
+	if err != nil {
+		return err
+	}
+
+	plan, err := markUnreferenced(indexCacheStore, blobCacheStore, blobDigestCacheStore)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		plan.print()
+		return nil
+	}
+	return plan.sweep(blobCacheStore, blobDigestCacheStore)
+}
+
+// pruneEntry is a blob or an uncompressed-keys entry marked for removal, or for a rewrite keeping keys
+type pruneEntry struct {
+	name string
+	size int64
+	keys oci.CacheKeys
+}
+
+// prunePlan is the outcome of the mark phase of prune
+type prunePlan struct {
+	blobs []pruneEntry
+	// keys are the uncompressed-keys entries none of whose keys is used anymore
+	keys []pruneEntry
+	// rewrites are the uncompressed-keys entries keeping part of their keys
+	rewrites []pruneEntry
+}
+
+// markUnreferenced walks every local image and the leases of running builds, and plans the removal of
+// everything else. Nothing is removed, and an unreadable image or cache key fails the whole plan.
+func markUnreferenced(indexStore cache.CacheStore, blobStore cache.CacheStore, keysStore cache.CacheStore) (prunePlan, error) {
+	// entries pinned by running builds are kept even if no index references them yet
+	leased, err := cache.LeasedDigests(basePath, true)
+	if err != nil {
+		return prunePlan{}, err
+	}
+	graph := oci.WalkReferences(indexStore, blobStore)
+	return planPrune(graph, leased, blobStore, keysStore)
+}
+
+// planPrune plans the removal of the blobs and cache keys neither referenced by graph nor leased
+func planPrune(graph oci.ReferenceGraph, leased map[string]bool, blobStore cache.CacheStore, keysStore cache.CacheStore) (prunePlan, error) {
+	plan := prunePlan{}
+	if walkErrors := graph.Errors(); len(walkErrors) > 0 {
+		return plan, fmt.Errorf("unable to read the references of the local images, run tdfs cache verify: %s", strings.Join(walkErrors, "; "))
+	}
+
+	for _, blob := range unreferencedBlobs(blobStore.List(), graph, leased) {
+		size, err := blobStore.GetSize(blob)
+		if err != nil {
+			return plan, err
 		}
+		plan.blobs = append(plan.blobs, pruneEntry{name: blob, size: size})
 	}
 
-	indexes := indexCacheStore.List()
-	for _, index := range indexes {
-		reader, err := indexCacheStore.Get(index)
+	// a key is kept only while the blob it points to is kept: the allotments of encrypted cells reference the
+	// ciphertext, a key to the plaintext layer sharing their DiffID would outlive its blob
+	referenced := graph.Referenced()
+	for _, key := range keysStore.List() {
+		reader, err := keysStore.Get(key)
 		if err != nil {
-			return err
+			return plan, fmt.Errorf("cache key %s: %w", key, err)
 		}
-		idx, err := oci.ReadIndex(reader)
+		cachekeys, err := oci.ParseCacheKey(reader)
 		reader.Close()
 		if err != nil {
-			return err
+			return plan, fmt.Errorf("cache key %s: %w", key, err)
 		}
-
-		//add reference for each layer,manifest,config and allotment file referenced by the index
-		for _, m := range idx.Manifests {
-			blobreferences[m.Digest.Encoded()]++
-			manifestReader, err := blobCacheStore.Get(m.Digest.Encoded())
-			if err != nil {
-				return err
+		kept := []oci.FileCacheKey{}
+		for _, k := range cachekeys.Keys {
+			if leased[key] || referenced[k.CompressedSha] > 0 || leased[k.CompressedSha] {
+				kept = append(kept, k)
 			}
-			manifest, _, _, err := oci.ReadManifest(manifestReader)
-			manifestReader.Close()
+		}
+		switch {
+		case len(kept) == 0:
+			size, err := keysStore.GetSize(key)
 			if err != nil {
-				return err
+				return plan, err
 			}
-			for _, l := range manifest.Layers {
-				blobreferences[l.Digest.Encoded()]++
-				if l.MediaType == oci.TwoDfsMediaType {
-					tdfsReader, err := blobCacheStore.Get(l.Digest.Encoded())
-					if err != nil {
-						return err
-					}
-					fieldBytes, err := io.ReadAll(tdfsReader)
-					tdfsReader.Close()
-					if err != nil {
-						return err
-					}
-					tdfs, err := filesystem.GetField().Unmarshal(string(fieldBytes))
-					if err != nil {
-						return err
-					}
-					for f := range tdfs.IterateAllotments() {
-						blobreferences[f.Digest]++
-						digestreferences[f.DiffID]++
-					}
-				}
-			}
-			blobreferences[manifest.Config.Digest.Encoded()]++
+			plan.keys = append(plan.keys, pruneEntry{name: key, size: size})
+		case len(kept) < len(cachekeys.Keys):
+			plan.rewrites = append(plan.rewrites, pruneEntry{name: key, keys: oci.CacheKeys{Keys: kept}})
 		}
+	}
 
+	sort.Slice(plan.blobs, func(i, j int) bool { return plan.blobs[i].name < plan.blobs[j].name })
+	return plan, nil
+}
+
+// size returns the bytes the plan frees
+func (p prunePlan) size() int64 {
+	size := int64(0)
+	for _, blob := range p.blobs {
+		size += blob.size
+	}
+	for _, key := range p.keys {
+		size += key.size
+	}
+	return size
+}
+
+// print lists what the plan would remove, for --dry-run
+func (p prunePlan) print() {
+	for _, blob := range p.blobs {
+		fmt.Printf("%s %s [WOULD REMOVE]\n", blob.name, formatBytes(blob.size))
+	}
+	for _, key := range p.keys {
+		fmt.Printf("Cache key %s %s [WOULD REMOVE]\n", key.name, formatBytes(key.size))
 	}
-	//garbage collect unreferenced blobs
+	for _, key := range p.rewrites {
+		fmt.Printf("Cache key %s keeping %d keys [WOULD REWRITE]\n", key.name, len(key.keys.Keys))
+	}
+	fmt.Printf("Would remove %d blobs and %d cache keys, %s\n", len(p.blobs), len(p.keys), formatBytes(p.size()))
+}
+
+// sweep applies the plan. Every removal is attempted, and the failures are reported together.
+func (p prunePlan) sweep(blobStore cache.CacheStore, keysStore cache.CacheStore) error {
+	failures := []string{}
+
+	// keys go first, so that no key is left pointing at a removed blob
+	for _, key := range p.rewrites {
+		cachekeyBytes, err := json.Marshal(key.keys)
+		if err == nil {
+			// the entry is replaced atomically
+			err = cache.WriteEntry(keysStore, key.name, cachekeyBytes)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("cache key %s: %v", key.name, err))
+			continue
+		}
+		fmt.Printf("Cache key %s [REWRITTEN]\n", key.name)
+	}
+	removedKeys := 0
+	for _, key := range p.keys {
+		err := keysStore.Del(key.name)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("cache key %s: %v", key.name, err))
+			continue
+		}
+		fmt.Printf("Cache key %s [REMOVED]\n", key.name)
+		removedKeys++
+	}
+
 	removed := 0
-	for blob, ref := range blobreferences {
-		if ref == 0 {
-			blobCacheStore.Del(blob)
-			fmt.Printf("%s [REMOVED]\n", blob)
-			removed++
+	names := []string{}
+	for _, blob := range p.blobs {
+		names = append(names, blob.name)
+	}
+	blobFailures := cache.DelEntries(blobStore, names)
+	for _, blob := range p.blobs {
+		if err := blobFailures[blob.name]; err != nil {
+			failures = append(failures, fmt.Sprintf("blob %s: %v", blob.name, err))
+			continue
 		}
+		fmt.Printf("%s [REMOVED]\n", blob.name)
+		removed++
 	}
 
-	//garbage collect unreferenced cache file keys
-	keys := blobDigestCacheStore.List()
-	for _, key := range keys {
-		err := func() error {
-			keyreader, err := blobDigestCacheStore.Get(key)
-			if err != nil {
-				return err
-			}
-			defer keyreader.Close()
-			cachekeys, err := oci.ParseCacheKey(keyreader)
-			if err != nil {
-				return err
-			}
-			newkeys := []oci.FileCacheKey{}
-			for _, k := range cachekeys.Keys {
-				if digestreferences[k.DiffID] != 0 {
-					newkeys = append(newkeys, k)
-				}
-			}
-			if len(newkeys) != len(cachekeys.Keys) {
-				blobDigestCacheStore.Del(key)
-				fmt.Printf("%s [REMOVED]\n", key)
-				if len(newkeys) >= 0 {
-					newkey := oci.CacheKeys{
-						Keys: newkeys,
-					}
-					newkeyBytes, err := json.Marshal(newkey)
-					if err != nil {
-						return err
-					}
-					newkeyReader, err := blobDigestCacheStore.Add(key)
-					if err != nil {
-						return err
-					}
-					defer newkeyReader.Close()
-					_, err = newkeyReader.Write(newkeyBytes)
-					if err != nil {
-						return err
-					}
-				}
-			}
-			return nil
-		}()
+	fmt.Println("Removed", removed, "blobs and", removedKeys, "cache keys")
+	if len(failures) > 0 {
+		return fmt.Errorf("unable to remove %d entries: %s", len(failures), strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// unreferencedBlobs returns the blobs prune removes: those no local image references and no running build leased
+func unreferencedBlobs(blobs []string, graph oci.ReferenceGraph, leased map[string]bool) []string {
+	referenced := graph.Referenced()
+	unreferenced := []string{}
+	for _, blob := range blobs {
+		if referenced[blob] == 0 && !leased[blob] {
+			unreferenced = append(unreferenced, blob)
+		}
+	}
+	return unreferenced
+}
+
+// getPartitionOptions builds the partition options out of the export and push flags
+func getPartitionOptions() (oci.PartitionOptions, error) {
+	options := oci.PartitionOptions{
+		Squash:              squash,
+		Platform:            platform,
+		IncludeDependencies: withDependencies,
+	}
+	if budget != "" {
+		budgetBytes, err := filesystem.ParseSize(budget)
 		if err != nil {
-			return err
+			return options, err
+		}
+		if budgetBytes == 0 {
+			return options, fmt.Errorf("budget must be greater than zero")
+		}
+		options.Budget = budgetBytes
+	}
+	for _, keyPath := range decryptKeys {
+		key, err := oci.ReadPrivateKey(keyPath)
+		if err != nil {
+			return options, err
 		}
+		options.DecryptKeys = append(options.DecryptKeys, key)
 	}
+	return options, nil
+}
 
-	for digest, ref := range digestreferences {
-		if ref == 0 {
-			blobDigestCacheStore.Del(digest)
-			removed++
+// getExportOptions builds the export options out of the export and push flags
+func getExportOptions() (oci.ExportOptions, error) {
+	options := oci.ExportOptions{Have: have}
+	if requireSignature {
+		if signatureKey == "" {
+			return options, fmt.Errorf("--require-signature needs the public key of the publisher, use --key")
+		}
+		key, err := oci.ReadVerifyKey(signatureKey)
+		if err != nil {
+			return options, err
 		}
+		options.SignatureKey = key
 	}
-	fmt.Println("Removed", removed, "blobs")
-	return nil
+	return options, nil
 }
 
 func imageExport(reference string, dstFile string) error {
@@ -358,6 +629,16 @@ func imageExport(reference string, dstFile string) error {
 	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
 	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
 	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	partitionOptions, err := getPartitionOptions()
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oci.PartitionOptionsContextKey, partitionOptions)
+	exportOptions, err := getExportOptions()
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oci.ExportOptionsContextKey, exportOptions)
 	log.Default().Printf("Retrieving %s from local cache...\n", reference)
 	ociImage, err := oci.GetLocalImage(ctx, reference)
 	if err != nil {
@@ -399,6 +680,16 @@ func imagePush(reference string) error {
 	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
 	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
 	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	partitionOptions, err := getPartitionOptions()
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oci.PartitionOptionsContextKey, partitionOptions)
+	exportOptions, err := getExportOptions()
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, oci.ExportOptionsContextKey, exportOptions)
 	log.Default().Printf("Retrieving %s from local cache...\n", reference)
 
 	if forceHttp {
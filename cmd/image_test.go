@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// useStore points the store paths at an empty store for the duration of the test
+func useStore(t *testing.T) (cache.CacheStore, cache.CacheStore, cache.CacheStore) {
+	previous := []string{basePath, BlobStorePath, IndexStorePath, KeysStorePath}
+	t.Cleanup(func() {
+		basePath, BlobStorePath, IndexStorePath, KeysStorePath = previous[0], previous[1], previous[2], previous[3]
+	})
+	basePath = t.TempDir()
+	BlobStorePath = filepath.Join(basePath, "blobs")
+	IndexStorePath = filepath.Join(basePath, "index")
+	KeysStorePath = filepath.Join(basePath, "uncompressed-keys")
+	for _, dir := range []string{BlobStorePath, IndexStorePath, KeysStorePath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	indexStore, err := cache.NewMetadataStore(IndexStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobStore, err := cache.NewCacheStore(BlobStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keysStore, err := cache.NewMetadataStore(KeysStorePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return indexStore, blobStore, keysStore
+}
+
+// storeBaseImage stores a single platform image as if it had been pulled, so that builds on top of it run offline.
+// It returns the descriptors of its layer and config.
+func storeBaseImage(t *testing.T, indexStore cache.CacheStore, blobStore cache.CacheStore, url string) (v1.Descriptor, v1.Descriptor) {
+	store := func(content []byte) v1.Descriptor {
+		sha := fmt.Sprintf("%x", sha256.Sum256(content))
+		if err := cache.WriteEntry(blobStore, sha, content); err != nil {
+			t.Fatal(err)
+		}
+		return v1.Descriptor{Digest: digest.Digest("sha256:" + sha), Size: int64(len(content))}
+	}
+	layer := store([]byte("base layer"))
+	layer.MediaType = v1.MediaTypeImageLayerGzip
+	configBytes, _ := json.Marshal(v1.Image{Platform: v1.Platform{OS: "linux", Architecture: "amd64"}})
+	config := store(configBytes)
+	config.MediaType = v1.MediaTypeImageConfig
+	manifestBytes, _ := json.Marshal(v1.Manifest{MediaType: v1.MediaTypeImageManifest, Config: config, Layers: []v1.Descriptor{layer}})
+	manifest := store(manifestBytes)
+	manifest.MediaType = v1.MediaTypeImageManifest
+	manifest.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	indexBytes, _ := json.Marshal(v1.Index{
+		Manifests:   []v1.Descriptor{manifest},
+		Annotations: map[string]string{oci.ImageNameAnnotation: url},
+	})
+	if err := cache.WriteEntry(indexStore, fmt.Sprintf("%x", sha256.Sum256([]byte(url))), indexBytes); err != nil {
+		t.Fatal(err)
+	}
+	return layer, config
+}
+
+func TestPruneEncryptedAllotment(t *testing.T) {
+	indexStore, blobStore, keysStore := useStore(t)
+	storeBaseImage(t, indexStore, blobStore, "docker.io/library/base:1")
+
+	src := filepath.Join(t.TempDir(), "weights.bin")
+	if err := os.WriteFile(src, []byte("licensed weights"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	recipient, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := filesystem.TwoDFsManifest{Allotments: []filesystem.AllotmentManifest{{
+		Src:     filesystem.StringList{List: []string{src}},
+		Dst:     filesystem.StringList{List: []string{"/weights.bin"}},
+		Encrypt: true,
+	}}}
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	ctx = context.WithValue(ctx, oci.BuildOptionsContextKey, oci.BuildOptions{Recipients: []*ecdh.PublicKey{recipient.PublicKey()}})
+	buildImage := func() {
+		image, err := oci.NewImage(ctx, "docker.io/library/base:1", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = image.AddField(manifest, "docker.io/library/app:encrypted")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buildImage()
+	built := blobStore.List()
+	// the encrypted layer is reused, not encrypted again with a new key
+	buildImage()
+	if rebuilt := blobStore.List(); !slices.Equal(rebuilt, built) {
+		t.Fatalf("rebuilding with the same inputs stored new blobs: %v, before %v", rebuilt, built)
+	}
+	plan, err := markUnreferenced(indexStore, blobStore, keysStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the plaintext layer is only reachable through the cache key, both go
+	if len(plan.blobs) != 1 || len(plan.keys) != 1 {
+		t.Fatalf("expected the plaintext layer and its key to be pruned, given %d blobs and %d keys", len(plan.blobs), len(plan.keys))
+	}
+	err = plan.sweep(blobStore, keysStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keysStore.List() {
+		reader, err := keysStore.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cachekeys, err := oci.ParseCacheKey(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range cachekeys.Keys {
+			if !blobStore.Check(k.CompressedSha) {
+				t.Errorf("cache key %s points to the pruned blob %s", key, k.CompressedSha)
+			}
+		}
+	}
+
+	buildImage()
+	if rebuilt := blobStore.List(); !slices.Equal(rebuilt, built) {
+		t.Fatalf("rebuilding after prune stored new blobs: %v, before %v", rebuilt, built)
+	}
+}
+
+func TestBuildUnderLease(t *testing.T) {
+	indexStore, blobStore, _ := useStore(t)
+	storeBaseImage(t, indexStore, blobStore, "docker.io/library/base:1")
+
+	src := filepath.Join(t.TempDir(), "app.py")
+	if err := os.WriteFile(src, []byte("print('hello')"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	lease, err := cache.NewLease(basePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lease.Release()
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	ctx = context.WithValue(ctx, oci.LeaseContextKey, lease)
+	image, err := oci.NewImage(ctx, "docker.io/library/base:1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = image.AddField(filesystem.TwoDFsManifest{Allotments: []filesystem.AllotmentManifest{{
+		Src: filesystem.StringList{List: []string{src}},
+		Dst: filesystem.StringList{List: []string{"/app/app.py"}},
+	}}}, "docker.io/library/app:leased")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the record and the access time of the built image are written through the lease
+	indexHash := fmt.Sprintf("%x", sha256.Sum256([]byte("docker.io/library/app:leased")))
+	record := oci.ImageRecord{}
+	if err := cache.ReadRecord(indexStore, indexHash, &record); err != nil {
+		t.Fatalf("no record of the built image: %v", err)
+	}
+	if record.Name != "docker.io/library/app:leased" {
+		t.Fatalf("unexpected record %+v", record)
+	}
+	if _, err := os.Stat(filepath.Join(IndexStorePath, cache.AccessDir, indexHash)); err != nil {
+		t.Fatalf("no access time of the built image: %v", err)
+	}
+}
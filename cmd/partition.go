@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/compress"
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	imageCmd.AddCommand(partitionCmd)
+	partitionCmd.AddCommand(partitionPlanCmd)
+	partitionPlanCmd.Flags().StringArrayVar(&haveDigests, "have", []string{}, "digest of a blob the target device already has, can be repeated")
+	partitionPlanCmd.Flags().StringVar(&haveFrom, "have-from", "", "previously exported partition (tar.gz) the target device already has")
+	partitionPlanCmd.Flags().StringVar(&outputFormat, "format", "table", "output format, supported formats: table, json")
+	partitionPlanCmd.Flags().BoolVar(&withDependencies, "with-dependencies", false, "include the cells required by the selected allotments instead of failing")
+	imageCmd.AddCommand(resolveCmd)
+	resolveCmd.Flags().StringVar(&profileFile, "profile", "", "device profile json file, e.g. {\"arch\":\"arm64\",\"gpu\":false,\"memory\":\"8GB\"}")
+	resolveCmd.MarkFlagRequired("profile")
+	resolveCmd.Flags().StringVar(&resolveExport, "export", "", "export the resolved partition to the given file instead of printing it")
+	resolveCmd.Flags().StringVar(&platform, "platform", "", "select platform when exporting, e.g., linux/amd64 or linux/arm64. Default: multiplatform image")
+	resolveCmd.Flags().BoolVar(&withDependencies, "with-dependencies", false, "include the cells required by the selected allotments instead of failing")
+}
+
+var haveDigests []string
+var haveFrom string
+var outputFormat string
+var profileFile string
+var resolveExport string
+var partitionCmd = &cobra.Command{
+	Use:   "partition",
+	Short: "Commands to inspect image partitions",
+}
+var partitionPlanCmd = &cobra.Command{
+	Use:   "plan [semantic tag]",
+	Short: "show allotments, sizes and transfer cost of a partition. E.g. plan mytdfs:v1--0.0.1.1",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return partitionPlan(args[0])
+	},
+}
+
+var resolveCmd = &cobra.Command{
+	Use:   "resolve [reference]",
+	Short: "resolve the partition for a device profile using the rules stored in the image",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return resolvePartition(args[0])
+	},
+}
+
+func resolvePartition(reference string) error {
+	profileBytes, err := os.ReadFile(profileFile)
+	if err != nil {
+		return err
+	}
+	profile := map[string]interface{}{}
+	err = json.Unmarshal(profileBytes, &profile)
+	if err != nil {
+		return fmt.Errorf("invalid device profile %s: %w", profileFile, err)
+	}
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	resolved, err := oci.ResolvePartition(ctx, reference, profile)
+	if err != nil {
+		return err
+	}
+
+	if resolveExport != "" {
+		return imageExport(resolved, resolveExport)
+	}
+	fmt.Println(resolved)
+	return nil
+}
+
+func partitionPlan(reference string) error {
+	have := append([]string{}, haveDigests...)
+	if haveFrom != "" {
+		exported, err := exportedBlobs(haveFrom)
+		if err != nil {
+			return err
+		}
+		have = append(have, exported...)
+	}
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	ctx = context.WithValue(ctx, oci.PartitionOptionsContextKey, oci.PartitionOptions{IncludeDependencies: withDependencies})
+	plan, err := oci.PlanPartition(ctx, reference, have)
+	if err != nil {
+		return err
+	}
+
+	switch outputFormat {
+	case "json":
+		planBytes, err := json.MarshalIndent(plan, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(planBytes))
+	case "table":
+		renderPartitionPlan(plan)
+	default:
+		return fmt.Errorf("unsupported output format %s", outputFormat)
+	}
+	return nil
+}
+
+func renderPartitionPlan(plan oci.PartitionPlan) {
+	allotmentsTable := table.NewWriter()
+	allotmentsTable.SetOutputMirror(os.Stdout)
+	allotmentsTable.AppendHeader(table.Row{"Row", "Col", "Compressed", "Uncompressed", "Present", "Digest"})
+	allotmentsTable.AppendSeparator()
+	for _, a := range plan.Allotments {
+		uncompressed := formatBytes(a.UncompressedSize)
+		if a.Encrypted {
+			uncompressed = "encrypted"
+		}
+		allotmentsTable.AppendRow([]interface{}{a.Row, a.Col, formatBytes(a.CompressedSize), uncompressed, a.Present, a.Digest})
+	}
+	allotmentsTable.AppendFooter(table.Row{"", "", formatBytes(plan.AllotmentsSize), formatBytes(plan.AllotmentsUncompressedSize), "", ""})
+	allotmentsTable.SetStyle(tableStyle)
+	allotmentsTable.Render()
+	fmt.Println()
+
+	platformsTable := table.NewWriter()
+	platformsTable.SetOutputMirror(os.Stdout)
+	platformsTable.AppendHeader(table.Row{"Platform", "Base Layers", "Base Size", "Total Size", "Transfer Size"})
+	platformsTable.AppendSeparator()
+	for _, p := range plan.Platforms {
+		platformsTable.AppendRow([]interface{}{p.Platform, len(p.BaseLayers), formatBytes(p.BaseSize), formatBytes(p.TotalSize), formatBytes(p.TransferSize)})
+	}
+	platformsTable.SetStyle(tableStyle)
+	platformsTable.Render()
+}
+
+// exportedBlobs returns the digests of the blobs contained in an archive created by image export
+func exportedBlobs(archivePath string) ([]string, error) {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	entries, err := compress.ListTarGz(archive)
+	if err != nil {
+		return nil, err
+	}
+	digests := []string{}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry, "blobs/sha256/") {
+			digests = append(digests, strings.TrimPrefix(entry, "blobs/sha256/"))
+		}
+	}
+	return digests, nil
+}
+
+// formatBytes returns a human readable size
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/2DFS/2dfs-builder/oci"
+)
+
+func TestPlanHaveFrom(t *testing.T) {
+	indexStore, blobStore, _ := useStore(t)
+	storeBaseImage(t, indexStore, blobStore, "docker.io/library/base:1")
+
+	allotments := []filesystem.AllotmentManifest{}
+	for i, content := range []string{"first cell", "second cell"} {
+		src := filepath.Join(t.TempDir(), "cell.txt")
+		if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		allotments = append(allotments, filesystem.AllotmentManifest{
+			Src: filesystem.StringList{List: []string{src}},
+			Dst: filesystem.StringList{List: []string{"/cell.txt"}},
+			Row: 0,
+			Col: i,
+		})
+	}
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	image, err := oci.NewImage(ctx, "docker.io/library/base:1", false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = image.AddField(filesystem.TwoDFsManifest{Allotments: allotments}, "docker.io/library/app:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the device got the first cell with a previous export
+	archive := filepath.Join(t.TempDir(), "first.tar.gz")
+	err = imageExport("docker.io/library/app:v1--0.0.0.0", archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := exportedBlobs(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := oci.PlanPartition(ctx, "docker.io/library/app:v1--0.0.0.1", have)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := int64(0)
+	for _, a := range plan.Allotments {
+		if a.Present != (a.Col == 0) {
+			t.Errorf("allotment %d/%d present %t", a.Row, a.Col, a.Present)
+		}
+		if a.Col == 1 {
+			second = a.CompressedSize
+		}
+	}
+	for _, p := range plan.Platforms {
+		for _, layer := range p.BaseLayers {
+			if !layer.Present {
+				t.Errorf("exported base layer %s not present", layer.Digest)
+			}
+		}
+		// only the second cell is transferred
+		if p.TransferSize != second {
+			t.Errorf("unexpected transfer size %d, expected %d", p.TransferSize, second)
+		}
+	}
+}
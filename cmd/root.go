@@ -5,7 +5,9 @@ import (
 	"log"
 	"os"
 	"path"
+	"time"
 
+	"github.com/2DFS/2dfs-builder/cache"
 	"github.com/spf13/cobra"
 )
 
@@ -14,7 +16,43 @@ var (
 		Use:   "tdfs",
 		Short: "Build a a 2dfs field ",
 		Long:  `Requires a 2dfs.yaml file in the current directory or a path to a 2dfs.yaml file. Read docs at https://github.com/2DFS/2dfs-builder`,
+		// commands lock the store shared, the ones deleting from it wait for exclusive access
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if cmd.Annotations[storeLockAnnotation] == noStore {
+				return nil
+			}
+			err := selectStore()
+			if err != nil {
+				return err
+			}
+			if readOnly {
+				if needsExclusiveLock(cmd) {
+					return fmt.Errorf("the store %s is read-only, %s removes entries from it", basePath, cmd.CommandPath())
+				}
+				// nobody removes entries from a read-only store, there is nothing to lock
+				return nil
+			}
+			err = createStoreDirs()
+			if err != nil {
+				return err
+			}
+			if cmd.Annotations[storeLockAnnotation] == requestLock || cmd.Annotations[storeLockAnnotation] == leaseLock {
+				return nil
+			}
+			if needsExclusiveLock(cmd) {
+				storeLock, err = cache.LockExclusive(basePath)
+			} else {
+				storeLock, err = cache.LockShared(basePath)
+			}
+			return err
+		},
+		PersistentPostRunE: func(cmd *cobra.Command, args []string) error {
+			return storeLock.Unlock()
+		},
 	}
+	storeLock      *cache.StoreLock
+	commandStart   = time.Now()
+	maxStoreSize   string
 	homeDir, _     = os.UserHomeDir()
 	basePath       = path.Join(homeDir, ".2dfs")
 	BlobStorePath  = path.Join(basePath, "blobs")
@@ -22,6 +60,28 @@ var (
 	KeysStorePath  = path.Join(basePath, "uncompressed-keys")
 )
 
+const (
+	// storeLockAnnotation marks the commands removing entries from the store: it is set to exclusiveLock,
+	// or to the name of the boolean flag that makes the command remove entries
+	storeLockAnnotation = "storeLock"
+	exclusiveLock       = "exclusive"
+	// noStore marks the commands that do not use the store
+	noStore = "none"
+	// requestLock marks long running commands locking the store while serving each request
+	requestLock = "request"
+	// leaseLock marks the commands locking the store while pinning and accessing each entry through a cache.Lease
+	leaseLock = "lease"
+)
+
+// needsExclusiveLock returns true if cmd, as invoked, removes entries from the store
+func needsExclusiveLock(cmd *cobra.Command) bool {
+	lock := cmd.Annotations[storeLockAnnotation]
+	if flag := cmd.Flags().Lookup(lock); flag != nil {
+		return flag.Value.String() == "true"
+	}
+	return lock == exclusiveLock
+}
+
 func Execute() error {
 	rootCmd.CompletionOptions.DisableDefaultCmd = true
 	return rootCmd.Execute()
@@ -32,28 +92,10 @@ func init() {
 	// Create a new logger with the custom format
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
 
-	// check if basePath exists if not create it
-
-	if _, err := os.Stat(basePath); os.IsNotExist(err) {
-		fmt.Print("Creating base path: " + basePath + "\n")
-		err := os.Mkdir(basePath, 0755)
-		if err != nil {
-			log.Fatalf("Error creating base path: %v", err)
-		}
-	}
-
-	//check if basePath/blobstore exists if not create it
-	if _, err := os.Stat(BlobStorePath); os.IsNotExist(err) {
-		os.Mkdir(BlobStorePath, 0755)
-	}
-
-	//check if basePath/index exists if not create it
-	if _, err := os.Stat(KeysStorePath); os.IsNotExist(err) {
-		os.Mkdir(KeysStorePath, 0755)
-	}
-
-	//check if basePath/index exists if not create it
-	if _, err := os.Stat(IndexStorePath); os.IsNotExist(err) {
-		os.Mkdir(IndexStorePath, 0755)
-	}
+	rootCmd.PersistentFlags().StringVar(&maxStoreSize, "max-store-size", os.Getenv("TDFS_MAX_STORE_SIZE"), "evict the least recently used images when a build leaves the local store larger than this size, e.g. 20GB. Default: $TDFS_MAX_STORE_SIZE")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "config file. Default: $TDFS_CONFIG or ~/.config/tdfs/config.json")
+	rootCmd.PersistentFlags().StringVar(&storeRoot, "root", "", "directory of the local store. Default: $TDFS_ROOT or ~/.2dfs")
+	rootCmd.PersistentFlags().StringVar(&storeName, "store", "", "named store of the config file. Default: $TDFS_STORE")
+	rootCmd.PersistentFlags().BoolVar(&readOnly, "read-only", false, "use a pre-populated store without writing to it. Default: $TDFS_READ_ONLY")
+	rootCmd.PersistentFlags().StringVar(&remoteCache, "remote-cache", "", "URL of a shared store served by tdfs cache serve, blobs are read through and written through it. Default: $TDFS_REMOTE_CACHE")
 }
@@ -0,0 +1,59 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	imageCmd.AddCommand(sbomCmd)
+	sbomCmd.Flags().BoolVar(&withDependencies, "with-dependencies", false, "include the cells required by the selected allotments instead of failing")
+}
+
+var sbomCmd = &cobra.Command{
+	Use:   "sbom [reference] [row col]",
+	Short: "print the SPDX SBOM of the partition selected by a semantic tag, of the allotment at row col, or of the whole field",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 && len(args) != 3 {
+			return fmt.Errorf("accepts a reference optionally followed by row and col, received %d args", len(args))
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cells := []filesystem.Cell{}
+		if len(args) == 3 {
+			row, err := strconv.Atoi(args[1])
+			if err != nil {
+				return fmt.Errorf("invalid row %s", args[1])
+			}
+			col, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("invalid col %s", args[2])
+			}
+			cells = append(cells, filesystem.Cell{Row: row, Col: col})
+		}
+		return printSBOM(args[0], cells)
+	},
+}
+
+func printSBOM(reference string, cells []filesystem.Cell) error {
+	ctx := context.WithValue(localImageContext(), oci.PartitionOptionsContextKey, oci.PartitionOptions{
+		IncludeDependencies: withDependencies,
+	})
+	sbom, err := oci.ImageSBOM(ctx, reference, cells...)
+	if err != nil {
+		return err
+	}
+	sbomBytes, err := json.MarshalIndent(sbom, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(sbomBytes))
+	return nil
+}
@@ -0,0 +1,225 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/jedib0t/go-pretty/v6/table"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(systemCmd)
+	systemCmd.AddCommand(systemDfCmd)
+	systemDfCmd.Flags().StringVar(&outputFormat, "format", "table", "output format, supported formats: table, json")
+}
+
+var systemCmd = &cobra.Command{
+	Use:   "system",
+	Short: "Commands to inspect the local store",
+}
+
+var systemDfCmd = &cobra.Command{
+	Use:   "df",
+	Short: "show the space used by every local image and what prune would reclaim",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return diskUsage()
+	},
+}
+
+// ImageUsage is the space taken in the blob store by a local image. Every blob is counted once per image.
+type ImageUsage struct {
+	Name      string   `json:"name"`
+	Reference string   `json:"reference"`
+	Platforms []string `json:"platforms"`
+	// BaseSize is taken by the manifests, configs, layers and attestations of the base image
+	BaseSize int64 `json:"base_size"`
+	// FieldSize is taken by the 2dfs fields and their signatures
+	FieldSize int64 `json:"field_size"`
+	// AllotmentSize is taken by the allotments and their TOCs, SBOMs and deltas
+	AllotmentSize int64 `json:"allotment_size"`
+	// SharedSize is the part of the image also referenced by other images
+	SharedSize int64 `json:"shared_size"`
+	Size       int64 `json:"size"`
+}
+
+// DiskUsage is the space taken by the local store
+type DiskUsage struct {
+	Images          []ImageUsage `json:"images"`
+	Blobs           int          `json:"blobs"`
+	BlobsSize       int64        `json:"blobs_size"`
+	BlobsStoredSize int64        `json:"blobs_stored_size"`
+	Keys            int          `json:"keys"`
+	KeysSize        int64        `json:"keys_size"`
+	// Reclaimable and ReclaimableKeys are the blobs and cache keys prune would remove
+	Reclaimable     int   `json:"reclaimable"`
+	ReclaimableKeys int   `json:"reclaimable_keys"`
+	ReclaimableSize int64 `json:"reclaimable_size"`
+}
+
+func diskUsage() error {
+	indexCacheStore, err := cache.NewMetadataStore(IndexStorePath)
+	if err != nil {
+		return err
+	}
+	blobCacheStore, err := cache.NewLocalStore(BlobStorePath)
+	if err != nil {
+		return err
+	}
+	blobDigestCacheStore, err := cache.NewMetadataStore(KeysStorePath)
+	if err != nil {
+		return err
+	}
+
+	usage, err := computeDiskUsage(indexCacheStore, blobCacheStore, blobDigestCacheStore)
+	if err != nil {
+		return err
+	}
+
+	switch outputFormat {
+	case "json":
+		usageBytes, err := json.MarshalIndent(usage, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(usageBytes))
+	case "table":
+		imagesTable := table.NewWriter()
+		imagesTable.SetOutputMirror(os.Stdout)
+		imagesTable.AppendHeader(table.Row{"#", "Url", "Reference", "Platforms", "Base", "Field", "Allotments", "Shared", "Total"})
+		imagesTable.AppendSeparator()
+		for i, image := range usage.Images {
+			reference := image.Reference
+			if len(reference) > 12 {
+				reference = reference[:12]
+			}
+			imagesTable.AppendRow([]interface{}{i, image.Name, reference, strings.Join(image.Platforms, ","), formatBytes(image.BaseSize), formatBytes(image.FieldSize), formatBytes(image.AllotmentSize), formatBytes(image.SharedSize), formatBytes(image.Size)})
+		}
+		imagesTable.SetStyle(tableStyle)
+		imagesTable.Render()
+
+		totalsTable := table.NewWriter()
+		totalsTable.SetOutputMirror(os.Stdout)
+		totalsTable.AppendHeader(table.Row{"Blobs", "Size", "On Disk", "Cache Keys", "Keys Size", "Reclaimable"})
+		totalsTable.AppendSeparator()
+		totalsTable.AppendRow([]interface{}{usage.Blobs, formatBytes(usage.BlobsSize), formatBytes(usage.BlobsStoredSize), usage.Keys, formatBytes(usage.KeysSize), fmt.Sprintf("%s (%d blobs, %d keys)", formatBytes(usage.ReclaimableSize), usage.Reclaimable, usage.ReclaimableKeys)})
+		totalsTable.SetStyle(tableStyle)
+		totalsTable.Render()
+	default:
+		return fmt.Errorf("unsupported output format %s", outputFormat)
+	}
+	return nil
+}
+
+// computeDiskUsage splits the blob store among the local images, out of the reference graph prune walks
+func computeDiskUsage(indexStore cache.CacheStore, blobStore cache.CacheStore, keysStore cache.CacheStore) (DiskUsage, error) {
+	usage := DiskUsage{Images: []ImageUsage{}}
+
+	graph := oci.WalkReferences(indexStore, blobStore)
+	if walkErrors := graph.Errors(); len(walkErrors) > 0 {
+		// the sizes of the unreadable blobs are unknown, they are reported as empty
+		log.Printf("%d blobs of the local images are unreadable, run tdfs cache verify", len(walkErrors))
+	}
+
+	sizes := map[string]int64{}
+	sizeOf := func(digest string) int64 {
+		size, ok := sizes[digest]
+		if !ok {
+			size, _ = blobStore.GetSize(digest)
+			sizes[digest] = size
+		}
+		return size
+	}
+
+	// allotments are plain layers once partitioned, and blobs shared by several images count as shared
+	allotments := map[string]bool{}
+	imagesUsing := map[string]int{}
+	for _, image := range graph.Images {
+		seen := map[string]bool{}
+		for _, blob := range image.Blobs {
+			if blob.Kind == oci.AllotmentBlob {
+				allotments[blob.Digest] = true
+			}
+			if !seen[blob.Digest] {
+				seen[blob.Digest] = true
+				imagesUsing[blob.Digest]++
+			}
+		}
+	}
+
+	for _, image := range graph.Images {
+		imageUsage := ImageUsage{Name: image.Name, Reference: image.IndexHash, Platforms: []string{}}
+		platforms := map[string]bool{}
+		seen := map[string]bool{}
+		for _, blob := range image.Blobs {
+			if blob.Kind == oci.ManifestBlob && blob.Platform != "" && !platforms[blob.Platform] {
+				platforms[blob.Platform] = true
+				imageUsage.Platforms = append(imageUsage.Platforms, blob.Platform)
+			}
+			if seen[blob.Digest] {
+				continue
+			}
+			seen[blob.Digest] = true
+			size := sizeOf(blob.Digest)
+			switch {
+			case blob.Kind == oci.FieldBlob || blob.Kind == oci.SignatureBlob:
+				imageUsage.FieldSize += size
+			case allotments[blob.Digest] || blob.Kind == oci.TOCBlob || blob.Kind == oci.DeltaBlob || allotments[blob.Parent]:
+				imageUsage.AllotmentSize += size
+			default:
+				imageUsage.BaseSize += size
+			}
+			if imagesUsing[blob.Digest] > 1 {
+				imageUsage.SharedSize += size
+			}
+			imageUsage.Size += size
+		}
+		sort.Strings(imageUsage.Platforms)
+		usage.Images = append(usage.Images, imageUsage)
+	}
+	sort.SliceStable(usage.Images, func(i, j int) bool {
+		return usage.Images[i].Name < usage.Images[j].Name
+	})
+
+	stats, err := cache.GetStats(BlobStorePath)
+	if err != nil {
+		return usage, err
+	}
+	usage.Blobs = stats.Blobs
+	usage.BlobsSize = stats.LogicalSize
+	usage.BlobsStoredSize = stats.StoredSize
+
+	for _, key := range keysStore.List() {
+		size, err := keysStore.GetSize(key)
+		if err != nil {
+			continue
+		}
+		usage.Keys++
+		usage.KeysSize += size
+	}
+
+	// prune refuses to run while images are unreadable, nothing is reclaimable then
+	if len(graph.Errors()) > 0 {
+		return usage, nil
+	}
+	// df only holds the shared lock, the leases of builds that are gone are left to prune
+	leased, err := cache.LeasedDigests(basePath, false)
+	if err != nil {
+		return usage, err
+	}
+	plan, err := planPrune(graph, leased, blobStore, keysStore)
+	if err != nil {
+		return usage, err
+	}
+	usage.Reclaimable = len(plan.blobs)
+	usage.ReclaimableKeys = len(plan.keys)
+	usage.ReclaimableSize = plan.size()
+	return usage, nil
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/2DFS/2dfs-builder/oci"
+)
+
+func TestDiskUsage(t *testing.T) {
+	indexStore, blobStore, keysStore := useStore(t)
+	layer, config := storeBaseImage(t, indexStore, blobStore, "docker.io/library/base:1")
+
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, oci.IndexStoreContextKey, IndexStorePath)
+	ctx = context.WithValue(ctx, oci.BlobStoreContextKey, BlobStorePath)
+	ctx = context.WithValue(ctx, oci.KeyStoreContextKey, KeysStorePath)
+	for _, name := range []string{"a", "b"} {
+		src := filepath.Join(t.TempDir(), "cell.txt")
+		if err := os.WriteFile(src, []byte("cell of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		image, err := oci.NewImage(ctx, "docker.io/library/base:1", false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = image.AddField(filesystem.TwoDFsManifest{Allotments: []filesystem.AllotmentManifest{{
+			Src: filesystem.StringList{List: []string{src}},
+			Dst: filesystem.StringList{List: []string{"/cell.txt"}},
+		}}}, "docker.io/library/app:"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	orphan := []byte("blob of a removed image")
+	if err := cache.WriteEntry(blobStore, fmt.Sprintf("%x", sha256.Sum256(orphan)), orphan); err != nil {
+		t.Fatal(err)
+	}
+	// the lease of a build that is gone, df only reads it
+	stale := filepath.Join(basePath, cache.LeasesDir, "stale")
+	if err := os.MkdirAll(filepath.Dir(stale), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte("orphan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := computeDiskUsage(indexStore, blobStore, keysStore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usage.Images) != 3 {
+		t.Fatalf("unexpected images %v", usage.Images)
+	}
+	// the images built on the base image keep its layer and config, their manifests are their own
+	shared := layer.Size + config.Size
+	for _, image := range usage.Images {
+		switch image.Name {
+		case "docker.io/library/base:1":
+			if image.SharedSize != shared || image.AllotmentSize != 0 || image.FieldSize != 0 {
+				t.Errorf("unexpected usage of the base image %+v", image)
+			}
+		default:
+			if image.SharedSize != shared || image.AllotmentSize == 0 || image.FieldSize == 0 {
+				t.Errorf("unexpected usage of %s %+v", image.Name, image)
+			}
+		}
+		if image.Size != image.BaseSize+image.FieldSize+image.AllotmentSize || len(image.Platforms) != 1 {
+			t.Errorf("unexpected usage of %s %+v", image.Name, image)
+		}
+	}
+	if usage.Reclaimable != 1 || usage.ReclaimableKeys != 0 || usage.ReclaimableSize != int64(len(orphan)) {
+		t.Errorf("unexpected reclaimable %d blobs, %d keys, %d bytes", usage.Reclaimable, usage.ReclaimableKeys, usage.ReclaimableSize)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Errorf("stale lease removed by df: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package cmd
+
+import (
+	"github.com/2DFS/2dfs-builder/oci"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	imageCmd.AddCommand(verifyCmd)
+	verifyCmd.Flags().StringVar(&verifyKey, "key", "", "ed25519 or ECDSA public key (PEM): the field must be signed by this key")
+	verifyCmd.Flags().BoolVar(&verifyProvenance, "provenance", false, "require a provenance statement describing the image manifests")
+}
+
+var verifyKey string
+var verifyProvenance bool
+var verifyCmd = &cobra.Command{
+	Use:   "verify [reference]",
+	Short: "verify digests of the allotments, the eStargz TOC of lazy-pullable layers and optionally the field signature and the build provenance",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		opts := oci.VerifyOptions{Provenance: verifyProvenance}
+		if verifyKey != "" {
+			key, err := oci.ReadVerifyKey(verifyKey)
+			if err != nil {
+				return err
+			}
+			opts.Key = key
+		}
+		return oci.VerifyImage(localImageContext(), args[0], opts)
+	},
+}
@@ -14,8 +14,9 @@ func init() {
 }
 
 var versionCmd = &cobra.Command{
-	Use:   "version",
-	Short: "Print the version number of tdfs",
+	Use:         "version",
+	Short:       "Print the version number of tdfs",
+	Annotations: map[string]string{storeLockAnnotation: noStore},
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println("tdfs version ", Version)
 	},
@@ -7,11 +7,19 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
+const (
+	// WhiteoutPrefix marks a tar entry that removes the file or directory with the same name from the lower layers
+	WhiteoutPrefix = ".wh."
+	// WhiteoutOpaqueDir marks a directory whose content from the lower layers is hidden
+	WhiteoutOpaqueDir = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
 // Efficiently Tar and Gzip a folder
 func CompressFolder(fromPath string) (string, error) {
 
@@ -192,8 +200,10 @@ func TarFolder(fromPath string) (string, error) {
 	return outFile.Name(), nil
 }
 
-// Creates a tar from a file
-func TarFile(src []string, dst []string) (string, error) {
+// Creates a tar from a file.
+// remove lists paths to delete from the lower layers: they are emitted as whiteout entries.
+// A path ending with "/" hides the content of the directory from the lower layers (opaque directory) instead of removing it.
+func TarFile(src []string, dst []string, remove ...string) (string, error) {
 	if len(src) != len(dst) {
 		return "", fmt.Errorf("src and Dst list size do not match: %d!=%d", len(src), len(dst))
 	}
@@ -211,6 +221,21 @@ func TarFile(src []string, dst []string) (string, error) {
 	tarWriter := tar.NewWriter(outFile)
 	defer tarWriter.Close()
 
+	// whiteouts go first so that they never shadow the files of this same layer
+	for _, r := range remove {
+		header := &tar.Header{
+			Name:       WhiteoutPath(r),
+			Typeflag:   tar.TypeReg,
+			Mode:       0644,
+			AccessTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+			ChangeTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+			ModTime:    time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		}
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return "", err
+		}
+	}
+
 	for i, s := range src {
 
 		// Walk through the source directory
@@ -319,6 +344,8 @@ func DecompressFolder(targzFilePath string, outputDirectory string) error {
 	// Create a new tar archive reader
 	tarReader := tar.NewReader(gzipReader)
 
+	// paths extracted from this archive, whiteouts only remove content that was already in outputDirectory
+	extracted := make(map[string]bool)
 	copyBuffer := make([]byte, 1024*1024)
 	// Walk through the tar archive
 	for {
@@ -339,7 +366,25 @@ func DecompressFolder(targzFilePath string, outputDirectory string) error {
 			continue
 		}
 
-		target := filepath.Join(outputDirectory, header.Name)
+		name := cleanTarPath(header.Name)
+		target := filepath.Join(outputDirectory, name)
+
+		// honor whiteouts
+		if whiteout, isOpaque := whiteoutTarget(name); whiteout != "" {
+			if isOpaque {
+				err = removeDirContent(filepath.Join(outputDirectory, whiteout), whiteout, extracted)
+			} else if !extracted[whiteout] {
+				err = os.RemoveAll(filepath.Join(outputDirectory, whiteout))
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		extracted[name] = true
+		for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+			extracted[p] = true
+		}
 
 		switch header.Typeflag {
 
@@ -353,7 +398,10 @@ func DecompressFolder(targzFilePath string, outputDirectory string) error {
 
 		// if it's a file create it
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
@@ -366,22 +414,34 @@ func DecompressFolder(targzFilePath string, outputDirectory string) error {
 	}
 }
 
-func CalculateSha256Digest(outFile io.ReadCloser) string {
-	allbytes := make([]byte, 0)
-	buffer := make([]byte, 500)
-
-	for {
-		n, err := outFile.Read(buffer)
-		allbytes = append(allbytes, buffer[:n]...)
-		if err != nil {
-			break
+// removeDirContent removes the content of dir that was not extracted from the current archive
+func removeDirContent(dir string, name string, extracted map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if extracted[path.Join(name, entry.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
 		}
 	}
-	if len(allbytes) == 0 {
+	return nil
+}
+
+// CalculateSha256Digest streams the content through sha256, empty content has no digest
+func CalculateSha256Digest(outFile io.ReadCloser) string {
+	hash := sha256.New()
+	n, _ := io.CopyBuffer(hash, outFile, make([]byte, 1024*1024))
+	if n == 0 {
 		return ""
 	}
-	digest := sha256.Sum256(allbytes)
-	return fmt.Sprintf("%x", digest)
+	return fmt.Sprintf("%x", hash.Sum(nil))
 }
 
 func CalculateMultiSha256Digest(multifile []string) (string, error) {
@@ -421,3 +481,178 @@ func CopyFile(src *os.File, dst *os.File) error {
 	return nil
 
 }
+
+// MergeTarGz overlays the given gzipped tar layers into a single uncompressed tar and returns its path.
+// Layers are given bottom-up: when two layers provide the same path, the entry of the upper layer wins.
+// Whiteouts of the upper layers drop the removed paths of the lower ones and are kept in the result, so they still apply to the base image.
+func MergeTarGz(layers []io.Reader) (string, error) {
+
+	outFile, err := os.CreateTemp(os.TempDir(), "merged-*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer outFile.Close()
+
+	tarWriter := tar.NewWriter(outFile)
+	defer tarWriter.Close()
+
+	// walk the layers top-down so that the first occurrence of a path is the one to keep
+	seen := make(map[string]bool)
+	removed := make(map[string]bool)
+	opaque := make(map[string]bool)
+	copyBuffer := make([]byte, 1024*1024)
+	for i := len(layers) - 1; i >= 0; i-- {
+		// whiteouts of this layer only apply to the layers below
+		layerRemoved := make(map[string]bool)
+		layerOpaque := make(map[string]bool)
+		err := func() error {
+			gzipReader, err := gzip.NewReader(layers[i])
+			if err != nil {
+				return err
+			}
+			defer gzipReader.Close()
+			tarReader := tar.NewReader(gzipReader)
+			for {
+				header, err := tarReader.Next()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return err
+				}
+				name := cleanTarPath(header.Name)
+				// the TOCs of eStargz layers describe their own layer only
+				if seen[name] || isHidden(name, removed) || isUnderOpaque(name, opaque) || IsEStargzMetadata(name) {
+					continue
+				}
+				if target, isOpaque := whiteoutTarget(name); target != "" {
+					// a whiteout for a path provided by an upper layer is meaningless
+					if seen[target] && !isOpaque {
+						continue
+					}
+					if isOpaque {
+						layerOpaque[target] = true
+					} else {
+						layerRemoved[target] = true
+					}
+				}
+				seen[name] = true
+				if err := tarWriter.WriteHeader(header); err != nil {
+					return err
+				}
+				if _, err := io.CopyBuffer(tarWriter, tarReader, copyBuffer); err != nil {
+					return err
+				}
+			}
+		}()
+		if err != nil {
+			os.Remove(outFile.Name())
+			return "", fmt.Errorf("failed merging layer %d: %w", i, err)
+		}
+		for p := range layerRemoved {
+			removed[p] = true
+		}
+		for p := range layerOpaque {
+			opaque[p] = true
+		}
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		os.Remove(outFile.Name())
+		return "", fmt.Errorf("failed flushing tar file: %w", err)
+	}
+
+	return outFile.Name(), nil
+}
+
+// WhiteoutPath returns the whiteout entry name that removes the given path, or hides its content if it ends with "/"
+func WhiteoutPath(p string) string {
+	if strings.HasSuffix(p, "/") {
+		return path.Join(p, WhiteoutOpaqueDir)
+	}
+	return path.Join(path.Dir(p), WhiteoutPrefix+path.Base(p))
+}
+
+// whiteoutTarget returns the path removed by a whiteout entry and whether the entry is an opaque directory marker.
+// The path is empty if the entry is not a whiteout.
+func whiteoutTarget(name string) (string, bool) {
+	base := path.Base(name)
+	if base == WhiteoutOpaqueDir {
+		return path.Dir(name), true
+	}
+	if strings.HasPrefix(base, WhiteoutPrefix) {
+		return path.Join(path.Dir(name), strings.TrimPrefix(base, WhiteoutPrefix)), false
+	}
+	return "", false
+}
+
+// isHidden returns true if the path, or one of its parents, is in the removed set
+func isHidden(name string, removed map[string]bool) bool {
+	for p := name; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if removed[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnderOpaque returns true if one of the parents of the path is in the opaque set
+func isUnderOpaque(name string, opaque map[string]bool) bool {
+	for p := path.Dir(name); p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if opaque[p] {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanTarPath normalizes a tar entry name so that "./a/b/", "/a/b" and "a/b" compare equal
+func cleanTarPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// UncompressedSize returns the size of the content of a gzip stream
+func UncompressedSize(gz io.Reader) (int64, error) {
+	gzipReader, err := gzip.NewReader(gz)
+	if err != nil {
+		return 0, err
+	}
+	defer gzipReader.Close()
+	return io.CopyBuffer(io.Discard, gzipReader, make([]byte, 1024*1024))
+}
+
+// UncompressedDigest returns the sha256 of the content of a gzip stream, i.e. the DiffID of a layer
+func UncompressedDigest(gz io.Reader) (string, error) {
+	gzipReader, err := gzip.NewReader(gz)
+	if err != nil {
+		return "", err
+	}
+	defer gzipReader.Close()
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(hash, gzipReader, make([]byte, 1024*1024)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// ListTarGz returns the names of all entries of a gzipped tar
+func ListTarGz(targz io.Reader) ([]string, error) {
+	gzipReader, err := gzip.NewReader(targz)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	names := []string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return names, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, cleanTarPath(header.Name))
+	}
+}
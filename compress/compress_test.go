@@ -1,11 +1,16 @@
 package compress
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"crypto/sha256"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
 )
 
@@ -189,3 +194,224 @@ func TestCopyFile(t *testing.T) {
 		t.Errorf("Unexpected content in destination file: got %s, want %s", string(dstContent), content)
 	}
 }
+
+// writeTarGz builds an in-memory tar.gz layer out of name->content pairs
+func writeTarGz(t *testing.T, files map[string]string) *bytes.Buffer {
+	buffer := &bytes.Buffer{}
+	gzipWriter := gzip.NewWriter(buffer)
+	tarWriter := tar.NewWriter(gzipWriter)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		content := files[name]
+		err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return buffer
+}
+
+// readTar returns the name->content pairs of an uncompressed tar, failing on duplicated entries
+func readTar(t *testing.T, tarPath string) map[string]string {
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	result := map[string]string{}
+	tarReader := tar.NewReader(tarFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := result[header.Name]; ok {
+			t.Fatalf("duplicated entry %s", header.Name)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result[header.Name] = string(content)
+	}
+	return result
+}
+
+func TestMergeTarGz(t *testing.T) {
+	lower := writeTarGz(t, map[string]string{"a.txt": "lower a", "b.txt": "lower b"})
+	upper := writeTarGz(t, map[string]string{"./a.txt": "upper a", "c.txt": "upper c"})
+
+	merged, err := MergeTarGz([]io.Reader{lower, upper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(merged)
+
+	expected := map[string]string{"./a.txt": "upper a", "b.txt": "lower b", "c.txt": "upper c"}
+	actual := readTar(t, merged)
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %d entries, got %d: %v", len(expected), len(actual), actual)
+	}
+	for name, content := range expected {
+		if actual[name] != content {
+			t.Errorf("Unexpected content for %s: got %s, want %s", name, actual[name], content)
+		}
+	}
+}
+
+func TestMergeTarGzWhiteouts(t *testing.T) {
+	lower := writeTarGz(t, map[string]string{"a.txt": "lower a", "b.txt": "lower b", "dir/x.txt": "lower x", "dir/y.txt": "lower y"})
+	upper := writeTarGz(t, map[string]string{".wh.a.txt": "", "dir/" + WhiteoutOpaqueDir: "", "dir/z.txt": "upper z"})
+
+	merged, err := MergeTarGz([]io.Reader{lower, upper})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(merged)
+
+	actual := readTar(t, merged)
+	for _, removed := range []string{"a.txt", "dir/x.txt", "dir/y.txt"} {
+		if _, ok := actual[removed]; ok {
+			t.Errorf("%s should have been removed by a whiteout", removed)
+		}
+	}
+	for _, kept := range []string{"b.txt", "dir/z.txt", ".wh.a.txt", "dir/" + WhiteoutOpaqueDir} {
+		if _, ok := actual[kept]; !ok {
+			t.Errorf("%s should be part of the merged layer", kept)
+		}
+	}
+}
+
+func TestWhiteoutPath(t *testing.T) {
+	tests := map[string]string{
+		"/usr/lib/big.so": "/usr/lib/.wh.big.so",
+		"cache":           ".wh.cache",
+		"/var/cache/":     "/var/cache/" + WhiteoutOpaqueDir,
+	}
+	for p, expected := range tests {
+		if actual := WhiteoutPath(p); actual != expected {
+			t.Errorf("WhiteoutPath(%s) = %s, want %s", p, actual, expected)
+		}
+	}
+}
+
+func TestDecompressWhiteouts(t *testing.T) {
+	outputDir, err := os.MkdirTemp("", "whiteouts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	layers := []map[string]string{
+		{"a.txt": "lower a", "b.txt": "lower b", "dir/x.txt": "lower x"},
+		{".wh.a.txt": "", "dir/" + WhiteoutOpaqueDir: "", "dir/z.txt": "upper z"},
+	}
+	for _, layer := range layers {
+		archive, err := os.CreateTemp("", "layer-*.tar.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(archive.Name())
+		if _, err := io.Copy(archive, writeTarGz(t, layer)); err != nil {
+			t.Fatal(err)
+		}
+		archive.Close()
+		if err := DecompressFolder(archive.Name(), outputDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, removed := range []string{"a.txt", "dir/x.txt", ".wh.a.txt", "dir/" + WhiteoutOpaqueDir} {
+		if _, err := os.Stat(filepath.Join(outputDir, removed)); !os.IsNotExist(err) {
+			t.Errorf("%s should not exist", removed)
+		}
+	}
+	for _, kept := range []string{"b.txt", "dir/z.txt"} {
+		if _, err := os.Stat(filepath.Join(outputDir, kept)); err != nil {
+			t.Errorf("%s should exist: %v", kept, err)
+		}
+	}
+}
+
+func TestTableOfContentsTarGz(t *testing.T) {
+	files := map[string]string{"./opt/models/x.bin": "weights", "etc/.wh.app.conf": "", "var/cache/" + WhiteoutOpaqueDir: ""}
+	tarPath := writeTar(t, files)
+	defer os.Remove(tarPath)
+	estargzPath, _, err := TarToEStargz(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(estargzPath)
+	estargz, err := os.ReadFile(estargzPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		layer io.Reader
+	}{
+		{"gzip", writeTarGz(t, files)},
+		// the eStargz index and landmark are not listed
+		{"estargz", bytes.NewReader(estargz)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries, err := TableOfContentsTarGz(tt.layer)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := map[string]string{"/opt/models/x.bin": TOCTypeFile, "/etc/app.conf": TOCTypeWhiteout, "/var/cache": TOCTypeOpaque}
+			if len(entries) != len(expected) {
+				t.Fatalf("expected %d entries, got %d: %v", len(expected), len(entries), entries)
+			}
+			for _, entry := range entries {
+				if expected[entry.Path] != entry.Type {
+					t.Errorf("Unexpected type for %s: got %s, want %s", entry.Path, entry.Type, expected[entry.Path])
+				}
+				if entry.Type == TOCTypeFile {
+					if entry.Size != int64(len("weights")) || entry.Digest != fmt.Sprintf("%x", sha256.Sum256([]byte("weights"))) {
+						t.Errorf("Unexpected size or digest for %s: %d %s", entry.Path, entry.Size, entry.Digest)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDetectPackagesTarGz(t *testing.T) {
+	layer := writeTarGz(t, map[string]string{
+		"usr/lib/python3/site-packages/numpy-1.26.4.dist-info/METADATA": "Metadata-Version: 2.1\nName: numpy\nVersion: 1.26.4\n\nName: not-a-header\n",
+		"app/node_modules/@scope/lib/package.json":                      `{"name": "@scope/lib", "version": "2.0.0"}`,
+		"app/node_modules/@scope/lib/node_modules/x/src/package.json":   `{"name": "nested-source", "version": "0.0.1"}`,
+		"var/lib/dpkg/status": "Package: libc6\nVersion: 2.36-9\nDescription: GNU C Library\n continuation: line\n\nPackage: zlib1g\nVersion: 1:1.2.13\n",
+		"opt/readme.txt":      "Name: not-a-package\n",
+	})
+
+	packages, err := DetectPackagesTarGz(layer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"pkg:deb/debian/libc6@2.36-9", "pkg:deb/debian/zlib1g@1%3A1.2.13", "pkg:npm/%40scope/lib@2.0.0", "pkg:pypi/numpy@1.26.4"}
+	if len(packages) != len(expected) {
+		t.Fatalf("expected %d packages, got %v", len(expected), packages)
+	}
+	for i, p := range packages {
+		if p.PURL() != expected[i] {
+			t.Errorf("unexpected package %d: got %s, want %s", i, p.PURL(), expected[i])
+		}
+	}
+}
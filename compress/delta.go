@@ -0,0 +1,295 @@
+package compress
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// DeltaBlockSize is the size of the blocks of the base searched in the target
+	DeltaBlockSize = 8 << 10
+
+	deltaMagic      = "2DFSDELTA1\n"
+	deltaOpCopy     = 'C'
+	deltaOpInsert   = 'I'
+	deltaOpEnd      = 'E'
+	deltaMaxLiteral = 1 << 20
+)
+
+type deltaBlock struct {
+	offset int64
+	strong [sha256.Size]byte
+}
+
+// deltaEncoder writes copy and insert instructions, merging adjacent copies
+type deltaEncoder struct {
+	w          *bufio.Writer
+	literal    []byte
+	copyOffset int64
+	copyLength int64
+	varint     [binary.MaxVarintLen64]byte
+}
+
+func (e *deltaEncoder) uvarint(v uint64) error {
+	n := binary.PutUvarint(e.varint[:], v)
+	_, err := e.w.Write(e.varint[:n])
+	return err
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if e.copyLength == 0 {
+		return nil
+	}
+	if err := e.w.WriteByte(deltaOpCopy); err != nil {
+		return err
+	}
+	if err := e.uvarint(uint64(e.copyOffset)); err != nil {
+		return err
+	}
+	if err := e.uvarint(uint64(e.copyLength)); err != nil {
+		return err
+	}
+	e.copyLength = 0
+	return nil
+}
+
+func (e *deltaEncoder) flushLiteral() error {
+	if len(e.literal) == 0 {
+		return nil
+	}
+	if err := e.w.WriteByte(deltaOpInsert); err != nil {
+		return err
+	}
+	if err := e.uvarint(uint64(len(e.literal))); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(e.literal); err != nil {
+		return err
+	}
+	e.literal = e.literal[:0]
+	return nil
+}
+
+func (e *deltaEncoder) copy(offset int64, length int64) error {
+	if err := e.flushLiteral(); err != nil {
+		return err
+	}
+	if e.copyLength > 0 && e.copyOffset+e.copyLength == offset {
+		e.copyLength += length
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.copyOffset = offset
+	e.copyLength = length
+	return nil
+}
+
+func (e *deltaEncoder) insert(b ...byte) error {
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.literal = append(e.literal, b...)
+	if len(e.literal) >= deltaMaxLiteral {
+		return e.flushLiteral()
+	}
+	return nil
+}
+
+// weakChecksum is the rsync rolling checksum of a block
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+	l := uint32(len(block))
+	for i, c := range block {
+		a += uint32(c)
+		b += (l - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+/*
+Delta writes to out a gzipped binary delta that rebuilds target out of base.
+The blocks of base found anywhere in target are copied, everything else is inserted literally.
+The delta records the sha256 of target, ApplyDelta verifies it.
+*/
+func Delta(base io.ReaderAt, baseSize int64, target io.Reader, out io.Writer) error {
+	// index the blocks of the base
+	index := make(map[uint32][]deltaBlock)
+	block := make([]byte, DeltaBlockSize)
+	for offset := int64(0); offset+DeltaBlockSize <= baseSize; offset += DeltaBlockSize {
+		if _, err := base.ReadAt(block, offset); err != nil {
+			return err
+		}
+		a, b := weakChecksum(block)
+		weak := a | b<<16
+		index[weak] = append(index[weak], deltaBlock{offset: offset, strong: sha256.Sum256(block)})
+	}
+
+	gzipWriter := gzip.NewWriter(out)
+	bufferedWriter := bufio.NewWriterSize(gzipWriter, 1024*1024)
+	encoder := &deltaEncoder{w: bufferedWriter, literal: make([]byte, 0, deltaMaxLiteral)}
+	if _, err := bufferedWriter.WriteString(deltaMagic); err != nil {
+		return err
+	}
+
+	targetHash := sha256.New()
+	reader := bufio.NewReaderSize(io.TeeReader(target, targetHash), 1024*1024)
+
+	// window holds the candidate block of the target, buffer grows by one block and is compacted when full
+	buffer := make([]byte, 0, 4*DeltaBlockSize)
+	fill := func() error {
+		for len(buffer) < DeltaBlockSize {
+			c, err := reader.ReadByte()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			buffer = append(buffer, c)
+		}
+		return nil
+	}
+	if err := fill(); err != nil {
+		return err
+	}
+	a, b := weakChecksum(buffer)
+	for len(buffer) == DeltaBlockSize {
+		weak := a | b<<16
+		matched := false
+		if candidates, ok := index[weak]; ok {
+			strong := sha256.Sum256(buffer)
+			for _, candidate := range candidates {
+				if candidate.strong == strong {
+					if err := encoder.copy(candidate.offset, DeltaBlockSize); err != nil {
+						return err
+					}
+					matched = true
+					break
+				}
+			}
+		}
+		if matched {
+			buffer = buffer[:0]
+			if err := fill(); err != nil {
+				return err
+			}
+			a, b = weakChecksum(buffer)
+			continue
+		}
+
+		// slide the window by one byte
+		out := buffer[0]
+		if err := encoder.insert(out); err != nil {
+			return err
+		}
+		in, err := reader.ReadByte()
+		if err == io.EOF {
+			buffer = buffer[1:]
+			break
+		}
+		if err != nil {
+			return err
+		}
+		a = (a - uint32(out) + uint32(in)) & 0xffff
+		b = (b - DeltaBlockSize*uint32(out) + a) & 0xffff
+		if cap(buffer) == len(buffer) {
+			buffer = append(make([]byte, 0, 4*DeltaBlockSize), buffer[1:]...)
+		} else {
+			buffer = buffer[1:]
+		}
+		buffer = append(buffer, in)
+	}
+	// the tail shorter than a block is always literal
+	if len(buffer) > 0 {
+		if err := encoder.insert(buffer...); err != nil {
+			return err
+		}
+	}
+
+	if err := encoder.flushCopy(); err != nil {
+		return err
+	}
+	if err := encoder.flushLiteral(); err != nil {
+		return err
+	}
+	if err := bufferedWriter.WriteByte(deltaOpEnd); err != nil {
+		return err
+	}
+	if _, err := bufferedWriter.Write(targetHash.Sum(nil)); err != nil {
+		return err
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+// ApplyDelta rebuilds the target of a delta created by Delta and writes it to out. It fails if the rebuilt target does not match the recorded digest.
+func ApplyDelta(base io.ReaderAt, delta io.Reader, out io.Writer) error {
+	gzipReader, err := gzip.NewReader(delta)
+	if err != nil {
+		return err
+	}
+	defer gzipReader.Close()
+	reader := bufio.NewReaderSize(gzipReader, 1024*1024)
+
+	magic := make([]byte, len(deltaMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || string(magic) != deltaMagic {
+		return fmt.Errorf("invalid delta header")
+	}
+
+	targetHash := sha256.New()
+	writer := io.MultiWriter(out, targetHash)
+	copyBuffer := make([]byte, 1024*1024)
+	for {
+		op, err := reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("truncated delta: %w", err)
+		}
+		switch op {
+		case deltaOpCopy:
+			offset, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return err
+			}
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return err
+			}
+			section := io.NewSectionReader(base, int64(offset), int64(length))
+			n, err := io.CopyBuffer(writer, section, copyBuffer)
+			if err != nil {
+				return err
+			}
+			if n != int64(length) {
+				return fmt.Errorf("delta copies beyond the end of the base")
+			}
+		case deltaOpInsert:
+			length, err := binary.ReadUvarint(reader)
+			if err != nil {
+				return err
+			}
+			if _, err := io.CopyN(writer, reader, int64(length)); err != nil {
+				return err
+			}
+		case deltaOpEnd:
+			expected := make([]byte, sha256.Size)
+			if _, err := io.ReadFull(reader, expected); err != nil {
+				return err
+			}
+			if actual := targetHash.Sum(nil); !bytes.Equal(actual, expected) {
+				return fmt.Errorf("delta target digest mismatch: expected %x, found %x", expected, actual)
+			}
+			return nil
+		default:
+			return fmt.Errorf("invalid delta instruction %q", op)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package compress
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestDelta(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	base := make([]byte, 40*DeltaBlockSize+123)
+	random.Read(base)
+
+	// change a few bytes, insert and remove some data
+	target := append([]byte{}, base[:5*DeltaBlockSize]...)
+	target = append(target, []byte("inserted data")...)
+	target = append(target, base[5*DeltaBlockSize:20*DeltaBlockSize]...)
+	target = append(target, base[22*DeltaBlockSize:]...)
+	target[30*DeltaBlockSize] ^= 0xff
+
+	delta := &bytes.Buffer{}
+	err := Delta(bytes.NewReader(base), int64(len(base)), bytes.NewReader(target), delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta.Len() > len(target)/4 {
+		t.Errorf("delta too large: %d bytes for a %d bytes target", delta.Len(), len(target))
+	}
+
+	rebuilt := &bytes.Buffer{}
+	err = ApplyDelta(bytes.NewReader(base), bytes.NewReader(delta.Bytes()), rebuilt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rebuilt.Bytes(), target) {
+		t.Errorf("rebuilt target differs from the original")
+	}
+
+	// a different base is detected
+	wrongBase := append([]byte{}, base...)
+	wrongBase[0] ^= 0xff
+	err = ApplyDelta(bytes.NewReader(wrongBase), bytes.NewReader(delta.Bytes()), &bytes.Buffer{})
+	if err == nil {
+		t.Errorf("expected digest mismatch with a different base")
+	}
+}
+
+func TestDeltaShortTarget(t *testing.T) {
+	base := []byte("base")
+	target := []byte("short target")
+	delta := &bytes.Buffer{}
+	if err := Delta(bytes.NewReader(base), int64(len(base)), bytes.NewReader(target), delta); err != nil {
+		t.Fatal(err)
+	}
+	rebuilt := &bytes.Buffer{}
+	if err := ApplyDelta(bytes.NewReader(base), delta, rebuilt); err != nil {
+		t.Fatal(err)
+	}
+	if rebuilt.String() != string(target) {
+		t.Errorf("Unexpected rebuilt target %q", rebuilt.String())
+	}
+}
@@ -0,0 +1,422 @@
+package compress
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// EStargzTOCDigestAnnotation is the layer descriptor annotation carrying the digest of the eStargz TOC
+	EStargzTOCDigestAnnotation = "containerd.io/snapshot/stargz/toc.digest"
+	// EStargzTOCTarName is the tar entry holding the eStargz TOC
+	EStargzTOCTarName = "stargz.index.json"
+	// EStargzFooterSize is the size of the footer pointing to the TOC
+	EStargzFooterSize = 51
+	// EStargzChunkSize is the maximum size of a file chunk, each chunk can be fetched and decompressed on its own
+	EStargzChunkSize = 4 << 20
+
+	estargzNoPrefetchLandmark = ".no.prefetch.landmark"
+	estargzPrefetchLandmark   = ".prefetch.landmark"
+	estargzLandmarkContents   = 0xf
+)
+
+// IsEStargzMetadata returns true for the tar entries eStargz adds to a layer: the TOC and the prefetch landmarks
+func IsEStargzMetadata(name string) bool {
+	switch cleanTarPath(name) {
+	case EStargzTOCTarName, estargzNoPrefetchLandmark, estargzPrefetchLandmark:
+		return true
+	}
+	return false
+}
+
+type estargzTOC struct {
+	Version int            `json:"version"`
+	Entries []estargzEntry `json:"entries"`
+}
+
+type estargzEntry struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Size        int64  `json:"size,omitempty"`
+	ModTime     string `json:"modtime,omitempty"`
+	LinkName    string `json:"linkName,omitempty"`
+	Mode        int64  `json:"mode,omitempty"`
+	UID         int    `json:"uid,omitempty"`
+	GID         int    `json:"gid,omitempty"`
+	Uname       string `json:"userName,omitempty"`
+	Gname       string `json:"groupName,omitempty"`
+	Offset      int64  `json:"offset,omitempty"`
+	DevMajor    int64  `json:"devMajor,omitempty"`
+	DevMinor    int64  `json:"devMinor,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+	ChunkOffset int64  `json:"chunkOffset,omitempty"`
+	ChunkSize   int64  `json:"chunkSize,omitempty"`
+	ChunkDigest string `json:"chunkDigest,omitempty"`
+}
+
+// countWriter counts the bytes written to w
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// estargzWriter writes a tar stream as a sequence of gzip members, a new member starts at every entry and chunk
+type estargzWriter struct {
+	cw *countWriter
+	gz *gzip.Writer
+}
+
+func (w *estargzWriter) Write(p []byte) (int, error) {
+	if w.gz == nil {
+		w.gz = gzip.NewWriter(w.cw)
+	}
+	return w.gz.Write(p)
+}
+
+// newMember closes the current gzip member and returns the offset of the next one
+func (w *estargzWriter) newMember() (int64, error) {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return 0, err
+		}
+		w.gz = nil
+	}
+	return w.cw.n, nil
+}
+
+/*
+TarToEStargz converts a tar file to an eStargz blob: a gzipped tar where every file can be located through a TOC and
+decompressed on its own, so that lazy-pulling snapshotters can fetch single files.
+The result decompresses to a valid tar. Returns the path of the blob and the digest of the TOC (sha256:<hex>).
+*/
+func TarToEStargz(tarPath string) (string, string, error) {
+	tarFile, err := os.Open(tarPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer tarFile.Close()
+
+	outFile, err := os.CreateTemp("", "estargz-*.tar.gz")
+	if err != nil {
+		return "", "", err
+	}
+	defer outFile.Close()
+	bufferedWriter := bufio.NewWriterSize(outFile, 1024*1024)
+	w := &estargzWriter{cw: &countWriter{w: bufferedWriter}}
+	toc := estargzTOC{Version: 1, Entries: []estargzEntry{}}
+
+	failure := func(err error) (string, string, error) {
+		outFile.Close()
+		os.Remove(outFile.Name())
+		return "", "", err
+	}
+
+	// the landmark tells the snapshotters that no file needs to be prefetched
+	landmark := &tar.Header{Name: estargzNoPrefetchLandmark, Typeflag: tar.TypeReg, Mode: 0644, Size: 1, ModTime: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+	if err := w.appendEntry(&toc, landmark, bytes.NewReader([]byte{estargzLandmarkContents})); err != nil {
+		return failure(err)
+	}
+
+	tarReader := tar.NewReader(tarFile)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return failure(err)
+		}
+		if err := w.appendEntry(&toc, header, tarReader); err != nil {
+			return failure(err)
+		}
+	}
+
+	// TOC and footer pointing to it
+	tocBytes, err := json.Marshal(toc)
+	if err != nil {
+		return failure(err)
+	}
+	tocOffset, err := w.newMember()
+	if err != nil {
+		return failure(err)
+	}
+	tarWriter := tar.NewWriter(w)
+	err = tarWriter.WriteHeader(&tar.Header{Name: EStargzTOCTarName, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(tocBytes))})
+	if err != nil {
+		return failure(err)
+	}
+	if _, err := tarWriter.Write(tocBytes); err != nil {
+		return failure(err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		return failure(err)
+	}
+	if _, err := w.newMember(); err != nil {
+		return failure(err)
+	}
+	footer, err := estargzFooter(tocOffset)
+	if err != nil {
+		return failure(err)
+	}
+	if _, err := w.cw.Write(footer); err != nil {
+		return failure(err)
+	}
+	if err := bufferedWriter.Flush(); err != nil {
+		return failure(err)
+	}
+
+	return outFile.Name(), fmt.Sprintf("sha256:%x", sha256.Sum256(tocBytes)), nil
+}
+
+// appendEntry writes a tar entry starting a new gzip member, files larger than EStargzChunkSize start a new member every chunk
+func (w *estargzWriter) appendEntry(toc *estargzTOC, header *tar.Header, content io.Reader) error {
+	offset, err := w.newMember()
+	if err != nil {
+		return err
+	}
+	entry := estargzEntry{
+		Name:     cleanTarPath(header.Name),
+		Size:     header.Size,
+		LinkName: header.Linkname,
+		Mode:     header.Mode,
+		UID:      header.Uid,
+		GID:      header.Gid,
+		Uname:    header.Uname,
+		Gname:    header.Gname,
+		Offset:   offset,
+		DevMajor: header.Devmajor,
+		DevMinor: header.Devminor,
+	}
+	if !header.ModTime.IsZero() {
+		entry.ModTime = header.ModTime.UTC().Format(time.RFC3339)
+	}
+	switch header.Typeflag {
+	case tar.TypeReg:
+		entry.Type = "reg"
+	case tar.TypeDir:
+		entry.Type = "dir"
+	case tar.TypeSymlink:
+		entry.Type = "symlink"
+	case tar.TypeLink:
+		entry.Type = "hardlink"
+	case tar.TypeChar:
+		entry.Type = "char"
+	case tar.TypeBlock:
+		entry.Type = "block"
+	case tar.TypeFifo:
+		entry.Type = "fifo"
+	default:
+		return fmt.Errorf("unsupported tar entry type %c for %s", header.Typeflag, header.Name)
+	}
+
+	// entries are relative to the root as snapshotters expect
+	header.Name = entry.Name
+	if entry.Type == "dir" {
+		header.Name += "/"
+	}
+	tarWriter := tar.NewWriter(w)
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if entry.Type != "reg" || header.Size == 0 {
+		entry.Size = 0
+		toc.Entries = append(toc.Entries, entry)
+		return tarWriter.Flush()
+	}
+
+	fileHash := sha256.New()
+	chunked := header.Size > EStargzChunkSize
+	for chunkOffset := int64(0); chunkOffset < header.Size; chunkOffset += EStargzChunkSize {
+		chunkSize := min(EStargzChunkSize, header.Size-chunkOffset)
+		chunk := entry
+		if chunkOffset > 0 {
+			chunk = estargzEntry{Name: entry.Name, Type: "chunk"}
+			chunk.Offset, err = w.newMember()
+			if err != nil {
+				return err
+			}
+		}
+		chunkHash := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(tarWriter, fileHash, chunkHash), content, chunkSize); err != nil {
+			return err
+		}
+		chunk.ChunkOffset = chunkOffset
+		chunk.ChunkDigest = fmt.Sprintf("sha256:%x", chunkHash.Sum(nil))
+		if chunked {
+			chunk.ChunkSize = chunkSize
+		}
+		toc.Entries = append(toc.Entries, chunk)
+	}
+	for i := len(toc.Entries) - 1; i >= 0; i-- {
+		if toc.Entries[i].Type == "reg" {
+			toc.Entries[i].Digest = fmt.Sprintf("sha256:%x", fileHash.Sum(nil))
+			break
+		}
+	}
+	return tarWriter.Flush()
+}
+
+// estargzFooter returns an empty gzip member whose extra field points to the TOC.
+// It is assembled by hand since the size of the empty deflate block written by compress/gzip is not fixed.
+func estargzFooter(tocOffset int64) ([]byte, error) {
+	subfield := fmt.Sprintf("%016xSTARGZ", tocOffset)
+	footer := make([]byte, 0, EStargzFooterSize)
+	// gzip header with FEXTRA flag, no mtime, unknown OS
+	footer = append(footer, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff)
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(4+len(subfield)))
+	footer = append(footer, 'S', 'G')
+	footer = binary.LittleEndian.AppendUint16(footer, uint16(len(subfield)))
+	footer = append(footer, subfield...)
+	// final stored deflate block with no data, then crc32 and size of the empty content
+	footer = append(footer, 1, 0, 0, 0xff, 0xff)
+	footer = append(footer, 0, 0, 0, 0, 0, 0, 0, 0)
+	if len(footer) != EStargzFooterSize {
+		return nil, fmt.Errorf("invalid eStargz footer size %d", len(footer))
+	}
+	return footer, nil
+}
+
+// readEStargzTOC reads the TOC of an eStargz blob and returns it along with its digest
+func readEStargzTOC(blob io.ReaderAt, size int64) (estargzTOC, string, error) {
+	toc := estargzTOC{}
+	if size < EStargzFooterSize {
+		return toc, "", fmt.Errorf("not an eStargz blob: too small")
+	}
+	footer := make([]byte, EStargzFooterSize)
+	if _, err := blob.ReadAt(footer, size-EStargzFooterSize); err != nil {
+		return toc, "", err
+	}
+	footerReader, err := gzip.NewReader(bytes.NewReader(footer))
+	if err != nil {
+		return toc, "", fmt.Errorf("not an eStargz blob: %w", err)
+	}
+	extra := footerReader.Header.Extra
+	if len(extra) != 4+22 || extra[0] != 'S' || extra[1] != 'G' || string(extra[4+16:]) != "STARGZ" {
+		return toc, "", fmt.Errorf("not an eStargz blob: invalid footer")
+	}
+	tocOffset, err := strconv.ParseInt(string(extra[4:4+16]), 16, 64)
+	if err != nil || tocOffset >= size-EStargzFooterSize {
+		return toc, "", fmt.Errorf("not an eStargz blob: invalid TOC offset")
+	}
+
+	gzipReader, err := gzip.NewReader(io.NewSectionReader(blob, tocOffset, size-EStargzFooterSize-tocOffset))
+	if err != nil {
+		return toc, "", err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+	header, err := tarReader.Next()
+	if err != nil {
+		return toc, "", err
+	}
+	if header.Name != EStargzTOCTarName {
+		return toc, "", fmt.Errorf("not an eStargz blob: unexpected entry %s at TOC offset", header.Name)
+	}
+	tocBytes, err := io.ReadAll(tarReader)
+	if err != nil {
+		return toc, "", err
+	}
+	err = json.Unmarshal(tocBytes, &toc)
+	return toc, fmt.Sprintf("sha256:%x", sha256.Sum256(tocBytes)), err
+}
+
+// EStargzTOCDigest returns the digest of the TOC of an eStargz blob (sha256:<hex>), reading only the TOC
+func EStargzTOCDigest(blob io.ReaderAt, size int64) (string, error) {
+	_, tocDigest, err := readEStargzTOC(blob, size)
+	return tocDigest, err
+}
+
+/*
+VerifyEStargz checks an eStargz blob against its TOC: the TOC must match tocDigest (if not empty) and every file and chunk
+must be readable from the offset recorded in the TOC with the recorded digest.
+*/
+func VerifyEStargz(blob io.ReaderAt, size int64, tocDigest string) error {
+	toc, actualDigest, err := readEStargzTOC(blob, size)
+	if err != nil {
+		return err
+	}
+	if tocDigest != "" && tocDigest != actualDigest {
+		return fmt.Errorf("TOC digest mismatch: expected %s, found %s", tocDigest, actualDigest)
+	}
+
+	var fileHash hash.Hash
+	var file *estargzEntry
+	checkFile := func() error {
+		if file != nil && file.Digest != "" {
+			if digest := fmt.Sprintf("sha256:%x", fileHash.Sum(nil)); digest != file.Digest {
+				return fmt.Errorf("digest mismatch for %s: expected %s, found %s", file.Name, file.Digest, digest)
+			}
+		}
+		file = nil
+		return nil
+	}
+
+	for i := range toc.Entries {
+		entry := &toc.Entries[i]
+		if entry.Type != "chunk" {
+			if err := checkFile(); err != nil {
+				return err
+			}
+		}
+		if entry.Offset < 0 || entry.Offset >= size {
+			return fmt.Errorf("invalid offset %d for %s", entry.Offset, entry.Name)
+		}
+		if entry.Type != "reg" && entry.Type != "chunk" {
+			continue
+		}
+		if entry.Type == "chunk" && (file == nil || file.Name != entry.Name) {
+			return fmt.Errorf("chunk of %s without a file entry", entry.Name)
+		}
+
+		gzipReader, err := gzip.NewReader(io.NewSectionReader(blob, entry.Offset, size-entry.Offset))
+		if err != nil {
+			return fmt.Errorf("%s at offset %d: %w", entry.Name, entry.Offset, err)
+		}
+		var content io.Reader = gzipReader
+		if entry.Type == "reg" {
+			file = entry
+			fileHash = sha256.New()
+			tarReader := tar.NewReader(gzipReader)
+			header, err := tarReader.Next()
+			if err != nil {
+				return fmt.Errorf("%s at offset %d: %w", entry.Name, entry.Offset, err)
+			}
+			if cleanTarPath(header.Name) != entry.Name {
+				return fmt.Errorf("entry at offset %d is %s, expected %s", entry.Offset, header.Name, entry.Name)
+			}
+			content = tarReader
+		}
+		chunkSize := entry.ChunkSize
+		if chunkSize == 0 {
+			chunkSize = file.Size - entry.ChunkOffset
+		}
+		chunkHash := sha256.New()
+		if _, err := io.CopyN(io.MultiWriter(chunkHash, fileHash), content, chunkSize); err != nil {
+			return fmt.Errorf("%s at offset %d: %w", entry.Name, entry.Offset, err)
+		}
+		gzipReader.Close()
+		if entry.ChunkDigest != "" {
+			if digest := fmt.Sprintf("sha256:%x", chunkHash.Sum(nil)); digest != entry.ChunkDigest {
+				return fmt.Errorf("chunk digest mismatch for %s at %d: expected %s, found %s", entry.Name, entry.ChunkOffset, entry.ChunkDigest, digest)
+			}
+		}
+	}
+	return checkFile()
+}
@@ -0,0 +1,123 @@
+package compress
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// writeTar writes an uncompressed tar file out of name->content pairs
+func writeTar(t *testing.T, files map[string]string) string {
+	gzipped := writeTarGz(t, files)
+	gzipReader, err := gzip.NewReader(gzipped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarFile, err := os.CreateTemp("", "layer-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tarFile.Close()
+	if _, err := io.Copy(tarFile, gzipReader); err != nil {
+		t.Fatal(err)
+	}
+	return tarFile.Name()
+}
+
+func TestTarToEStargz(t *testing.T) {
+	big := strings.Repeat("0123456789abcdef", (EStargzChunkSize*2+1000)/16)
+	files := map[string]string{"/opt/big.bin": big, "etc/app.conf": "conf", "empty": ""}
+	tarPath := writeTar(t, files)
+	defer os.Remove(tarPath)
+
+	blobPath, tocDigest, err := TarToEStargz(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(blobPath)
+	blob, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = VerifyEStargz(bytes.NewReader(blob), int64(len(blob)), tocDigest)
+	if err != nil {
+		t.Fatalf("Verification failed: %v", err)
+	}
+	digest, err := EStargzTOCDigest(bytes.NewReader(blob), int64(len(blob)))
+	if err != nil || digest != tocDigest {
+		t.Errorf("Unexpected TOC digest %s, expected %s: %v", digest, tocDigest, err)
+	}
+
+	// the blob is a regular tar.gz with the same files
+	gzipReader, err := gzip.NewReader(bytes.NewReader(blob))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+	found := map[string]string{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found[header.Name] = string(content)
+	}
+	for name, content := range files {
+		if found[cleanTarPath(name)] != content {
+			t.Errorf("Unexpected content for %s", name)
+		}
+	}
+	if _, ok := found[EStargzTOCTarName]; !ok {
+		t.Errorf("TOC entry not found")
+	}
+
+	// wrong TOC digest and corrupted content are detected
+	if err := VerifyEStargz(bytes.NewReader(blob), int64(len(blob)), "sha256:0000"); err == nil {
+		t.Errorf("Expected TOC digest mismatch")
+	}
+	corrupted := append([]byte{}, blob...)
+	corrupted[len(corrupted)/2] ^= 0xff
+	if err := VerifyEStargz(bytes.NewReader(corrupted), int64(len(corrupted)), ""); err == nil {
+		t.Errorf("Expected corrupted blob to fail verification")
+	}
+}
+
+func TestMergeEStargz(t *testing.T) {
+	layers := []io.Reader{}
+	for _, files := range []map[string]string{{"a.txt": "lower a"}, {"b.txt": "upper b"}} {
+		tarPath := writeTar(t, files)
+		defer os.Remove(tarPath)
+		blobPath, _, err := TarToEStargz(tarPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(blobPath)
+		blob, err := os.ReadFile(blobPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, bytes.NewReader(blob))
+	}
+
+	merged, err := MergeTarGz(layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(merged)
+	actual := readTar(t, merged)
+	if len(actual) != 2 || actual["a.txt"] != "lower a" || actual["b.txt"] != "upper b" {
+		t.Fatalf("expected the files of the layers without their eStargz metadata, got %v", actual)
+	}
+}
@@ -0,0 +1,204 @@
+package compress
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	PackageTypePyPI = "pypi"
+	PackageTypeNpm  = "npm"
+	PackageTypeDeb  = "deb"
+	PackageTypeApk  = "apk"
+
+	// package metadata files larger than this are not parsed
+	maxPackageMetadataSize = 16 << 20
+)
+
+// Package is a software package detected through the metadata files of a package manager
+type Package struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Type    string `json:"type"`
+	// Path is the metadata file declaring the package
+	Path string `json:"path"`
+}
+
+var nodePackagePattern = regexp.MustCompile(`(^|/)node_modules/(@[^/]+/)?[^/@]+/package\.json$`)
+
+// PURL returns the package URL identifying the package
+func (p Package) PURL() string {
+	name := purlEscape(p.Name)
+	if p.Type == PackageTypeNpm {
+		// the scope of npm packages is the namespace
+		if scope, pkg, found := strings.Cut(p.Name, "/"); found {
+			name = purlEscape(scope) + "/" + purlEscape(pkg)
+		}
+	}
+	namespace := ""
+	switch p.Type {
+	case PackageTypeDeb:
+		namespace = "debian/"
+	case PackageTypeApk:
+		namespace = "alpine/"
+	}
+	return "pkg:" + p.Type + "/" + namespace + name + "@" + purlEscape(p.Version)
+}
+
+// purlEscape percent-encodes every character but the unreserved ones
+func purlEscape(s string) string {
+	escaped := strings.Builder{}
+	for _, c := range []byte(s) {
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+// packageMetadataType returns the package manager owning a metadata file, empty if the file is not package metadata
+func packageMetadataType(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".dist-info/METADATA"), strings.HasSuffix(name, ".egg-info/PKG-INFO"):
+		return PackageTypePyPI
+	case nodePackagePattern.MatchString(name):
+		return PackageTypeNpm
+	case name == "var/lib/dpkg/status", strings.HasPrefix(name, "var/lib/dpkg/status.d/"):
+		return PackageTypeDeb
+	case name == "lib/apk/db/installed":
+		return PackageTypeApk
+	}
+	return ""
+}
+
+/*
+DetectPackagesTarGz lists the packages declared by the metadata files of a tar+gzip layer: Python distributions, node modules,
+dpkg and apk databases. Packages are sorted by type, name and version.
+*/
+func DetectPackagesTarGz(targz io.Reader) ([]Package, error) {
+	gzipReader, err := gzip.NewReader(targz)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	tarReader := tar.NewReader(gzipReader)
+
+	packages := []Package{}
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > maxPackageMetadataSize {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+header.Name), "/")
+		packageType := packageMetadataType(name)
+		if packageType == "" {
+			continue
+		}
+		content, err := io.ReadAll(tarReader)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range parsePackageMetadata(packageType, content) {
+			p.Path = "/" + name
+			packages = append(packages, p)
+		}
+	}
+
+	sort.SliceStable(packages, func(i, j int) bool {
+		if packages[i].Type != packages[j].Type {
+			return packages[i].Type < packages[j].Type
+		}
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+	return packages, nil
+}
+
+// parsePackageMetadata extracts the packages of a metadata file, malformed files declare no package
+func parsePackageMetadata(packageType string, content []byte) []Package {
+	switch packageType {
+	case PackageTypeNpm:
+		manifest := struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+		}{}
+		if json.Unmarshal(content, &manifest) != nil || manifest.Name == "" {
+			return nil
+		}
+		return []Package{{Name: manifest.Name, Version: manifest.Version, Type: packageType}}
+	case PackageTypePyPI:
+		// the headers end at the first empty line
+		fields := parseFields(content, ": ")
+		if len(fields) == 0 || fields[0]["Name"] == "" {
+			return nil
+		}
+		return []Package{{Name: fields[0]["Name"], Version: fields[0]["Version"], Type: packageType}}
+	case PackageTypeDeb:
+		packages := []Package{}
+		for _, stanza := range parseFields(content, ": ") {
+			if stanza["Package"] != "" {
+				packages = append(packages, Package{Name: stanza["Package"], Version: stanza["Version"], Type: packageType})
+			}
+		}
+		return packages
+	case PackageTypeApk:
+		packages := []Package{}
+		for _, stanza := range parseFields(content, ":") {
+			if stanza["P"] != "" {
+				packages = append(packages, Package{Name: stanza["P"], Version: stanza["V"], Type: packageType})
+			}
+		}
+		return packages
+	}
+	return nil
+}
+
+// parseFields parses "key<separator>value" stanzas separated by empty lines, continuation lines are ignored
+func parseFields(content []byte, separator string) []map[string]string {
+	stanzas := []map[string]string{}
+	current := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(make([]byte, 64*1024), maxPackageMetadataSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				stanzas = append(stanzas, current)
+				current = map[string]string{}
+			}
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			continue
+		}
+		key, value, found := strings.Cut(line, separator)
+		if found {
+			if _, ok := current[key]; !ok {
+				current[key] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+	return stanzas
+}
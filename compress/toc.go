@@ -0,0 +1,99 @@
+package compress
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+)
+
+const (
+	TOCTypeFile     = "file"
+	TOCTypeDir      = "dir"
+	TOCTypeSymlink  = "symlink"
+	TOCTypeHardlink = "hardlink"
+	TOCTypeWhiteout = "whiteout"
+	TOCTypeOpaque   = "opaque"
+	TOCTypeOther    = "other"
+)
+
+// TOCEntry describes a single entry of a layer
+type TOCEntry struct {
+	// Path is absolute and clean, e.g. /opt/models/x.bin. For whiteouts it is the removed path, for opaque markers the hidden directory
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Mode int64  `json:"mode"`
+	// Digest is the sha256 of the content of regular files
+	Digest string `json:"digest,omitempty"`
+	// Link is the target of symlinks and hardlinks
+	Link string `json:"link,omitempty"`
+}
+
+// TableOfContentsTarGz returns the table of contents of a gzipped tar, see TableOfContents
+func TableOfContentsTarGz(targz io.Reader) ([]TOCEntry, error) {
+	gzipReader, err := gzip.NewReader(targz)
+	if err != nil {
+		return nil, err
+	}
+	defer gzipReader.Close()
+	return TableOfContents(gzipReader)
+}
+
+// TableOfContents returns path, type, size, mode and content digest of every entry of a tar, in archive order
+func TableOfContents(tarStream io.Reader) ([]TOCEntry, error) {
+	tarReader := tar.NewReader(tarStream)
+	entries := []TOCEntry{}
+	copyBuffer := make([]byte, 1024*1024)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := cleanTarPath(header.Name)
+		if IsEStargzMetadata(name) {
+			// the index and landmarks of eStargz layers are not files of the image
+			continue
+		}
+		entry := TOCEntry{
+			Path: "/" + name,
+			Size: header.Size,
+			Mode: header.Mode,
+		}
+		if target, isOpaque := whiteoutTarget(name); target != "" {
+			entry.Path = "/" + cleanTarPath(target)
+			entry.Type = TOCTypeWhiteout
+			if isOpaque {
+				entry.Type = TOCTypeOpaque
+			}
+			entries = append(entries, entry)
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			entry.Type = TOCTypeFile
+			hash := sha256.New()
+			if _, err := io.CopyBuffer(hash, tarReader, copyBuffer); err != nil {
+				return nil, err
+			}
+			entry.Digest = fmt.Sprintf("%x", hash.Sum(nil))
+		case tar.TypeDir:
+			entry.Type = TOCTypeDir
+		case tar.TypeSymlink:
+			entry.Type = TOCTypeSymlink
+			entry.Link = header.Linkname
+		case tar.TypeLink:
+			entry.Type = TOCTypeHardlink
+			entry.Link = header.Linkname
+		default:
+			entry.Type = TOCTypeOther
+		}
+		entries = append(entries, entry)
+	}
+}
@@ -0,0 +1,103 @@
+package filesystem
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+const (
+	// ConflictsFail makes the build fail if two cells write the same path
+	ConflictsFail = "fail"
+	// ConflictsWarn logs the paths written by more than one cell
+	ConflictsWarn = "warn"
+	// ConflictsAllow accepts paths written by more than one cell
+	ConflictsAllow = "allow"
+)
+
+// PathConflict is a destination path written by the allotments of more than one cell
+type PathConflict struct {
+	Path  string
+	Cells []Cell
+}
+
+func (c PathConflict) String() string {
+	cells := []string{}
+	for _, cell := range c.Cells {
+		cells = append(cells, fmt.Sprintf("%d/%d", cell.Row, cell.Col))
+	}
+	return fmt.Sprintf("%s written by %s", c.Path, strings.Join(cells, ", "))
+}
+
+// ConflictPolicy returns the manifest conflict policy, validating it
+func (m TwoDFsManifest) ConflictPolicy() (string, error) {
+	switch m.Conflicts {
+	case "":
+		return ConflictsWarn, nil
+	case ConflictsFail, ConflictsWarn, ConflictsAllow:
+		return m.Conflicts, nil
+	}
+	return "", fmt.Errorf("invalid conflicts policy %s, supported policies: %s, %s, %s", m.Conflicts, ConflictsFail, ConflictsWarn, ConflictsAllow)
+}
+
+/*
+DetectConflicts returns the destination paths written or removed by allotments of different cells.
+A path also conflicts with the paths below it, e.g. a file /opt/model conflicts with /opt/model/weights.bin.
+*/
+func DetectConflicts(manifest TwoDFsManifest) []PathConflict {
+	writers := make(map[string][]Cell)
+	for _, a := range manifest.Allotments {
+		cell := Cell{Row: a.Row, Col: a.Col}
+		for _, dst := range append(append([]string{}, a.Dst.List...), a.Remove.List...) {
+			p := path.Clean("/" + dst)
+			if !containsCell(writers[p], cell) {
+				writers[p] = append(writers[p], cell)
+			}
+		}
+	}
+
+	// a path collects the writers of the paths below it
+	collected := make(map[string][]Cell)
+	for p, cells := range writers {
+		collected[p] = append(collected[p], cells...)
+	}
+	for p, cells := range writers {
+		for parent := path.Dir(p); parent != "/"; parent = path.Dir(parent) {
+			if _, ok := writers[parent]; !ok {
+				continue
+			}
+			for _, cell := range cells {
+				if !containsCell(collected[parent], cell) {
+					collected[parent] = append(collected[parent], cell)
+				}
+			}
+		}
+	}
+
+	conflicts := []PathConflict{}
+	for p, cells := range collected {
+		if len(cells) > 1 {
+			sort.Slice(cells, func(i, j int) bool {
+				if cells[i].Row != cells[j].Row {
+					return cells[i].Row < cells[j].Row
+				}
+				return cells[i].Col < cells[j].Col
+			})
+			conflicts = append(conflicts, PathConflict{Path: p, Cells: cells})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+	return conflicts
+}
+
+func containsCell(cells []Cell, cell Cell) bool {
+	for _, c := range cells {
+		if c == cell {
+			return true
+		}
+	}
+	return false
+}
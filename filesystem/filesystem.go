@@ -19,6 +19,13 @@ func (f *TwoDFilesystem) AddAllotment(allotment Allotment) Field {
 	f.genAllotments(allotment.Row, allotment.Col)
 	f.Rows[allotment.Row].Allotments[allotment.Col].Digest = allotment.Digest
 	f.Rows[allotment.Row].Allotments[allotment.Col].DiffID = allotment.DiffID
+	f.Rows[allotment.Row].Allotments[allotment.Col].Requires = allotment.Requires
+	f.Rows[allotment.Row].Allotments[allotment.Col].Priority = allotment.Priority
+	f.Rows[allotment.Row].Allotments[allotment.Col].TOC = allotment.TOC
+	f.Rows[allotment.Row].Allotments[allotment.Col].SBOM = allotment.SBOM
+	f.Rows[allotment.Row].Allotments[allotment.Col].EStargzTOC = allotment.EStargzTOC
+	f.Rows[allotment.Row].Allotments[allotment.Col].Delta = allotment.Delta
+	f.Rows[allotment.Row].Allotments[allotment.Col].Encryption = allotment.Encryption
 	return f
 }
 
@@ -81,3 +88,36 @@ func (f *TwoDFilesystem) IterateAllotments() chan Allotment {
 	}()
 	return c
 }
+
+func (f *TwoDFilesystem) SetSelectionPriority(cells []Cell) Field {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.SelectionPriority = cells
+	return f
+}
+
+func (f *TwoDFilesystem) GetSelectionPriority() []Cell {
+	return f.SelectionPriority
+}
+
+func (f *TwoDFilesystem) SetOwner(owner string) Field {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.Owner = owner
+	return f
+}
+
+func (f *TwoDFilesystem) GetOwner() string {
+	return f.Owner
+}
+
+func (f *TwoDFilesystem) SetRules(rules []PartitionRule) Field {
+	f.mtx.Lock()
+	defer f.mtx.Unlock()
+	f.Rules = rules
+	return f
+}
+
+func (f *TwoDFilesystem) GetRules() []PartitionRule {
+	return f.Rules
+}
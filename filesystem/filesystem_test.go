@@ -231,3 +231,27 @@ func TestMarshalUnmarshal(t *testing.T) {
 
 	isTheSame(f, unmarshaled, t)
 }
+
+func TestDetectConflicts(t *testing.T) {
+	manifest := TwoDFsManifest{
+		Allotments: []AllotmentManifest{
+			{Dst: StringList{List: []string{"/etc/app.conf"}}, Row: 0, Col: 0},
+			{Dst: StringList{List: []string{"etc/app.conf", "/bin/tool"}}, Row: 0, Col: 1},
+			{Dst: StringList{List: []string{"/opt/model"}}, Row: 1, Col: 0},
+			{Dst: StringList{List: []string{"/opt/model/weights.bin"}}, Row: 1, Col: 1},
+			{Dst: StringList{List: []string{"/opt/model x"}}, Row: 2, Col: 0},
+		},
+	}
+
+	conflicts := DetectConflicts(manifest)
+
+	if len(conflicts) != 2 {
+		t.Fatalf("expected 2 conflicts, actual %v", conflicts)
+	}
+	if conflicts[0].Path != "/etc/app.conf" || len(conflicts[0].Cells) != 2 {
+		t.Errorf("unexpected conflict %v", conflicts[0])
+	}
+	if conflicts[1].Path != "/opt/model" || len(conflicts[1].Cells) != 2 {
+		t.Errorf("unexpected conflict %v", conflicts[1])
+	}
+}
@@ -0,0 +1,323 @@
+package filesystem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// PartitionRule selects cells of the field when its condition holds for a device profile.
+// The selection is the union of every cell in Rows, every cell in Cols and the explicit Cells.
+type PartitionRule struct {
+	// When is a condition over the device profile, e.g. `arch == arm64 && gpu == false` or `memory >= 8GB`
+	When  string `json:"when"`
+	Rows  []int  `json:"rows,omitempty"`
+	Cols  []int  `json:"cols,omitempty"`
+	Cells []Cell `json:"cells,omitempty"`
+}
+
+// Selects returns true if the cell at row,col is selected by the rule
+func (r PartitionRule) Selects(row int, col int) bool {
+	for _, rr := range r.Rows {
+		if rr == row {
+			return true
+		}
+	}
+	for _, cc := range r.Cols {
+		if cc == col {
+			return true
+		}
+	}
+	for _, cell := range r.Cells {
+		if cell.Row == row && cell.Col == col {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRule checks the syntax of a rule condition
+func ValidateRule(condition string) error {
+	_, err := parseCondition(condition)
+	return err
+}
+
+/*
+EvaluateRule evaluates a rule condition against a device profile.
+Conditions compare a profile property (left) with a literal (right) using ==, !=, >, >=, <, <=.
+Literals can be bare words, quoted strings, numbers, sizes (e.g. 8GB) or booleans. A property alone is true if it is a true boolean.
+Comparisons can be combined with &&, || and !, and grouped with parentheses. A property missing from the profile differs from every literal:
+!= on it is true, every other comparison and the property alone are false.
+*/
+func EvaluateRule(condition string, profile map[string]interface{}) (bool, error) {
+	node, err := parseCondition(condition)
+	if err != nil {
+		return false, err
+	}
+	return node.eval(profile)
+}
+
+type conditionNode interface {
+	eval(profile map[string]interface{}) (bool, error)
+}
+
+type andNode struct{ left, right conditionNode }
+type orNode struct{ left, right conditionNode }
+type notNode struct{ operand conditionNode }
+type propertyNode struct{ property string }
+type comparisonNode struct {
+	property string
+	operator string
+	literal  string
+}
+
+func (n andNode) eval(profile map[string]interface{}) (bool, error) {
+	left, err := n.left.eval(profile)
+	if err != nil || !left {
+		return false, err
+	}
+	return n.right.eval(profile)
+}
+
+func (n orNode) eval(profile map[string]interface{}) (bool, error) {
+	left, err := n.left.eval(profile)
+	if err != nil || left {
+		return left, err
+	}
+	return n.right.eval(profile)
+}
+
+func (n notNode) eval(profile map[string]interface{}) (bool, error) {
+	result, err := n.operand.eval(profile)
+	return !result, err
+}
+
+func (n propertyNode) eval(profile map[string]interface{}) (bool, error) {
+	value, ok := profile[n.property]
+	if !ok {
+		return false, nil
+	}
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		return strconv.ParseBool(v)
+	default:
+		return false, fmt.Errorf("property %s is not a boolean", n.property)
+	}
+}
+
+func (n comparisonNode) eval(profile map[string]interface{}) (bool, error) {
+	value, ok := profile[n.property]
+	if !ok {
+		// a missing property differs from every literal
+		return n.operator == "!=", nil
+	}
+
+	// numeric comparison if both sides are numbers or sizes
+	left, leftIsNumber := toNumber(value)
+	right, rightIsNumber := toNumber(n.literal)
+	if leftIsNumber && rightIsNumber {
+		switch n.operator {
+		case "==":
+			return left == right, nil
+		case "!=":
+			return left != right, nil
+		case ">":
+			return left > right, nil
+		case ">=":
+			return left >= right, nil
+		case "<":
+			return left < right, nil
+		case "<=":
+			return left <= right, nil
+		}
+	}
+
+	leftStr := fmt.Sprintf("%v", value)
+	switch n.operator {
+	case "==":
+		return leftStr == n.literal, nil
+	case "!=":
+		return leftStr != n.literal, nil
+	}
+	return false, fmt.Errorf("operator %s requires numeric values, given %s=%v and %s", n.operator, n.property, value, n.literal)
+}
+
+// toNumber converts numbers, numeric strings and sizes to float64
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case string:
+		if number, err := strconv.ParseFloat(v, 64); err == nil {
+			return number, true
+		}
+		if len(v) > 0 && unicode.IsDigit(rune(v[0])) {
+			if size, err := ParseSize(v); err == nil {
+				return float64(size), true
+			}
+		}
+	}
+	return 0, false
+}
+
+type conditionParser struct {
+	tokens []string
+	pos    int
+}
+
+func parseCondition(condition string) (conditionNode, error) {
+	tokens, err := tokenizeCondition(condition)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty condition")
+	}
+	p := &conditionParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s in condition %q", p.tokens[p.pos], condition)
+	}
+	return node, nil
+}
+
+func (p *conditionParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *conditionParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *conditionParser) parseOr() (conditionNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "||" {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseAnd() (conditionNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "&&" {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = andNode{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *conditionParser) parseUnary() (conditionNode, error) {
+	switch token := p.next(); {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of condition")
+	case token == "!":
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand: operand}, nil
+	case token == "(":
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return node, nil
+	case isOperatorToken(token):
+		return nil, fmt.Errorf("unexpected %s, expected a property", token)
+	default:
+		if isComparisonOperator(p.peek()) {
+			operator := p.next()
+			literal := p.next()
+			if literal == "" || isOperatorToken(literal) {
+				return nil, fmt.Errorf("missing value after %s %s", token, operator)
+			}
+			return comparisonNode{property: token, operator: operator, literal: strings.Trim(literal, `"'`)}, nil
+		}
+		return propertyNode{property: token}, nil
+	}
+}
+
+func isComparisonOperator(token string) bool {
+	switch token {
+	case "==", "!=", ">", ">=", "<", "<=":
+		return true
+	}
+	return false
+}
+
+func isOperatorToken(token string) bool {
+	switch token {
+	case "&&", "||", "!", "(", ")":
+		return true
+	}
+	return isComparisonOperator(token)
+}
+
+func tokenizeCondition(condition string) ([]string, error) {
+	tokens := []string{}
+	for i := 0; i < len(condition); {
+		c := condition[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.HasPrefix(condition[i:], "&&"), strings.HasPrefix(condition[i:], "||"),
+			strings.HasPrefix(condition[i:], "=="), strings.HasPrefix(condition[i:], "!="),
+			strings.HasPrefix(condition[i:], ">="), strings.HasPrefix(condition[i:], "<="):
+			tokens = append(tokens, condition[i:i+2])
+			i += 2
+		case c == '!' || c == '(' || c == ')' || c == '>' || c == '<':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(condition[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in condition %q", condition)
+			}
+			tokens = append(tokens, condition[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(condition) && !strings.ContainsRune(" \t\n!()<>=&|\"'", rune(condition[i])) {
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected %q in condition %q", c, condition)
+			}
+			tokens = append(tokens, condition[start:i])
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,50 @@
+package filesystem
+
+import (
+	"testing"
+)
+
+func TestEvaluateRule(t *testing.T) {
+	profile := map[string]interface{}{
+		"arch":   "arm64",
+		"gpu":    false,
+		"memory": "16GB",
+		"cores":  float64(4),
+	}
+
+	tests := []struct {
+		condition string
+		expected  bool
+	}{
+		{"arch == arm64 && gpu == false", true},
+		{"arch == amd64 || gpu", false},
+		{"memory >= 8GB", true},
+		{"memory < 8GB", false},
+		{"cores > 2 && !(arch == \"amd64\")", true},
+		// properties missing from the profile differ from every literal
+		{"vendor == nvidia", false},
+		{"vendor != nvidia", true},
+		{"vendor >= 0", false},
+		{"vendor", false},
+		{"!(vendor == nvidia) && gpu != true", true},
+	}
+
+	for _, test := range tests {
+		result, err := EvaluateRule(test.condition, profile)
+		if err != nil {
+			t.Fatalf("%s: %v", test.condition, err)
+		}
+		if result != test.expected {
+			t.Errorf("%s: expected %v, actual %v", test.condition, test.expected, result)
+		}
+	}
+}
+
+func TestValidateRule(t *testing.T) {
+	invalid := []string{"", "arch ==", "(arch == arm64", "arch == arm64 &&", "== arm64"}
+	for _, condition := range invalid {
+		if ValidateRule(condition) == nil {
+			t.Errorf("expected %q to be invalid", condition)
+		}
+	}
+}
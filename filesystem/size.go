@@ -0,0 +1,34 @@
+package filesystem
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ParseSize parses human readable sizes such as 500MB, 1.5GiB or 2048. Decimal units are powers of 1000, binary units powers of 1024.
+func ParseSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier float64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+		{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+		{"K", 1e3}, {"M", 1e6}, {"G", 1e9}, {"T", 1e12},
+		{"B", 1},
+	}
+	trimmed := strings.TrimSpace(size)
+	multiplier := float64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(strings.ToUpper(trimmed), strings.ToUpper(unit.suffix)) {
+			trimmed = strings.TrimSpace(trimmed[:len(trimmed)-len(unit.suffix)])
+			multiplier = unit.multiplier
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %s", size)
+	}
+	return int64(value * multiplier), nil
+}
@@ -0,0 +1,23 @@
+package filesystem
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"500MB":  500 * 1000 * 1000,
+		"1GiB":   1 << 30,
+		"2048":   2048,
+		"1.5 kb": 1500,
+	}
+	for size, expected := range tests {
+		result, err := ParseSize(size)
+		if err != nil {
+			t.Fatalf("%s: %v", size, err)
+		}
+		if result != expected {
+			t.Errorf("%s: expected %d, actual %d", size, expected, result)
+		}
+	}
+}
@@ -7,10 +7,38 @@ import (
 )
 
 type Allotment struct {
-	Row    int    `json:"row"`
-	Col    int    `json:"col"`
+	Row      int    `json:"row"`
+	Col      int    `json:"col"`
+	Digest   string `json:"digest"`
+	DiffID   string `json:"diffid"`
+	Requires []Cell `json:"requires,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+	// TOC is the digest of the blob listing the files of the allotment
+	TOC string `json:"toc,omitempty"`
+	// SBOM is the digest of the SPDX document listing the files and packages of the allotment
+	SBOM string `json:"sbom,omitempty"`
+	// EStargzTOC is the digest of the eStargz TOC embedded in the layer, empty if the layer is not lazy-pullable
+	EStargzTOC string `json:"estargz_toc,omitempty"`
+	// Delta rebuilds the layer out of the same cell of a previous image
+	Delta *AllotmentDelta `json:"delta,omitempty"`
+	// Encryption is set if Digest is an encrypted layer that only the recipients can decrypt
+	Encryption *AllotmentEncryption `json:"encryption,omitempty"`
+}
+
+// AllotmentEncryption describes an encrypted allotment layer
+type AllotmentEncryption struct {
+	// Annotations are the ocicrypt annotations of the layer descriptor: wrapped keys and public cipher options
+	Annotations map[string]string `json:"annotations"`
+}
+
+// AllotmentDelta is a binary delta that rebuilds an allotment layer out of the layer of a previous image
+type AllotmentDelta struct {
+	// From is the digest of the base allotment layer
+	From string `json:"from"`
+	// Digest is the digest of the delta blob
 	Digest string `json:"digest"`
-	DiffID string `json:"diffid"`
+	// Format is the content the delta applies to: tar for uncompressed layers, gzip for compressed blobs
+	Format string `json:"format"`
 }
 
 type Cols struct {
@@ -18,11 +46,19 @@ type Cols struct {
 	TotAllotments int         `json:"allotments_size"`
 }
 
+// Cell identifies an allotment position in the field
+type Cell struct {
+	Row int `json:"row"`
+	Col int `json:"col"`
+}
+
 type TwoDFilesystem struct {
-	Rows    []Cols `json:"rows"`
-	TotRows int    `json:"rows_size"`
-	Owner   string `json:"owner"`
-	mtx     sync.Mutex
+	Rows              []Cols          `json:"rows"`
+	TotRows           int             `json:"rows_size"`
+	Owner             string          `json:"owner"`
+	SelectionPriority []Cell          `json:"selection_priority,omitempty"`
+	Rules             []PartitionRule `json:"rules,omitempty"`
+	mtx               sync.Mutex
 }
 
 type AllotmentManifest struct {
@@ -30,10 +66,24 @@ type AllotmentManifest struct {
 	Dst StringList `json:"dst"`
 	Row int        `json:"row"`
 	Col int        `json:"col"`
+	// Requires lists the cells this allotment is useless without
+	Requires []Cell `json:"requires,omitempty"`
+	// Priority orders the partition layers: allotments with higher priority are layered on top and win on conflicting paths
+	Priority int `json:"priority,omitempty"`
+	// Remove lists files or directories to delete from the lower layers. A path ending with "/" hides the directory content only
+	Remove StringList `json:"remove,omitempty"`
+	// Encrypt stores the layer encrypted with a per-cell key wrapped for the build recipients
+	Encrypt bool `json:"encrypt,omitempty"`
 }
 
 type TwoDFsManifest struct {
 	Allotments []AllotmentManifest `json:"allotments"`
+	// Conflicts is the policy applied when allotments of different cells write the same path: fail, warn (default) or allow
+	Conflicts string `json:"conflicts,omitempty"`
+	// SelectionPriority lists the cells to prefer, in order, when a partition is chosen automatically
+	SelectionPriority []Cell `json:"selection_priority,omitempty"`
+	// Rules map device capabilities to cells, they are stored in the field and evaluated by tdfs image resolve
+	Rules []PartitionRule `json:"rules,omitempty"`
 }
 
 type Field interface {
@@ -45,6 +95,18 @@ type Field interface {
 	Unmarshal(string) (Field, error)
 	// IterateAllotments iterates over all allotments in the filesystem
 	IterateAllotments() chan Allotment
+	// SetSelectionPriority sets the cells to prefer when a partition is chosen automatically
+	SetSelectionPriority(cells []Cell) Field
+	// GetSelectionPriority returns the cells to prefer when a partition is chosen automatically
+	GetSelectionPriority() []Cell
+	// SetOwner sets the identity of the publisher of the field
+	SetOwner(owner string) Field
+	// GetOwner returns the identity of the publisher of the field
+	GetOwner() string
+	// SetRules sets the rules mapping device profiles to cells
+	SetRules(rules []PartitionRule) Field
+	// GetRules returns the rules mapping device profiles to cells
+	GetRules() []PartitionRule
 }
 
 // StringOrStringList represents a type that wraps a string list. It unmarshals as list even a single string.
@@ -0,0 +1,194 @@
+package oci
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/2DFS/2dfs-builder/filesystem"
+)
+
+// selectBudgetPartitions chooses the partitions whose base layers plus allotments fit the budget (bytes).
+// Cells are taken following the field selection priority if declared, otherwise the largest rectangle anchored at (0,0) is chosen.
+func (c *containerImage) selectBudgetPartitions(budget int64) error {
+	err := c.loadField()
+	if err != nil {
+		return err
+	}
+	if c.field == nil {
+		return fmt.Errorf("no 2DFS field found. Make sure the image has format OCI+2DFS")
+	}
+
+	baseSize, err := c.baseSize(c.partitionOpts.Platform)
+	if err != nil {
+		return err
+	}
+	available := budget - baseSize
+	if available < 0 {
+		return fmt.Errorf("budget of %d bytes is smaller than the base image (%d bytes)", budget, baseSize)
+	}
+
+	sizes := make(map[filesystem.Cell]int64)
+	requires := make(map[filesystem.Cell][]filesystem.Cell)
+	for allotment := range c.field.IterateAllotments() {
+		if allotment.Digest == "" {
+			continue
+		}
+		size, err := c.blobCache.GetSize(allotment.Digest)
+		if err != nil {
+			return err
+		}
+		cell := filesystem.Cell{Row: allotment.Row, Col: allotment.Col}
+		sizes[cell] = size
+		requires[cell] = allotment.Requires
+	}
+
+	if priority := c.field.GetSelectionPriority(); len(priority) > 0 {
+		cells := budgetByPriority(priority, sizes, requires, available)
+		if len(cells) == 0 {
+			return fmt.Errorf("no allotment fits the budget of %d bytes (base image %d bytes)", budget, baseSize)
+		}
+		c.partitions = cellsToPartitions(cells)
+	} else {
+		rectangle, ok := budgetByRectangle(sizes, requires, available)
+		if !ok {
+			return fmt.Errorf("no allotment fits the budget of %d bytes (base image %d bytes)", budget, baseSize)
+		}
+		c.partitions = []partition{rectangle}
+	}
+
+	c.partitionTag = c.tag + formatPartitions(c.partitions)
+	fmt.Printf("Selected partition %s/%s:%s\n", c.registry, c.repository, c.partitionTag)
+	return nil
+}
+
+// baseSize returns the compressed size of the base layers of the given os/arch platform, or of the largest platform if empty
+func (c *containerImage) baseSize(platform string) (int64, error) {
+	maxSize := int64(-1)
+	for i, manifest := range c.manifests {
+		if platform != "" {
+			p := c.index.Manifests[i].Platform
+			if p == nil || fmt.Sprintf("%s/%s", p.OS, p.Architecture) != platform {
+				continue
+			}
+		}
+		size := int64(0)
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != TwoDfsMediaType {
+				size += layer.Size
+			}
+		}
+		if size > maxSize {
+			maxSize = size
+		}
+	}
+	if maxSize < 0 {
+		return 0, fmt.Errorf("manifest not found for %s", platform)
+	}
+	return maxSize, nil
+}
+
+// budgetByPriority takes cells in priority order, together with the cells they require, until the next one does not fit the budget
+func budgetByPriority(priority []filesystem.Cell, sizes map[filesystem.Cell]int64, requires map[filesystem.Cell][]filesystem.Cell, budget int64) []filesystem.Cell {
+	selected := []filesystem.Cell{}
+	taken := make(map[filesystem.Cell]bool)
+	total := int64(0)
+	for _, cell := range priority {
+		if _, ok := sizes[cell]; !ok {
+			fmt.Printf("[WARNING] Cell %d/%d in selection priority has no allotment, skipping...\n", cell.Row, cell.Col)
+			continue
+		}
+		if taken[cell] {
+			continue
+		}
+
+		// the cell is taken together with its missing dependencies
+		unit := []filesystem.Cell{cell}
+		candidate := map[filesystem.Cell]bool{cell: true}
+		for c := range taken {
+			candidate[c] = true
+		}
+		for required := range missingDependencies(candidate, requires) {
+			unit = append(unit, required)
+		}
+		cost := int64(0)
+		for _, c := range unit {
+			cost += sizes[c]
+		}
+		if total+cost > budget {
+			break
+		}
+		total += cost
+		for _, c := range unit {
+			taken[c] = true
+			selected = append(selected, c)
+		}
+	}
+	return selected
+}
+
+// budgetByRectangle returns the largest rectangle anchored at (0,0) whose allotments fit the budget and do not require cells outside of it.
+// Ties are broken by the number of bytes used.
+func budgetByRectangle(sizes map[filesystem.Cell]int64, requires map[filesystem.Cell][]filesystem.Cell, budget int64) (partition, bool) {
+	maxRow, maxCol := -1, -1
+	for cell := range sizes {
+		maxRow = max(maxRow, cell.Row)
+		maxCol = max(maxCol, cell.Col)
+	}
+
+	best := partition{}
+	bestArea, bestSize := 0, int64(-1)
+	for x2 := 0; x2 <= maxRow; x2++ {
+		for y2 := 0; y2 <= maxCol; y2++ {
+			rectangle := partition{x1: 0, y1: 0, x2: x2, y2: y2}
+			cells := make(map[filesystem.Cell]bool)
+			total := int64(0)
+			for cell, size := range sizes {
+				if rectangle.contains(cell.Row, cell.Col) {
+					cells[cell] = true
+					total += size
+				}
+			}
+			if len(cells) == 0 || total > budget || len(missingDependencies(cells, requires)) > 0 {
+				continue
+			}
+			area := (x2 + 1) * (y2 + 1)
+			if area > bestArea || (area == bestArea && total > bestSize) {
+				best, bestArea, bestSize = rectangle, area, total
+			}
+		}
+	}
+	return best, bestArea > 0
+}
+
+// cellsToPartitions converts a set of cells into the canonical partition list: one partition per contiguous run of columns, row by row
+func cellsToPartitions(cells []filesystem.Cell) []partition {
+	sorted := append([]filesystem.Cell{}, cells...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Row != sorted[j].Row {
+			return sorted[i].Row < sorted[j].Row
+		}
+		return sorted[i].Col < sorted[j].Col
+	})
+	partitions := []partition{}
+	for _, cell := range sorted {
+		last := len(partitions) - 1
+		if last >= 0 && partitions[last].x1 == cell.Row && partitions[last].y2 == cell.Col-1 {
+			partitions[last].y2 = cell.Col
+			continue
+		}
+		if last >= 0 && partitions[last].x1 == cell.Row && partitions[last].y2 == cell.Col {
+			continue
+		}
+		partitions = append(partitions, partition{x1: cell.Row, y1: cell.Col, x2: cell.Row, y2: cell.Col})
+	}
+	return partitions
+}
+
+// formatPartitions returns the semantic tag suffix of the given partitions, e.g. --0.0.1.1--2.0.2.0
+func formatPartitions(partitions []partition) string {
+	result := ""
+	for _, p := range partitions {
+		result += fmt.Sprintf("%s%d%s%d%s%d%s%d", partitionInit, p.x1, partitionSplitChar, p.y1, partitionSplitChar, p.x2, partitionSplitChar, p.y2)
+	}
+	return result
+}
@@ -0,0 +1,465 @@
+package oci
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/compress"
+	"github.com/2DFS/2dfs-builder/filesystem"
+)
+
+const (
+	// TwoDfsDeltaMediaType is the media type of the binary delta blobs of the allotments
+	TwoDfsDeltaMediaType = "application/vnd.2dfs.allotment.delta.v1+gzip"
+	// DeltaFormatTar deltas rebuild the uncompressed layer, which is then compressed again
+	DeltaFormatTar = "tar"
+	// DeltaFormatGzip deltas rebuild the compressed blob, used when compressing the layer again is not reproducible
+	DeltaFormatGzip = "gzip"
+	// DeltaBundleFile lists the deltas and the omitted blobs of an archive exported with ExportOptions.Have
+	DeltaBundleFile = "2dfs-deltas.json"
+)
+
+// ExportOptions tunes the content of an exported archive
+type ExportOptions struct {
+	// Have is a local image the target device already has: its blobs are omitted and the allotments are exported as deltas when possible
+	Have string
+	// SignatureKey, if set, rejects images whose field is not signed by this key
+	SignatureKey crypto.PublicKey
+}
+
+// DeltaBundle describes how to complete an archive exported with ExportOptions.Have
+type DeltaBundle struct {
+	// Base is the image the deltas apply to
+	Base    string        `json:"base"`
+	Deltas  []BundleDelta `json:"deltas"`
+	Omitted []string      `json:"omitted"`
+}
+
+// BundleDelta is a delta blob of the archive that rebuilds the layer Target
+type BundleDelta struct {
+	Target string `json:"target"`
+	filesystem.AllotmentDelta
+}
+
+// loadDeltaBase returns the field of the local image used as base of the deltas
+func loadDeltaBase(ctx context.Context, reference string) (filesystem.Field, error) {
+	img, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load delta base %s: %w", reference, err)
+	}
+	err = img.loadField()
+	if err != nil {
+		return nil, err
+	}
+	if img.field == nil {
+		return nil, fmt.Errorf("delta base %s has no 2DFS field", reference)
+	}
+	return img.field, nil
+}
+
+// allotmentDelta returns the delta from the same cell of the delta base to the given allotment layer, nil if the cell is new, unchanged or the delta is not worth it.
+// Deltas are cached in the uncompressed-keys store by the allotment layer digest.
+func (c *containerImage) allotmentDelta(row int, col int, target string, diffID string) (*filesystem.AllotmentDelta, error) {
+	base := ""
+	for allotment := range c.deltaBase.IterateAllotments() {
+		// deltas from encrypted layers would compare ciphertexts
+		if allotment.Row == row && allotment.Col == col && allotment.Encryption == nil {
+			base = allotment.Digest
+		}
+	}
+	if base == "" || base == target {
+		return nil, nil
+	}
+	if _, err := c.blobCache.GetSize(base); err != nil {
+		log.Printf("[WARNING] Delta %d/%d base layer %s not found, skipping delta\n", row, col, base)
+		return nil, nil
+	}
+
+	// check if the delta is cached
+	for _, format := range []string{DeltaFormatTar, DeltaFormatGzip} {
+		if _, deltaSha, ok := c.cachedDerivedBlob(target, deltaDestination, base, format); ok {
+			log.Printf("Delta %d/%d %s [CACHED] \n", row, col, deltaSha)
+			return &filesystem.AllotmentDelta{From: base, Digest: deltaSha, Format: format}, nil
+		}
+	}
+
+	deltaPath, format, err := computeDelta(c.blobCache, base, target)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(deltaPath)
+	deltaInfo, err := os.Stat(deltaPath)
+	if err != nil {
+		return nil, err
+	}
+	targetSize, err := c.blobCache.GetSize(target)
+	if err != nil {
+		return nil, err
+	}
+	if deltaInfo.Size() >= targetSize {
+		log.Printf("Delta %d/%d [SKIPPED] %d bytes, not smaller than the layer \n", row, col, deltaInfo.Size())
+		return nil, nil
+	}
+	deltaSha, err := c.storeArchive(deltaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	c.cacheDerivedBlob(target, diffID, deltaSha, deltaDestination, base, format)
+	log.Printf("Delta %d/%d %s [CREATED] %d bytes instead of %d \n", row, col, deltaSha, deltaInfo.Size(), targetSize)
+	return &filesystem.AllotmentDelta{From: base, Digest: deltaSha, Format: format}, nil
+}
+
+// computeDelta writes the delta from the base blob to the target blob to a temporary file and returns its path and format.
+// Deltas apply to the uncompressed layers if compressing the target tar again gives back the same blob.
+func computeDelta(store cache.CacheStore, base string, target string) (string, string, error) {
+	targetTar, err := decompressBlob(store, target)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(targetTar)
+	recompressed, err := compress.TarToGz(targetTar)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(recompressed)
+	recompressedSha, err := fileDigest(recompressed)
+	if err != nil {
+		return "", "", err
+	}
+
+	format := DeltaFormatGzip
+	var targetReader io.Reader
+	if recompressedSha == target {
+		format = DeltaFormatTar
+		targetFile, err := os.Open(targetTar)
+		if err != nil {
+			return "", "", err
+		}
+		defer targetFile.Close()
+		targetReader = targetFile
+	} else {
+		targetBlob, err := store.Get(target)
+		if err != nil {
+			return "", "", err
+		}
+		defer targetBlob.Close()
+		targetReader = targetBlob
+	}
+	baseBlob, baseSize, err := openDeltaBase(store, base, format)
+	if err != nil {
+		return "", "", err
+	}
+	defer baseBlob.Close()
+
+	deltaFile, err := os.CreateTemp("", "delta-*.gz")
+	if err != nil {
+		return "", "", err
+	}
+	defer deltaFile.Close()
+	err = compress.Delta(baseBlob, baseSize, targetReader, deltaFile)
+	if err != nil {
+		os.Remove(deltaFile.Name())
+		return "", "", err
+	}
+	return deltaFile.Name(), format, nil
+}
+
+// openDeltaBase opens the base of a delta for random access: the uncompressed layer for tar deltas, the blob for gzip deltas
+func openDeltaBase(store cache.CacheStore, blobDigest string, format string) (blobReaderAt, int64, error) {
+	switch format {
+	case DeltaFormatTar:
+		baseTar, err := decompressBlob(store, blobDigest)
+		if err != nil {
+			return nil, 0, err
+		}
+		baseFile, err := os.Open(baseTar)
+		// the open file stays readable after the removal
+		os.Remove(baseTar)
+		if err != nil {
+			return nil, 0, err
+		}
+		info, err := baseFile.Stat()
+		if err != nil {
+			baseFile.Close()
+			return nil, 0, err
+		}
+		return baseFile, info.Size(), nil
+	case DeltaFormatGzip:
+		return openStoreBlobAt(store, blobDigest)
+	default:
+		return nil, 0, fmt.Errorf("unsupported delta format %s", format)
+	}
+}
+
+// decompressBlob writes the uncompressed content of a gzip blob to a temporary file and returns its path
+func decompressBlob(store cache.CacheStore, blobDigest string) (string, error) {
+	blob, err := store.Get(blobDigest)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	gzipReader, err := gzip.NewReader(blob)
+	if err != nil {
+		return "", err
+	}
+	defer gzipReader.Close()
+	tarFile, err := os.CreateTemp("", "layer-*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer tarFile.Close()
+	if _, err := io.CopyBuffer(tarFile, gzipReader, make([]byte, 1024*1024)); err != nil {
+		os.Remove(tarFile.Name())
+		return "", err
+	}
+	return tarFile.Name(), nil
+}
+
+// fileDigest returns the sha256 of a file
+func fileDigest(filePath string) (string, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(hash, f, make([]byte, 1024*1024)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// loadHave collects the blobs of the image the target device already has and the deltas of the allotments of this image
+func (c *containerImage) loadHave(ctx context.Context, reference string) error {
+	have, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return fmt.Errorf("unable to load %s: %w", reference, err)
+	}
+	err = have.loadField()
+	if err != nil {
+		return err
+	}
+
+	c.haveBlobs = make(map[string]bool)
+	for i, manifest := range have.manifests {
+		// manifests and configs of semantic tags are generated on export
+		if len(have.partitions) == 0 {
+			c.haveBlobs[have.index.Manifests[i].Digest.Encoded()] = true
+			c.haveBlobs[manifest.Config.Digest.Encoded()] = true
+		}
+		for _, layer := range manifest.Layers {
+			if layer.MediaType == TwoDfsMediaType && len(have.partitions) > 0 {
+				continue
+			}
+			c.haveBlobs[layer.Digest.Encoded()] = true
+		}
+	}
+	if have.field != nil {
+		for allotment := range have.field.IterateAllotments() {
+			if allotment.Digest == "" || !have.selects(allotment, nil) {
+				continue
+			}
+			c.haveBlobs[allotment.Digest] = true
+			if allotment.TOC != "" {
+				c.haveBlobs[allotment.TOC] = true
+			}
+		}
+	}
+
+	c.deltas = make(map[string]filesystem.AllotmentDelta)
+	err = c.loadField()
+	if err != nil {
+		return err
+	}
+	if c.field != nil {
+		for allotment := range c.field.IterateAllotments() {
+			if allotment.Delta != nil {
+				c.deltas[allotment.Digest] = *allotment.Delta
+			}
+		}
+	}
+	return nil
+}
+
+// exportLayerBlob copies a blob to the archive folder. If the target device has a base image, blobs it already has are omitted
+// and allotments with a delta from one of its blobs are replaced by the delta.
+func (image *containerImage) exportLayerBlob(folder string, blobDigest string, bundle *DeltaBundle) error {
+	if image.haveBlobs == nil {
+		return image.exportBlobByDigest(filepath.Join(folder, blobDigest), blobDigest)
+	}
+	if image.haveBlobs[blobDigest] {
+		if !slices.Contains(bundle.Omitted, blobDigest) {
+			bundle.Omitted = append(bundle.Omitted, blobDigest)
+		}
+		return nil
+	}
+	if delta, ok := image.deltas[blobDigest]; ok && image.haveBlobs[delta.From] {
+		for _, d := range bundle.Deltas {
+			if d.Target == blobDigest {
+				return nil
+			}
+		}
+		err := image.exportBlobByDigest(filepath.Join(folder, delta.Digest), delta.Digest)
+		if err != nil {
+			return err
+		}
+		bundle.Deltas = append(bundle.Deltas, BundleDelta{Target: blobDigest, AllotmentDelta: delta})
+		fmt.Printf("Delta %s -> %s [EXPORTED]\n", delta.From, blobDigest)
+		return nil
+	}
+	return image.exportBlobByDigest(filepath.Join(folder, blobDigest), blobDigest)
+}
+
+/*
+ApplyDeltaBundle completes an archive exported with ExportOptions.Have and writes the resulting OCI archive to outPath.
+Omitted blobs and delta bases are read from the local blob store, every rebuilt layer is verified against its digest.
+*/
+func ApplyDeltaBundle(ctx context.Context, bundlePath string, outPath string) error {
+	blobStoreLocation, ok := ctx.Value(BlobStoreContextKey).(string)
+	if !ok {
+		return fmt.Errorf("blob store location not found in context")
+	}
+	store, err := cache.NewCacheStore(blobStoreLocation)
+	if err != nil {
+		return err
+	}
+
+	tmpFolder, err := os.MkdirTemp("", "2dfs-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpFolder)
+	err = compress.DecompressFolder(bundlePath, tmpFolder)
+	if err != nil {
+		return err
+	}
+
+	bundleBytes, err := os.ReadFile(filepath.Join(tmpFolder, DeltaBundleFile))
+	if err != nil {
+		return fmt.Errorf("%s is not a delta bundle: %w", bundlePath, err)
+	}
+	bundle := DeltaBundle{}
+	err = json.Unmarshal(bundleBytes, &bundle)
+	if err != nil {
+		return err
+	}
+	shaFolder := filepath.Join(tmpFolder, "blobs", "sha256")
+
+	for _, omitted := range bundle.Omitted {
+		err := copyVerifiedBlob(store, omitted, filepath.Join(shaFolder, omitted))
+		if err != nil {
+			return fmt.Errorf("blob %s of %s not found locally: %w", omitted, bundle.Base, err)
+		}
+	}
+
+	for _, delta := range bundle.Deltas {
+		err := applyBundleDelta(store, delta, shaFolder)
+		if err != nil {
+			return fmt.Errorf("unable to rebuild %s: %w", delta.Target, err)
+		}
+		fmt.Printf("Delta %s -> %s [APPLIED]\n", delta.From, delta.Target)
+	}
+
+	err = os.Remove(filepath.Join(tmpFolder, DeltaBundleFile))
+	if err != nil {
+		return err
+	}
+	archive, err := compress.CompressFolder(tmpFolder)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(archive)
+	archiveReader, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	return copyFile(archiveReader, outPath)
+}
+
+// applyBundleDelta rebuilds the target of a delta in shaFolder and removes the delta blob
+func applyBundleDelta(store cache.CacheStore, delta BundleDelta, shaFolder string) error {
+	deltaPath := filepath.Join(shaFolder, delta.Digest)
+	deltaFile, err := os.Open(deltaPath)
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+
+	baseBlob, _, err := openDeltaBase(store, delta.From, delta.Format)
+	if err != nil {
+		return err
+	}
+	defer baseBlob.Close()
+
+	rebuilt, err := os.CreateTemp("", "rebuilt-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(rebuilt.Name())
+	err = compress.ApplyDelta(baseBlob, deltaFile, rebuilt)
+	rebuilt.Close()
+	if err != nil {
+		return err
+	}
+
+	rebuiltBlob := rebuilt.Name()
+	if delta.Format == DeltaFormatTar {
+		rebuiltBlob, err = compress.TarToGz(rebuilt.Name())
+		if err != nil {
+			return err
+		}
+		defer os.Remove(rebuiltBlob)
+	}
+	rebuiltSha, err := fileDigest(rebuiltBlob)
+	if err != nil {
+		return err
+	}
+	if rebuiltSha != delta.Target {
+		return fmt.Errorf("digest mismatch, rebuilt %s", rebuiltSha)
+	}
+
+	rebuiltReader, err := os.Open(rebuiltBlob)
+	if err != nil {
+		return err
+	}
+	err = copyFile(rebuiltReader, filepath.Join(shaFolder, delta.Target))
+	rebuiltReader.Close()
+	if err != nil {
+		return err
+	}
+	deltaFile.Close()
+	return os.Remove(deltaPath)
+}
+
+// copyVerifiedBlob copies a blob of the store to dst checking its digest
+func copyVerifiedBlob(store cache.CacheStore, blobDigest string, dst string) error {
+	blob, err := store.Get(blobDigest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	dstFile, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(io.MultiWriter(dstFile, hash), blob, make([]byte, 1024*1024)); err != nil {
+		return err
+	}
+	if actual := fmt.Sprintf("%x", hash.Sum(nil)); actual != blobDigest {
+		return fmt.Errorf("digest mismatch, found %s", actual)
+	}
+	return nil
+}
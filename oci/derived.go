@@ -0,0 +1,79 @@
+package oci
+
+import (
+	"log"
+	"strings"
+)
+
+// Pseudo destinations of the uncompressed-keys store. Blobs derived from another blob are cached by the digest of the
+// blob they derive from (or by the identity of a partition) under one of these, followed by the derivation parameters.
+const (
+	// squashed partition layers, cached by the partition identity
+	squashDestination = "2dfs.squash"
+	// table of contents of an allotment layer
+	tocDestination = "2dfs.toc"
+	// SBOM of an allotment layer
+	sbomDestination = "2dfs.sbom"
+	// binary delta of an allotment layer, followed by the base layer digest and the delta format
+	deltaDestination = "2dfs.delta"
+	// appended to the destinations of an allotment whose layer is eStargz, so that it is cached apart from the gzip one
+	estargzDestination = "2dfs.estargz"
+	// encrypted allotment layer, followed by the digest of the recipient set, its key holds the encryption annotations
+	encryptedDestination = "2dfs.encrypted"
+)
+
+// cachedDerivedBlob returns the DiffID and digest of the blob derived from source as described by derivation,
+// if it was cached and is still in the blob store
+func (c *containerImage) cachedDerivedBlob(source string, derivation ...string) (string, string, bool) {
+	key, ok := c.cachedDerivedKey(source, derivation...)
+	return key.DiffID, key.CompressedSha, ok
+}
+
+// cachedDerivedKey returns the cache key of the blob derived from source as described by derivation,
+// if it was cached and the blob is still in the blob store
+func (c *containerImage) cachedDerivedKey(source string, derivation ...string) (FileCacheKey, bool) {
+	key := func() FileCacheKey {
+		c.cacheLock.Lock()
+		defer c.cacheLock.Unlock()
+		keyDigestReader, err := c.keyDigestCache.Get(source)
+		if err != nil {
+			return FileCacheKey{}
+		}
+		defer keyDigestReader.Close()
+		cacheKeys, err := ParseCacheKey(keyDigestReader)
+		if err != nil {
+			return FileCacheKey{}
+		}
+		destination := strings.Join(derivation, ",")
+		for _, key := range cacheKeys.Keys {
+			if key.Destination == destination {
+				return key
+			}
+		}
+		return FileCacheKey{}
+	}()
+	if key.CompressedSha == "" || !c.blobCache.Check(key.CompressedSha) {
+		return FileCacheKey{}, false
+	}
+	return key, true
+}
+
+// cacheDerivedBlob records the blob derived from source as described by derivation. Failures are logged,
+// they only cost deriving the blob again.
+func (c *containerImage) cacheDerivedBlob(source string, diffID string, derivedSha string, derivation ...string) {
+	c.cacheDerivedKey(source, FileCacheKey{
+		DiffID:        diffID,
+		CompressedSha: derivedSha,
+	}, derivation...)
+}
+
+// cacheDerivedKey records the cache key of the blob derived from source as described by derivation,
+// failures are logged
+func (c *containerImage) cacheDerivedKey(source string, key FileCacheKey, derivation ...string) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	err := c.upsertCacheKey(source, key, derivation)
+	if err != nil {
+		log.Printf("unable to cache %s of %s: %v", strings.TrimPrefix(derivation[0], "2dfs."), source, err)
+	}
+}
@@ -0,0 +1,352 @@
+package oci
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/filesystem"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// MediaTypeImageLayerGzipEncrypted is the ocicrypt media type of encrypted gzip layers
+	MediaTypeImageLayerGzipEncrypted = v1.MediaTypeImageLayerGzip + "+encrypted"
+	// EncryptionKeysAnnotation holds the layer key wrapped for every recipient, comma separated
+	EncryptionKeysAnnotation = "org.opencontainers.image.enc.keys.2dfs-x25519"
+	// EncryptionPubOptsAnnotation holds the public cipher options of the layer
+	EncryptionPubOptsAnnotation = "org.opencontainers.image.enc.pubopts"
+
+	// layerCipher is the ocicrypt block cipher: AES-256 in CTR mode, authenticated with HMAC-SHA256 of the ciphertext
+	layerCipher = "AES_256_CTR_HMAC_SHA256"
+	// wrapLabel separates the key wrapping hash from other uses of the shared secret
+	wrapLabel = "2dfs-x25519"
+)
+
+// privateLayerOptions are the secret cipher options of a layer, wrapped for each recipient
+type privateLayerOptions struct {
+	Cipher        string            `json:"cipher"`
+	SymmetricKey  []byte            `json:"symkey"`
+	Digest        string            `json:"digest"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// publicLayerOptions are the cipher options of a layer stored in clear
+type publicLayerOptions struct {
+	Cipher        string            `json:"cipher"`
+	Hmac          []byte            `json:"hmac"`
+	CipherOptions map[string][]byte `json:"cipheroptions"`
+}
+
+// ReadPublicKey reads a PEM encoded X25519 public key, e.g. generated with openssl pkey -pubout
+func ReadPublicKey(keyPath string) (*ecdh.PublicKey, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	publicKey, ok := key.(*ecdh.PublicKey)
+	if !ok || publicKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s is not an X25519 public key", keyPath)
+	}
+	return publicKey, nil
+}
+
+// ReadPrivateKey reads a PEM encoded PKCS8 X25519 private key, e.g. generated with openssl genpkey -algorithm X25519
+func ReadPrivateKey(keyPath string) (*ecdh.PrivateKey, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	privateKey, ok := key.(*ecdh.PrivateKey)
+	if !ok || privateKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("%s is not an X25519 private key", keyPath)
+	}
+	return privateKey, nil
+}
+
+func readPEM(keyPath string) (*pem.Block, error) {
+	keyBytes, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", keyPath)
+	}
+	return block, nil
+}
+
+// encryptLayer encrypts a cached layer with a new key wrapped for the recipients and returns the digest of the encrypted blob and its annotations.
+// The encrypted layer is cached, rebuilding with the same layer and recipients gives the same blob.
+func (c *containerImage) encryptLayer(plainDigest string, recipients []*ecdh.PublicKey) (string, map[string]string, error) {
+	recipientSet := recipientSetDigest(recipients)
+	if key, ok := c.cachedDerivedKey(plainDigest, encryptedDestination, recipientSet); ok {
+		return key.CompressedSha, key.Annotations, nil
+	}
+	plain, err := c.blobCache.Get(plainDigest)
+	if err != nil {
+		return "", nil, err
+	}
+	defer plain.Close()
+	encrypted, err := os.CreateTemp("", "encrypted-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(encrypted.Name())
+	privOpts, pubOpts, err := encryptStream(plain, encrypted)
+	encrypted.Close()
+	if err != nil {
+		return "", nil, err
+	}
+	privOpts.Digest = "sha256:" + plainDigest
+
+	encryptedSha, err := c.storeArchive(encrypted.Name())
+	if err != nil {
+		return "", nil, err
+	}
+	annotations, err := encryptionAnnotations(privOpts, pubOpts, recipients)
+	if err != nil {
+		return "", nil, err
+	}
+	c.cacheDerivedKey(plainDigest, FileCacheKey{CompressedSha: encryptedSha, Annotations: annotations}, encryptedDestination, recipientSet)
+	return encryptedSha, annotations, nil
+}
+
+// recipientSetDigest identifies a set of recipients regardless of their order
+func recipientSetDigest(recipients []*ecdh.PublicKey) string {
+	keys := []string{}
+	for _, recipient := range recipients {
+		keys = append(keys, fmt.Sprintf("%x", recipient.Bytes()))
+	}
+	sort.Strings(keys)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(keys, ","))))
+}
+
+// encryptStream encrypts plain to out with a new random key and returns the cipher options
+func encryptStream(plain io.Reader, out io.Writer) (privateLayerOptions, publicLayerOptions, error) {
+	symmetricKey := make([]byte, 32)
+	nonce := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(symmetricKey); err != nil {
+		return privateLayerOptions{}, publicLayerOptions{}, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return privateLayerOptions{}, publicLayerOptions{}, err
+	}
+	block, err := aes.NewCipher(symmetricKey)
+	if err != nil {
+		return privateLayerOptions{}, publicLayerOptions{}, err
+	}
+	mac := hmac.New(sha256.New, symmetricKey)
+	writer := cipher.StreamWriter{S: cipher.NewCTR(block, nonce), W: io.MultiWriter(out, mac)}
+	if _, err := io.CopyBuffer(writer, plain, make([]byte, 1024*1024)); err != nil {
+		return privateLayerOptions{}, publicLayerOptions{}, err
+	}
+	return privateLayerOptions{
+		Cipher:        layerCipher,
+		SymmetricKey:  symmetricKey,
+		CipherOptions: map[string][]byte{"nonce": nonce},
+	}, publicLayerOptions{
+		Cipher:        layerCipher,
+		Hmac:          mac.Sum(nil),
+		CipherOptions: map[string][]byte{},
+	}, nil
+}
+
+// decryptStream checks the HMAC of the ciphertext, then writes the decrypted content to out
+func decryptStream(encrypted io.ReaderAt, size int64, privOpts privateLayerOptions, pubOpts publicLayerOptions, out io.Writer) error {
+	if privOpts.Cipher != layerCipher || pubOpts.Cipher != layerCipher {
+		return fmt.Errorf("unsupported cipher %s", privOpts.Cipher)
+	}
+	mac := hmac.New(sha256.New, privOpts.SymmetricKey)
+	if _, err := io.CopyBuffer(mac, io.NewSectionReader(encrypted, 0, size), make([]byte, 1024*1024)); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac.Sum(nil), pubOpts.Hmac) {
+		return fmt.Errorf("HMAC mismatch, the layer was tampered with")
+	}
+	block, err := aes.NewCipher(privOpts.SymmetricKey)
+	if err != nil {
+		return err
+	}
+	reader := cipher.StreamReader{S: cipher.NewCTR(block, privOpts.CipherOptions["nonce"]), R: io.NewSectionReader(encrypted, 0, size)}
+	_, err = io.CopyBuffer(out, reader, make([]byte, 1024*1024))
+	return err
+}
+
+// encryptionAnnotations wraps the private options for every recipient
+func encryptionAnnotations(privOpts privateLayerOptions, pubOpts publicLayerOptions, recipients []*ecdh.PublicKey) (map[string]string, error) {
+	privBytes, err := json.Marshal(privOpts)
+	if err != nil {
+		return nil, err
+	}
+	pubBytes, err := json.Marshal(pubOpts)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKeys := []string{}
+	for _, recipient := range recipients {
+		wrapped, err := wrapKey(privBytes, recipient)
+		if err != nil {
+			return nil, err
+		}
+		wrappedKeys = append(wrappedKeys, base64.StdEncoding.EncodeToString(wrapped))
+	}
+	return map[string]string{
+		EncryptionKeysAnnotation:    strings.Join(wrappedKeys, ","),
+		EncryptionPubOptsAnnotation: base64.StdEncoding.EncodeToString(pubBytes),
+	}, nil
+}
+
+// wrapKey encrypts the private options for a recipient: an ephemeral X25519 key agreement derives a single-use AES-GCM key.
+// The result is the ephemeral public key followed by the sealed options.
+func wrapKey(privOpts []byte, recipient *ecdh.PublicKey) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := wrapCipher(shared, ephemeral.PublicKey().Bytes(), recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nil, make([]byte, aead.NonceSize()), privOpts, nil)
+	return append(ephemeral.PublicKey().Bytes(), sealed...), nil
+}
+
+// unwrapKey returns the private options if one of the wrapped keys was wrapped for the given key
+func unwrapKey(wrappedKeys string, key *ecdh.PrivateKey) (privateLayerOptions, bool) {
+	privOpts := privateLayerOptions{}
+	for _, encoded := range strings.Split(wrappedKeys, ",") {
+		wrapped, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(wrapped) < 32 {
+			continue
+		}
+		ephemeral, err := ecdh.X25519().NewPublicKey(wrapped[:32])
+		if err != nil {
+			continue
+		}
+		shared, err := key.ECDH(ephemeral)
+		if err != nil {
+			continue
+		}
+		aead, err := wrapCipher(shared, wrapped[:32], key.PublicKey().Bytes())
+		if err != nil {
+			continue
+		}
+		privBytes, err := aead.Open(nil, make([]byte, aead.NonceSize()), wrapped[32:], nil)
+		if err != nil {
+			continue
+		}
+		if json.Unmarshal(privBytes, &privOpts) == nil {
+			return privOpts, true
+		}
+	}
+	return privOpts, false
+}
+
+func wrapCipher(shared []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte(wrapLabel))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// plainAllotment returns the allotment pointing to its decrypted layer if it is encrypted and one of the decryption keys of the partition options fits
+func (c *containerImage) plainAllotment(a filesystem.Allotment) (filesystem.Allotment, error) {
+	if a.Encryption == nil || len(c.partitionOpts.DecryptKeys) == 0 {
+		return a, nil
+	}
+	plainDigest, err := c.decryptAllotment(a, c.partitionOpts.DecryptKeys)
+	if err != nil || plainDigest == "" {
+		return a, err
+	}
+	a.Digest = plainDigest
+	a.Encryption = nil
+	return a, nil
+}
+
+/*
+decryptAllotment decrypts an encrypted allotment if one of the keys unwraps its layer key.
+It returns the digest of the cached plaintext layer, or an empty string if no key fits.
+*/
+func (c *containerImage) decryptAllotment(a filesystem.Allotment, keys []*ecdh.PrivateKey) (string, error) {
+	var privOpts privateLayerOptions
+	found := false
+	for _, key := range keys {
+		if privOpts, found = unwrapKey(a.Encryption.Annotations[EncryptionKeysAnnotation], key); found {
+			break
+		}
+	}
+	if !found {
+		return "", nil
+	}
+	plainDigest := strings.TrimPrefix(privOpts.Digest, "sha256:")
+	if plainDigest != "" && c.blobCache.Check(plainDigest) {
+		log.Printf("Allotment %d/%d %s [DECRYPTED] [CACHED]\n", a.Row, a.Col, plainDigest)
+		return plainDigest, nil
+	}
+
+	pubOpts := publicLayerOptions{}
+	pubBytes, err := base64.StdEncoding.DecodeString(a.Encryption.Annotations[EncryptionPubOptsAnnotation])
+	if err != nil {
+		return "", err
+	}
+	if err := json.Unmarshal(pubBytes, &pubOpts); err != nil {
+		return "", err
+	}
+	encrypted, size, err := c.openBlobAt(a.Digest)
+	if err != nil {
+		return "", err
+	}
+	defer encrypted.Close()
+	decrypted, err := os.CreateTemp("", "decrypted-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(decrypted.Name())
+	err = decryptStream(encrypted, size, privOpts, pubOpts, decrypted)
+	decrypted.Close()
+	if err != nil {
+		return "", fmt.Errorf("unable to decrypt allotment %d/%d: %w", a.Row, a.Col, err)
+	}
+	decryptedSha, err := c.storeArchive(decrypted.Name())
+	if err != nil {
+		return "", err
+	}
+	if plainDigest != "" && decryptedSha != plainDigest {
+		c.blobCache.Del(decryptedSha)
+		return "", fmt.Errorf("allotment %d/%d decrypted to %s, expected %s", a.Row, a.Col, decryptedSha, plainDigest)
+	}
+	log.Printf("Allotment %d/%d %s [DECRYPTED]\n", a.Row, a.Col, decryptedSha)
+	return decryptedSha, nil
+}
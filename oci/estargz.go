@@ -0,0 +1,213 @@
+package oci
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/compress"
+)
+
+// storeEStargzLayer converts the given tar to eStargz, adds it to the blob cache and returns its DiffID and compressed digest
+func (c *containerImage) storeEStargzLayer(tarPath string) (string, string, error) {
+	archiveName, _, err := compress.TarToEStargz(tarPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(archiveName)
+
+	// the eStargz tar stream differs from the source tar: landmark and TOC entries are added
+	archive, err := os.Open(archiveName)
+	if err != nil {
+		return "", "", err
+	}
+	diffID, err := compress.UncompressedDigest(archive)
+	archive.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	compressedSha, err := c.storeArchive(archiveName)
+	if err != nil {
+		return "", "", err
+	}
+	return diffID, compressedSha, nil
+}
+
+// estargzTOCDigest returns the digest of the TOC of a cached eStargz blob
+func (c *containerImage) estargzTOCDigest(blobDigest string) (string, error) {
+	blob, size, err := c.openBlobAt(blobDigest)
+	if err != nil {
+		return "", err
+	}
+	defer blob.Close()
+	return compress.EStargzTOCDigest(blob, size)
+}
+
+// blobReaderAt is a cached blob supporting random access
+type blobReaderAt interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// openBlobAt opens a cached blob for random access
+func (c *containerImage) openBlobAt(blobDigest string) (blobReaderAt, int64, error) {
+	return openStoreBlobAt(c.blobCache, blobDigest)
+}
+
+// openStoreBlobAt opens a blob of the store for random access. Blobs streamed without random access, e.g. from a
+// remote cache, are copied to a temporary file first.
+func openStoreBlobAt(store cache.CacheStore, blobDigest string) (blobReaderAt, int64, error) {
+	size, err := store.GetSize(blobDigest)
+	if err != nil {
+		return nil, 0, err
+	}
+	reader, err := store.Get(blobDigest)
+	if err != nil {
+		return nil, 0, err
+	}
+	if blob, ok := reader.(blobReaderAt); ok {
+		return blob, size, nil
+	}
+	defer reader.Close()
+	blobFile, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	// the open file stays readable after the removal
+	os.Remove(blobFile.Name())
+	_, err = io.CopyBuffer(blobFile, reader, make([]byte, 1024*1024))
+	if err != nil {
+		blobFile.Close()
+		return nil, 0, err
+	}
+	return blobFile, size, nil
+}
+
+// VerifyOptions selects the optional checks of VerifyImage
+type VerifyOptions struct {
+	// Key, if set, requires the field to be signed by this key
+	Key crypto.PublicKey
+	// Provenance requires a provenance statement describing the image manifests
+	Provenance bool
+}
+
+/*
+VerifyImage checks the integrity of the layers of a local image: digests and DiffIDs of the allotments and,
+for eStargz layers, the TOC against the layer content.
+If reference is a semantic tag only the allotments of the partition are verified.
+*/
+func VerifyImage(ctx context.Context, reference string, opts VerifyOptions) error {
+	img, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return err
+	}
+	if opts.Key != nil {
+		err = img.verifyFieldSignature(opts.Key)
+		if err != nil {
+			fmt.Printf("Field signature [FAILED]: %v\n", err)
+			return err
+		}
+		fmt.Printf("Field signature [VERIFIED]\n")
+	}
+	if opts.Provenance {
+		err = img.verifyProvenance()
+		if err != nil {
+			fmt.Printf("Provenance [FAILED]: %v\n", err)
+			return err
+		}
+		fmt.Printf("Provenance %s [VERIFIED]\n", strings.TrimPrefix(img.index.Annotations[ProvenanceAnnotation], "sha256:"))
+	}
+	err = img.loadField()
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	verify := func(name string, blobDigest string, diffID string, estargzTOC string) {
+		err := img.verifyLayer(blobDigest, diffID, estargzTOC)
+		if err != nil {
+			fmt.Printf("%s %s [FAILED]: %v\n", name, blobDigest, err)
+			failures++
+			return
+		}
+		if estargzTOC != "" {
+			fmt.Printf("%s %s [VERIFIED] eStargz TOC %s\n", name, blobDigest, estargzTOC)
+		} else {
+			fmt.Printf("%s %s [VERIFIED]\n", name, blobDigest)
+		}
+	}
+
+	// layers of partitioned images
+	for i, manifest := range img.manifests {
+		for j, layer := range manifest.Layers {
+			if layer.MediaType == TwoDfsMediaType {
+				continue
+			}
+			estargzTOC := layer.Annotations[compress.EStargzTOCDigestAnnotation]
+			if estargzTOC == "" {
+				continue
+			}
+			diffID := ""
+			if j < len(img.configs[i].RootFS.DiffIDs) {
+				diffID = img.configs[i].RootFS.DiffIDs[j].Encoded()
+			}
+			verify("Layer", layer.Digest.Encoded(), diffID, estargzTOC)
+		}
+	}
+
+	// allotments of the field
+	if img.field != nil {
+		for allotment := range img.field.IterateAllotments() {
+			if allotment.Digest == "" || !img.selects(allotment, nil) {
+				continue
+			}
+			// the DiffID of encrypted allotments is the one of the plaintext layer
+			if allotment.Encryption != nil {
+				verify(fmt.Sprintf("Allotment %d/%d (encrypted)", allotment.Row, allotment.Col), allotment.Digest, "", "")
+				continue
+			}
+			verify(fmt.Sprintf("Allotment %d/%d", allotment.Row, allotment.Col), allotment.Digest, allotment.DiffID, allotment.EStargzTOC)
+		}
+	}
+
+	if failures > 0 {
+		return fmt.Errorf("%d layers failed verification", failures)
+	}
+	return nil
+}
+
+// verifyLayer checks digest, DiffID (if not empty) and eStargz TOC (if not empty) of a cached layer
+func (c *containerImage) verifyLayer(blobDigest string, diffID string, estargzTOC string) error {
+	blob, size, err := c.openBlobAt(blobDigest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	hash := sha256.New()
+	if _, err := io.CopyBuffer(hash, io.NewSectionReader(blob, 0, size), make([]byte, 1024*1024)); err != nil {
+		return err
+	}
+	if actualDigest := fmt.Sprintf("%x", hash.Sum(nil)); actualDigest != blobDigest {
+		return fmt.Errorf("digest mismatch, found %s", actualDigest)
+	}
+	if diffID != "" {
+		actualDiffID, err := compress.UncompressedDigest(io.NewSectionReader(blob, 0, size))
+		if err != nil {
+			return err
+		}
+		if actualDiffID != diffID {
+			return fmt.Errorf("DiffID mismatch: expected %s, found %s", diffID, actualDiffID)
+		}
+	}
+	if estargzTOC != "" {
+		return compress.VerifyEStargz(blob, size, estargzTOC)
+	}
+	return nil
+}
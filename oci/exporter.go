@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/2DFS/2dfs-builder/compress"
@@ -53,13 +54,23 @@ func (image *containerImage) ExportAsTar(path string) error {
 	shaFolder := filepath.Join(tmpFolder, "blobs", "sha256")
 	os.MkdirAll(shaFolder, os.ModePerm)
 
+	// blobs the target already has are omitted and allotments replaced by deltas
+	bundle := &DeltaBundle{Base: image.exportOpts.Have, Deltas: []BundleDelta{}, Omitted: []string{}}
+
+	// copy the provenance statement of the build
+	if provenance := image.index.Annotations[ProvenanceAnnotation]; provenance != "" {
+		err = image.exportLayerBlob(shaFolder, strings.TrimPrefix(provenance, "sha256:"), bundle)
+		if err != nil {
+			return err
+		}
+	}
+
 	// copy manifest, config and layers
 	tdfslayer := ""
 	for i, manifest := range image.index.Manifests {
 		// copy manifest
 		manifestDigest := manifest.Digest.Encoded()
-		manifestPath := filepath.Join(shaFolder, manifestDigest)
-		err = image.exportBlobByDigest(manifestPath, manifestDigest)
+		err = image.exportLayerBlob(shaFolder, manifestDigest, bundle)
 		if err != nil {
 			return err
 		}
@@ -67,24 +78,36 @@ func (image *containerImage) ExportAsTar(path string) error {
 
 		//copy config
 		configDigest := image.manifests[i].Config.Digest.Encoded()
-		configPath := filepath.Join(tmpFolder, "blobs", "sha256", configDigest)
-		err = image.exportBlobByDigest(configPath, configDigest)
+		err = image.exportLayerBlob(shaFolder, configDigest, bundle)
 		if err != nil {
 			return err
 		}
 		s.Suffix = fmt.Sprintf("%s [EXPORTED]\n", configDigest)
 
+		//copy the SBOM of the manifest layers
+		if sbom := image.manifests[i].Annotations[SBOMAnnotation]; sbom != "" {
+			err = image.exportLayerBlob(shaFolder, strings.TrimPrefix(sbom, "sha256:"), bundle)
+			if err != nil {
+				return err
+			}
+		}
+
 		//copy layers
 		for _, layer := range image.manifests[i].Layers {
 			layerDigest := layer.Digest.Encoded()
-			layerPath := filepath.Join(tmpFolder, "blobs", "sha256", layerDigest)
-			err = image.exportBlobByDigest(layerPath, layerDigest)
+			err = image.exportLayerBlob(shaFolder, layerDigest, bundle)
 			if err != nil {
 				return err
 			}
 			s.Suffix = fmt.Sprintf("%s [EXPORTED]\n", layerDigest)
 			if layer.MediaType == TwoDfsMediaType {
 				tdfslayer = layerDigest
+				if signature := layer.Annotations[FieldSignatureAnnotation]; signature != "" {
+					err = image.exportLayerBlob(shaFolder, strings.TrimPrefix(signature, "sha256:"), bundle)
+					if err != nil {
+						return err
+					}
+				}
 			}
 		}
 
@@ -113,16 +136,38 @@ func (image *containerImage) ExportAsTar(path string) error {
 	//export 2dfs if present and no partitioning required
 	if image.field != nil {
 		for allotment := range image.field.IterateAllotments() {
-			allotmentDigest := allotment.Digest
-			allotmentPath := filepath.Join(tmpFolder, "blobs", "sha256", allotmentDigest)
-			err = image.exportBlobByDigest(allotmentPath, allotmentDigest)
+			err = image.exportLayerBlob(shaFolder, allotment.Digest, bundle)
 			if err != nil {
 				return err
 			}
+			if allotment.TOC != "" {
+				err = image.exportLayerBlob(shaFolder, allotment.TOC, bundle)
+				if err != nil {
+					return err
+				}
+			}
+			if allotment.SBOM != "" {
+				err = image.exportLayerBlob(shaFolder, allotment.SBOM, bundle)
+				if err != nil {
+					return err
+				}
+			}
 			s.Suffix = fmt.Sprintf("Field %d/%d [EXPORTED]\n", allotment.Row, allotment.Col)
 		}
 	}
 
+	if image.haveBlobs != nil {
+		bundleBytes, err := json.Marshal(bundle)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(filepath.Join(tmpFolder, DeltaBundleFile), bundleBytes, 0644)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d deltas, %d blobs omitted\n", len(bundle.Deltas), len(bundle.Omitted))
+	}
+
 	//add oci layout version
 	ociLayout := []byte(`{"imageLayoutVersion": "1.0.0"}`)
 	ociLayoutPath := filepath.Join(tmpFolder, "oci-layout")
@@ -239,6 +284,17 @@ func (e *containerImage) uploadBlobs(link OciImageLink) error {
 
 			if layerMediaType == TwoDfsMediaType {
 				tdfsFilesystemDigest = layerDigest
+				if signature := layer.Annotations[FieldSignatureAnnotation]; signature != "" {
+					signatureDigest := strings.TrimPrefix(signature, "sha256:")
+					signatureSize, err := e.blobCache.GetSize(signatureDigest)
+					if err != nil {
+						return err
+					}
+					err = e.postByBlobDigest(link, TwoDfsSignatureMediaType, signatureDigest, int(signatureSize))
+					if err != nil {
+						return err
+					}
+				}
 			}
 
 		}
@@ -246,6 +302,18 @@ func (e *containerImage) uploadBlobs(link OciImageLink) error {
 
 	// Upload manifests configs
 	for _, manifest := range e.manifests {
+		if sbom := manifest.Annotations[SBOMAnnotation]; sbom != "" {
+			sbomDigest := strings.TrimPrefix(sbom, "sha256:")
+			sbomSize, err := e.blobCache.GetSize(sbomDigest)
+			if err != nil {
+				return err
+			}
+			err = e.postByBlobDigest(link, SBOMMediaType, sbomDigest, int(sbomSize))
+			if err != nil {
+				return err
+			}
+		}
+
 		configDigest := manifest.Config.Digest.Encoded()
 		layerMediaType := manifest.Config.MediaType
 
@@ -284,6 +352,49 @@ func (e *containerImage) uploadBlobs(link OciImageLink) error {
 			if err != nil {
 				return err
 			}
+			if allotment.TOC != "" {
+				tocSize, err := e.blobCache.GetSize(allotment.TOC)
+				if err != nil {
+					return err
+				}
+				err = e.postByBlobDigest(link, TwoDfsTOCMediaType, allotment.TOC, int(tocSize))
+				if err != nil {
+					return err
+				}
+			}
+			if allotment.SBOM != "" {
+				sbomSize, err := e.blobCache.GetSize(allotment.SBOM)
+				if err != nil {
+					return err
+				}
+				err = e.postByBlobDigest(link, SBOMMediaType, allotment.SBOM, int(sbomSize))
+				if err != nil {
+					return err
+				}
+			}
+			if allotment.Delta != nil {
+				deltaSize, err := e.blobCache.GetSize(allotment.Delta.Digest)
+				if err != nil {
+					return err
+				}
+				err = e.postByBlobDigest(link, TwoDfsDeltaMediaType, allotment.Delta.Digest, int(deltaSize))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	// Upload the provenance statement referenced by the index
+	if provenance := e.index.Annotations[ProvenanceAnnotation]; provenance != "" {
+		provenanceDigest := strings.TrimPrefix(provenance, "sha256:")
+		provenanceSize, err := e.blobCache.GetSize(provenanceDigest)
+		if err != nil {
+			return err
+		}
+		err = e.postByBlobDigest(link, InTotoMediaType, provenanceDigest, int(provenanceSize))
+		if err != nil {
+			return err
 		}
 	}
 
@@ -0,0 +1,170 @@
+package oci
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// BlobKind tells what a referenced blob is
+type BlobKind string
+
+const (
+	ManifestBlob   BlobKind = "manifest"
+	ConfigBlob     BlobKind = "config"
+	LayerBlob      BlobKind = "layer"
+	FieldBlob      BlobKind = "field"
+	AllotmentBlob  BlobKind = "allotment"
+	TOCBlob        BlobKind = "toc"
+	SBOMBlob       BlobKind = "sbom"
+	DeltaBlob      BlobKind = "delta"
+	SignatureBlob  BlobKind = "signature"
+	ProvenanceBlob BlobKind = "provenance"
+)
+
+// BlobReference is a blob of the blob store referenced by an image
+type BlobReference struct {
+	Digest string   `json:"digest"`
+	Kind   BlobKind `json:"kind"`
+	// Platform of the manifest referencing the blob, empty for blobs shared by the whole index
+	Platform string `json:"platform,omitempty"`
+	// Parent is the digest of the blob referencing this one, empty for blobs referenced by the index
+	Parent string `json:"parent,omitempty"`
+}
+
+// ImageReferences lists everything an index of the index store references
+type ImageReferences struct {
+	// IndexHash is the name of the index in the index store
+	IndexHash string          `json:"index"`
+	Name      string          `json:"name"`
+	Blobs     []BlobReference `json:"blobs"`
+	// Errors are the blobs that could not be read, the references they hold are unknown
+	Errors []string `json:"errors,omitempty"`
+}
+
+// ReferenceGraph is the set of blobs referenced by every local image
+type ReferenceGraph struct {
+	Images []ImageReferences `json:"images"`
+}
+
+// WalkReferences follows every index of indexStore through its manifests, configs, layers and fields.
+// Blobs that are missing or unreadable are still listed, and reported in the Errors of their image.
+func WalkReferences(indexStore cache.CacheStore, blobStore cache.CacheStore) ReferenceGraph {
+	graph := ReferenceGraph{Images: []ImageReferences{}}
+	for _, indexHash := range indexStore.List() {
+		image := ImageReferences{IndexHash: indexHash, Blobs: []BlobReference{}}
+		reader, err := indexStore.Get(indexHash)
+		if err != nil {
+			image.Errors = append(image.Errors, fmt.Sprintf("index %s: %v", indexHash, err))
+			graph.Images = append(graph.Images, image)
+			continue
+		}
+		idx, err := ReadIndex(reader)
+		reader.Close()
+		if err != nil {
+			image.Errors = append(image.Errors, fmt.Sprintf("index %s: %v", indexHash, err))
+			graph.Images = append(graph.Images, image)
+			continue
+		}
+		image.Name = idx.Annotations[ImageNameAnnotation]
+		if provenance := idx.Annotations[ProvenanceAnnotation]; provenance != "" {
+			image.add(strings.TrimPrefix(provenance, "sha256:"), ProvenanceBlob, "", "")
+		}
+		for _, m := range idx.Manifests {
+			image.walkManifest(blobStore, m)
+		}
+		graph.Images = append(graph.Images, image)
+	}
+	return graph
+}
+
+func (i *ImageReferences) add(digest string, kind BlobKind, platform string, parent string) {
+	i.Blobs = append(i.Blobs, BlobReference{Digest: digest, Kind: kind, Platform: platform, Parent: parent})
+}
+
+func (i *ImageReferences) walkManifest(blobStore cache.CacheStore, descriptor v1.Descriptor) {
+	manifestDigest := descriptor.Digest.Encoded()
+	platform := platformOf(descriptor)
+	i.add(manifestDigest, ManifestBlob, platform, "")
+	reader, err := blobStore.Get(manifestDigest)
+	if err != nil {
+		i.Errors = append(i.Errors, fmt.Sprintf("manifest %s: %v", manifestDigest, err))
+		return
+	}
+	manifest, _, _, err := ReadManifest(reader)
+	reader.Close()
+	if err != nil {
+		i.Errors = append(i.Errors, fmt.Sprintf("manifest %s: %v", manifestDigest, err))
+		return
+	}
+	i.add(manifest.Config.Digest.Encoded(), ConfigBlob, platform, manifestDigest)
+	if sbom := manifest.Annotations[SBOMAnnotation]; sbom != "" {
+		i.add(strings.TrimPrefix(sbom, "sha256:"), SBOMBlob, platform, manifestDigest)
+	}
+	for _, l := range manifest.Layers {
+		if l.MediaType != TwoDfsMediaType {
+			i.add(l.Digest.Encoded(), LayerBlob, platform, manifestDigest)
+			continue
+		}
+		i.add(l.Digest.Encoded(), FieldBlob, platform, manifestDigest)
+		if signature := l.Annotations[FieldSignatureAnnotation]; signature != "" {
+			i.add(strings.TrimPrefix(signature, "sha256:"), SignatureBlob, platform, l.Digest.Encoded())
+		}
+		i.walkField(blobStore, l.Digest.Encoded(), platform)
+	}
+}
+
+func (i *ImageReferences) walkField(blobStore cache.CacheStore, fieldDigest string, platform string) {
+	reader, err := blobStore.Get(fieldDigest)
+	if err != nil {
+		i.Errors = append(i.Errors, fmt.Sprintf("field %s: %v", fieldDigest, err))
+		return
+	}
+	fieldBytes, err := io.ReadAll(reader)
+	reader.Close()
+	if err != nil {
+		i.Errors = append(i.Errors, fmt.Sprintf("field %s: %v", fieldDigest, err))
+		return
+	}
+	field, err := filesystem.GetField().Unmarshal(string(fieldBytes))
+	if err != nil {
+		i.Errors = append(i.Errors, fmt.Sprintf("field %s: %v", fieldDigest, err))
+		return
+	}
+	for a := range field.IterateAllotments() {
+		i.add(a.Digest, AllotmentBlob, platform, fieldDigest)
+		if a.TOC != "" {
+			i.add(a.TOC, TOCBlob, platform, a.Digest)
+		}
+		if a.SBOM != "" {
+			i.add(a.SBOM, SBOMBlob, platform, a.Digest)
+		}
+		if a.Delta != nil {
+			i.add(a.Delta.Digest, DeltaBlob, platform, a.Digest)
+		}
+	}
+}
+
+// Referenced counts the references to every blob
+func (g ReferenceGraph) Referenced() map[string]int {
+	references := map[string]int{}
+	for _, image := range g.Images {
+		for _, blob := range image.Blobs {
+			references[blob.Digest]++
+		}
+	}
+	return references
+}
+
+// Errors returns the errors hit while walking every image
+func (g ReferenceGraph) Errors() []string {
+	errors := []string{}
+	for _, image := range g.Images {
+		errors = append(errors, image.Errors...)
+	}
+	return errors
+}
@@ -2,6 +2,8 @@ package oci
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdh"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
@@ -12,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"log"
 
@@ -34,6 +37,14 @@ const (
 	BlobStoreContextKey contextKeyType = "blobStore"
 	// KeyStoreContextKey is the context key for the blob store
 	KeyStoreContextKey contextKeyType = "keyStore"
+	// PartitionOptionsContextKey is the context key for the PartitionOptions used when materializing a semantic tag
+	PartitionOptionsContextKey contextKeyType = "partitionOptions"
+	// BuildOptionsContextKey is the context key for the BuildOptions used when adding a field
+	BuildOptionsContextKey contextKeyType = "buildOptions"
+	// ExportOptionsContextKey is the context key for the ExportOptions used when exporting an image
+	ExportOptionsContextKey contextKeyType = "exportOptions"
+	// LeaseContextKey is the context key for the *cache.Lease pinning the blobs used by a running build
+	LeaseContextKey contextKeyType = "lease"
 	// 2dfs media type
 	TwoDfsMediaType = "application/vnd.oci.image.layer.v1.2dfs.field"
 	// image name annotation
@@ -58,13 +69,21 @@ type containerImage struct {
 	platforms      []string
 	partitions     []partition
 	partitionTag   string
+	partitionOpts  PartitionOptions
+	buildOpts      BuildOptions
+	exportOpts     ExportOptions
+	deltaBase      filesystem.Field
+	haveBlobs      map[string]bool
+	deltas         map[string]filesystem.AllotmentDelta
 	indexCache     cache.CacheStore
 	blobCache      cache.CacheStore
 	keyDigestCache cache.CacheStore
 	field          filesystem.Field
 	manifests      []v1.Manifest
 	configs        []v1.Image
-	cacheLock      sync.Mutex
+	// record describes how the image was made, it is written along with the index
+	record    ImageRecord
+	cacheLock sync.Mutex
 }
 
 type CacheKeys struct {
@@ -75,6 +94,24 @@ type FileCacheKey struct {
 	Destination   string `json:"destination"`
 	DiffID        string `json:"diffID"`
 	CompressedSha string `json:"compressedSha"`
+	// Annotations of a derived blob that can't be derived again from it, like the wrapped keys of an encrypted layer
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// BuildOptions tunes how allotment layers are generated
+type BuildOptions struct {
+	// EStargz generates lazy-pullable allotment layers in eStargz format
+	EStargz bool
+	// DeltaFrom is a local image whose allotments are the base of binary deltas for the changed cells
+	DeltaFrom string
+	// SignKey signs the field and its allotments, the signature is stored as a detached blob referenced by the field layer
+	SignKey crypto.Signer
+	// Owner is the identity of the publisher stored in the field. Default: the fingerprint of SignKey
+	Owner string
+	// Recipients are the public keys the layer keys of the allotments marked encrypt are wrapped for
+	Recipients []*ecdh.PublicKey
+	// Provenance describes the build invocation recorded in the provenance statement of the image
+	Provenance ProvenanceOptions
 }
 
 type partition struct {
@@ -121,7 +158,7 @@ func NewImage(ctx context.Context, url string, forcepull bool, platforms []strin
 		return nil, fmt.Errorf("key store location not found in context")
 	}
 
-	imgstore, err := cache.NewCacheStore(indexStoreLocation)
+	imgstore, err := cache.NewMetadataStore(indexStoreLocation)
 	if err != nil {
 		return nil, err
 	}
@@ -129,10 +166,16 @@ func NewImage(ctx context.Context, url string, forcepull bool, platforms []strin
 	if err != nil {
 		return nil, err
 	}
-	blobdigeststore, err := cache.NewCacheStore(keyStoreLocation)
+	blobdigeststore, err := cache.NewMetadataStore(keyStoreLocation)
 	if err != nil {
 		return nil, err
 	}
+	// a prune running alongside the build must not remove the blobs it uses before its index is written
+	if lease, ok := ctx.Value(LeaseContextKey).(*cache.Lease); ok {
+		imgstore = lease.Locked(imgstore)
+		blobstore = lease.Store(blobstore)
+		blobdigeststore = lease.Store(blobdigeststore)
+	}
 
 	img := &containerImage{
 		indexCache:     imgstore,
@@ -144,15 +187,30 @@ func NewImage(ctx context.Context, url string, forcepull bool, platforms []strin
 		cacheLock:      sync.Mutex{},
 	}
 
+	if opts, ok := ctx.Value(BuildOptionsContextKey).(BuildOptions); ok {
+		img.buildOpts = opts
+	}
+	if img.buildOpts.DeltaFrom != "" {
+		img.deltaBase, err = loadDeltaBase(ctx, img.buildOpts.DeltaFrom)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	err = img.loadIndex(url, ctx)
 	if err != nil {
 		return nil, err
 	}
+	img.downloadProvenance()
 
 	err = img.downloadManifests()
 	if err != nil {
 		return nil, err
 	}
+	// the index of a pulled image is stored before its manifests are known
+	if img.record.Kind == PulledImage {
+		img.writeRecord()
+	}
 
 	for _, manifest := range img.manifests {
 		err = img.downloadManifestBlobs(manifest)
@@ -167,6 +225,76 @@ func NewImage(ctx context.Context, url string, forcepull bool, platforms []strin
 
 func GetLocalImage(ctx context.Context, reference string) (Image, error) {
 
+	img, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts, ok := ctx.Value(ExportOptionsContextKey).(ExportOptions); ok {
+		img.exportOpts = opts
+		// only fields signed by the given key are exported
+		if opts.SignatureKey != nil {
+			err = img.verifyFieldSignature(opts.SignatureKey)
+			if err != nil {
+				return nil, fmt.Errorf("signature required: %w", err)
+			}
+			fmt.Printf("Field signature [VERIFIED]\n")
+		}
+		// export deltas against the blobs of an image the target already has
+		if opts.Have != "" {
+			err = img.loadHave(ctx, opts.Have)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// choose the partition automatically if a budget is given
+	if img.partitionOpts.Budget > 0 {
+		if len(img.partitions) > 0 {
+			return nil, fmt.Errorf("a budget can't be combined with a semantic tag partition")
+		}
+		err = img.selectBudgetPartitions(img.partitionOpts.Budget)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// check if image requires partitioning
+	if len(img.partitions) > 0 {
+		fmt.Printf("Partitioning the image...\n")
+		err = img.partition()
+		if err != nil {
+			return nil, err
+		}
+		//delete field for current image
+		img.field = nil
+	}
+
+	return img, nil
+}
+
+// ResolveIndex returns the name of the index of reference in indexStore, reference is an index hash or an image url
+func ResolveIndex(indexStore cache.CacheStore, reference string) (string, error) {
+	if _, err := indexStore.GetSize(reference); err == nil {
+		return reference, nil
+	}
+	img := &containerImage{}
+	img.updateImageInfo(reference)
+	// partitions are stored under their semantic tag
+	partitionHash := fmt.Sprintf("%x", sha256.Sum256([]byte(img.registry+"/"+img.repository+":"+img.partitionTag)))
+	if _, err := indexStore.GetSize(partitionHash); err == nil {
+		return partitionHash, nil
+	}
+	if _, err := indexStore.GetSize(img.indexHash); err != nil {
+		return "", fmt.Errorf("image %s not found", reference)
+	}
+	return img.indexHash, nil
+}
+
+// loadLocalImage loads an image from the local cache. Partitions requested by a semantic tag are parsed but not applied.
+func loadLocalImage(ctx context.Context, reference string) (*containerImage, error) {
+
 	ctxIndexPosition := ctx.Value(IndexStoreContextKey)
 	indexStoreLocation := ""
 	if ctxIndexPosition != nil {
@@ -191,7 +319,7 @@ func GetLocalImage(ctx context.Context, reference string) (Image, error) {
 		return nil, fmt.Errorf("key store location not found in context")
 	}
 
-	imgstore, err := cache.NewCacheStore(indexStoreLocation)
+	imgstore, err := cache.NewMetadataStore(indexStoreLocation)
 	if err != nil {
 		return nil, err
 	}
@@ -199,7 +327,7 @@ func GetLocalImage(ctx context.Context, reference string) (Image, error) {
 	if err != nil {
 		return nil, err
 	}
-	blobdigeststore, err := cache.NewCacheStore(keyStoreLocation)
+	blobdigeststore, err := cache.NewMetadataStore(keyStoreLocation)
 	if err != nil {
 		return nil, err
 	}
@@ -212,17 +340,24 @@ func GetLocalImage(ctx context.Context, reference string) (Image, error) {
 		cacheLock:      sync.Mutex{},
 	}
 
+	if opts, ok := ctx.Value(PartitionOptionsContextKey).(PartitionOptions); ok {
+		img.partitionOpts = opts
+	}
+
+	indexName := reference
 	idxReader, err := imgstore.Get(reference)
 	if err != nil {
 		// if reference not found, try getting the image using the url
 		img.updateImageInfo(reference)
-		fmt.Printf("Resolving image url %s locally...\n", img.indexHash)
+		log.Printf("Resolving image url %s locally...", img.indexHash)
+		indexName = img.indexHash
 		idxReader, err = imgstore.Get(img.indexHash)
 		if err != nil {
 			return nil, err
 		}
 	}
 	defer idxReader.Close()
+	cache.Touch(imgstore, indexName)
 
 	idx, err := ReadIndex(idxReader)
 	if err != nil {
@@ -246,19 +381,6 @@ func GetLocalImage(ctx context.Context, reference string) (Image, error) {
 		}
 	}
 
-	// check if image requires partitioning
-	if len(img.partitions) > 0 {
-		fmt.Printf("Partitioning the image...\n")
-		idx.Annotations[ImageNameAnnotation] = img.registry + "/" + img.repository + ":" + img.partitionTag
-		img.indexHash = fmt.Sprintf("%x", sha256.Sum256([]byte(idx.Annotations[ImageNameAnnotation])))
-		err = img.partition()
-		if err != nil {
-			return nil, err
-		}
-		//delete field for current image
-		img.field = nil
-	}
-
 	return img, nil
 }
 
@@ -275,6 +397,7 @@ func (c *containerImage) loadIndex(url string, ctx context.Context) error {
 	indexReader, err := c.indexCache.Get(c.indexHash)
 	if err == nil {
 		log.Default().Printf("%s [CACHED] \n", c.url)
+		cache.Touch(c.indexCache, c.indexHash)
 		// load index from cache
 		defer indexReader.Close()
 		index, err := ReadIndex(indexReader)
@@ -306,24 +429,36 @@ func (c *containerImage) loadIndex(url string, ctx context.Context) error {
 	log.Default().Println("Index downloaded")
 
 	index = c.filterByPlatform(index)
+	c.index = index
+	c.record = ImageRecord{Kind: PulledImage}
 
 	// save index to cache
-	uploadWriter, err := c.indexCache.Add(c.indexHash)
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = c.storeIndex(indexBytes)
 	if err != nil {
 		return err
 	}
 
-	defer uploadWriter.Close()
-	indexBytes, err := json.Marshal(index)
+	c.index = index
+	return nil
+}
+
+// storeIndex writes the index of the image to the index store, records its use and how it was made
+func (c *containerImage) storeIndex(indexBytes []byte) error {
+	// the index commits the record, a record never describes an older index
+	err := cache.DelRecord(c.indexCache, c.indexHash)
 	if err != nil {
 		return err
 	}
-	_, err = uploadWriter.Write(indexBytes)
+	err = cache.WriteEntry(c.indexCache, c.indexHash, indexBytes)
 	if err != nil {
 		return err
 	}
-
-	c.index = index
+	cache.Touch(c.indexCache, c.indexHash)
+	c.writeRecord()
 	return nil
 }
 
@@ -377,6 +512,32 @@ func (c *containerImage) updateImageInfo(url string) {
 }
 
 func (c *containerImage) AddField(manifest filesystem.TwoDFsManifest, targetUrl string) error {
+	start := time.Now()
+	baseIndex, err := json.Marshal(c.index)
+	if err != nil {
+		return err
+	}
+	record := ImageRecord{
+		Kind:                 BuiltImage,
+		SourceManifestDigest: c.buildOpts.Provenance.ManifestDigest,
+		Base:                 c.url,
+		BaseDigest:           fmt.Sprintf("sha256:%x", sha256.Sum256(baseIndex)),
+		Parent:               c.indexHash,
+	}
+
+	// the provenance records the base image before the field is added
+	dependencies := c.baseDependencies()
+	if c.buildOpts.Provenance.ManifestDigest != "" {
+		dependencies = append(dependencies, ResourceDescriptor{
+			URI:    "file:" + c.buildOpts.Provenance.ManifestPath,
+			Digest: map[string]string{"sha256": c.buildOpts.Provenance.ManifestDigest},
+		})
+	}
+	sources, err := sourceDependencies(manifest)
+	if err != nil {
+		return err
+	}
+	dependencies = append(dependencies, sources...)
 
 	fs, err := c.buildFiled(manifest)
 	c.field = fs
@@ -384,35 +545,48 @@ func (c *containerImage) AddField(manifest filesystem.TwoDFsManifest, targetUrl
 		return err
 	}
 
+	if c.buildOpts.Owner != "" {
+		fs.SetOwner(c.buildOpts.Owner)
+	} else if c.buildOpts.SignKey != nil {
+		fingerprint, err := KeyFingerprint(c.buildOpts.SignKey.Public())
+		if err != nil {
+			return err
+		}
+		fs.SetOwner(fingerprint)
+	}
+
 	marshalledFs := []byte(fs.Marshal())
 	fsDigest := fmt.Sprintf("%x", sha256.Sum256(marshalledFs))
 
 	// if new fs, write it to cache
 	if !c.blobCache.Check(fsDigest) {
 		fmt.Printf("Field %s [CREATED]\n", fsDigest)
-		fsWriter, err := c.blobCache.Add(fsDigest)
+		err = cache.WriteEntry(c.blobCache, fsDigest, marshalledFs)
 		if err != nil {
 			return err
 		}
-		_, err = fsWriter.Write(marshalledFs)
+	} else {
+		fmt.Printf("Field %s [CACHED]\n", fsDigest)
+	}
+
+	fieldDescriptor := v1.Descriptor{
+		MediaType: TwoDfsMediaType,
+		Digest:    digest.Digest(fmt.Sprintf("sha256:%s", fsDigest)),
+		Size:      int64(len(marshalledFs)),
+	}
+	if c.buildOpts.SignKey != nil {
+		signatureDigest, err := c.signField(fsDigest, c.buildOpts.SignKey)
 		if err != nil {
-			c.blobCache.Del(fsDigest)
 			return err
 		}
-		defer fsWriter.Close()
-	} else {
-		fmt.Printf("Field %s [CACHED]\n", fsDigest)
+		fieldDescriptor.Annotations = map[string]string{FieldSignatureAnnotation: "sha256:" + signatureDigest}
 	}
 
 	c.updateImageInfo(targetUrl)
 
 	for i, manifest := range c.manifests {
 		// update manifest with new layer
-		c.manifests[i].Layers = append(manifest.Layers, v1.Descriptor{
-			MediaType: TwoDfsMediaType,
-			Digest:    digest.Digest(fmt.Sprintf("sha256:%s", fsDigest)),
-			Size:      int64(len(marshalledFs)),
-		})
+		c.manifests[i].Layers = append(manifest.Layers, fieldDescriptor)
 		if c.manifests[i].Annotations != nil {
 			c.manifests[i].Annotations["org.opencontainers.image.url"] = fmt.Sprintf("https://%s/%s", c.registry, c.repository)
 			c.manifests[i].Annotations["org.opencontainers.image.version"] = c.tag
@@ -434,16 +608,10 @@ func (c *containerImage) AddField(manifest filesystem.TwoDFsManifest, targetUrl
 		manifestDigest := fmt.Sprintf("%x", sha256.Sum256(marshalledManifest))
 		// update manifest cache
 		if !c.blobCache.Check(manifestDigest) {
-			manifestWriter, err := c.blobCache.Add(manifestDigest)
-			if err != nil {
-				return err
-			}
-			_, err = manifestWriter.Write(marshalledManifest)
+			err = cache.WriteEntry(c.blobCache, manifestDigest, marshalledManifest)
 			if err != nil {
-				manifestWriter.Close()
 				return err
 			}
-			manifestWriter.Close()
 		} else {
 			fmt.Printf("%s [CACHED]\n", manifestDigest)
 		}
@@ -454,22 +622,20 @@ func (c *containerImage) AddField(manifest filesystem.TwoDFsManifest, targetUrl
 		}
 	}
 
-	// update index cache
-	indexBytes, err := json.Marshal(c.index)
+	err = c.storeProvenance(dependencies)
 	if err != nil {
 		return err
 	}
 
-	c.indexCache.Del(c.indexHash)
-	indexWriter, err := c.indexCache.Add(c.indexHash)
-	if err != nil {
-		return err
-	}
-	_, err = indexWriter.Write(indexBytes)
+	// update index cache
+	indexBytes, err := json.Marshal(c.index)
 	if err != nil {
 		return err
 	}
-	return nil
+
+	record.BuildDuration = time.Since(start)
+	c.record = record
+	return c.storeIndex(indexBytes)
 }
 
 func (c *containerImage) GetIndex() []byte {
@@ -482,8 +648,7 @@ func (c *containerImage) GetIndex() []byte {
 }
 
 func (c *containerImage) partition() error {
-
-	partitionAllotment := []filesystem.Allotment{}
+	partitionLayers := []partitionLayer{}
 
 	for i, manifest := range c.manifests {
 		filteredLayers := []v1.Descriptor{}
@@ -493,40 +658,26 @@ func (c *containerImage) partition() error {
 			if layer.MediaType == TwoDfsMediaType {
 				//if 2dfs layer parse field and partition allotments
 				c.readField(layer.Digest.Encoded())
-				if len(partitionAllotment) == 0 {
-					if c.field != nil {
-						for allotment := range c.field.IterateAllotments() {
-							//skip empty allotments
-							if allotment.Digest == "" {
-								continue
-							}
-							for _, p := range c.partitions {
-								if allotment.Row >= p.x1 && allotment.Row <= p.x2 && allotment.Col >= p.y1 && allotment.Col <= p.y2 {
-									partitionAllotment = append(partitionAllotment, allotment)
-									//TODO remove duplicated
-								}
-							}
-						}
+				if len(partitionLayers) == 0 && c.field != nil {
+					var err error
+					partitionLayers, err = c.partitionLayers()
+					if err != nil {
+						return err
 					}
 				}
 			} else {
 				filteredLayers = append(filteredLayers, layer)
 			}
 		}
-		if len(partitionAllotment) > 0 {
+		if len(partitionLayers) > 0 {
 			//adding partitioned layers
-			for _, p := range partitionAllotment {
-				blobSize, err := c.blobCache.GetSize(p.Digest)
-				if err != nil {
-					return err
-				}
-				fmt.Printf("Partition %s [CREATING]\n", p.Digest)
-				filteredLayers = append(filteredLayers, v1.Descriptor{
-					MediaType: "application/vnd.oci.image.layer.v1.tar+gzip",
-					Digest:    digest.Digest(fmt.Sprintf("sha256:%s", p.Digest)),
-					Size:      blobSize,
-				})
-				rootfsLayers.DiffIDs = append(rootfsLayers.DiffIDs, digest.Digest(fmt.Sprintf("sha256:%s", p.DiffID)))
+			for _, p := range partitionLayers {
+				filteredLayers = append(filteredLayers, p.descriptor)
+				rootfsLayers.DiffIDs = append(rootfsLayers.DiffIDs, digest.Digest(fmt.Sprintf("sha256:%s", p.diffID)))
+			}
+			err := c.annotateSBOM(i, partitionLayers)
+			if err != nil {
+				return err
 			}
 		} else {
 			return fmt.Errorf("no 2DFS partitions found. Make sure the image has format OCI+2DFS and that the partition matches the allotments")
@@ -536,6 +687,27 @@ func (c *containerImage) partition() error {
 
 		marshalledConfig, _ := json.Marshal(c.configs[i])
 		c.manifests[i].Config.Digest = digest.Digest(fmt.Sprintf("sha256:%x", sha256.Sum256(marshalledConfig)))
+		c.manifests[i].Config.Size = int64(len(marshalledConfig))
+	}
+
+	// the semantic tag is final once the selection is, dependencies included
+	parent := fmt.Sprintf("%x", sha256.Sum256([]byte(c.url)))
+	c.index.Annotations[ImageNameAnnotation] = c.registry + "/" + c.repository + ":" + c.partitionTag
+	c.indexHash = fmt.Sprintf("%x", sha256.Sum256([]byte(c.index.Annotations[ImageNameAnnotation])))
+
+	// partitions inherit how their image was built, and keep their creation time when generated again
+	record := ImageRecord{}
+	cache.ReadRecord(c.indexCache, parent, &record)
+	previous := ImageRecord{}
+	cache.ReadRecord(c.indexCache, c.indexHash, &previous)
+	c.record = ImageRecord{
+		Kind:                 PartitionImage,
+		Created:              previous.Created,
+		SourceManifestDigest: record.SourceManifestDigest,
+		Base:                 record.Base,
+		BaseDigest:           record.BaseDigest,
+		Parent:               parent,
+		Partition:            c.partitionTag,
 	}
 
 	for i, _ := range c.index.Manifests {
@@ -547,32 +719,20 @@ func (c *containerImage) partition() error {
 		configDigest := c.manifests[i].Config.Digest.Encoded()
 		// update manifest
 		if !c.blobCache.Check(manifestDigest) {
-			manifestWriter, err := c.blobCache.Add(manifestDigest)
-			if err != nil {
-				return err
-			}
-			_, err = manifestWriter.Write(marshalledManifest)
+			err = cache.WriteEntry(c.blobCache, manifestDigest, marshalledManifest)
 			if err != nil {
-				manifestWriter.Close()
 				return err
 			}
-			manifestWriter.Close()
 		} else {
 			fmt.Printf("%s [CACHED]\n", manifestDigest)
 		}
 		// update config
 		if !c.blobCache.Check(configDigest) {
-			configWriter, err := c.blobCache.Add(configDigest)
-			if err != nil {
-				return err
-			}
 			marshalledConfig, _ := json.Marshal(c.configs[i])
-			_, err = configWriter.Write(marshalledConfig)
+			err = cache.WriteEntry(c.blobCache, configDigest, marshalledConfig)
 			if err != nil {
-				configWriter.Close()
 				return err
 			}
-			configWriter.Close()
 		} else {
 			fmt.Printf("%s [CACHED]\n", configDigest)
 		}
@@ -590,16 +750,7 @@ func (c *containerImage) partition() error {
 		return err
 	}
 
-	c.indexCache.Del(c.indexHash)
-	indexWriter, err := c.indexCache.Add(c.indexHash)
-	if err != nil {
-		return err
-	}
-	_, err = indexWriter.Write(indexBytes)
-	if err != nil {
-		return err
-	}
-	return nil
+	return c.storeIndex(indexBytes)
 }
 
 func (c *containerImage) downloadManifests() error {
@@ -660,6 +811,7 @@ func (c *containerImage) downloadManifestBlobs(manifest v1.Manifest) error {
 		return err
 	}
 	c.configs = append(c.configs, config)
+	c.downloadSBOM(manifest)
 
 	// download layers
 	success := make(chan bool, len(manifest.Layers))
@@ -737,7 +889,7 @@ func (c *containerImage) downloadAndCache(downloadDigest digest.Digest, mediaTyp
 		defer readCloser.Close()
 	}
 
-	// upload blob to cache store
+	// upload blob to cache store, interrupted or corrupted downloads never reach the store
 	uploadWriter, err := c.blobCache.Add(downloadDigest.Encoded())
 	if err != nil {
 		return err
@@ -745,14 +897,12 @@ func (c *containerImage) downloadAndCache(downloadDigest digest.Digest, mediaTyp
 	copyBuffer := make([]byte, 1024*1024)
 	_, err = io.CopyBuffer(uploadWriter, readCloser, copyBuffer)
 	if err != nil {
-		c.blobCache.Del(downloadDigest.Encoded())
+		uploadWriter.Abort()
 		return err
 	}
-	defer uploadWriter.Close()
-
-	if !c.blobCache.Check(downloadDigest.Encoded()) {
-		c.blobCache.Del(downloadDigest.Encoded())
-		return fmt.Errorf("blob integrity check failed, please retry")
+	err = uploadWriter.Commit()
+	if err != nil {
+		return fmt.Errorf("blob integrity check failed, please retry: %w", err)
 	}
 
 	return nil
@@ -786,6 +936,40 @@ func (c *containerImage) GetExporter(args ...string) (FieldExporter, error) {
 
 func (c *containerImage) buildFiled(manifest filesystem.TwoDFsManifest) (filesystem.Field, error) {
 
+	for _, rule := range manifest.Rules {
+		if err := filesystem.ValidateRule(rule.When); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %w", rule.When, err)
+		}
+	}
+
+	// every required cell must be provided by the manifest
+	provided := make(map[filesystem.Cell]bool)
+	for _, a := range manifest.Allotments {
+		provided[filesystem.Cell{Row: a.Row, Col: a.Col}] = true
+	}
+	for _, a := range manifest.Allotments {
+		for _, required := range a.Requires {
+			if !provided[required] {
+				return nil, fmt.Errorf("allotment %d/%d requires cell %d/%d which has no allotment", a.Row, a.Col, required.Row, required.Col)
+			}
+		}
+	}
+
+	// check paths written by more than one cell
+	policy, err := manifest.ConflictPolicy()
+	if err != nil {
+		return nil, err
+	}
+	if policy != filesystem.ConflictsAllow {
+		conflicts := filesystem.DetectConflicts(manifest)
+		for _, conflict := range conflicts {
+			log.Printf("[WARNING] Path conflict: %s\n", conflict)
+		}
+		if len(conflicts) > 0 && policy == filesystem.ConflictsFail {
+			return nil, fmt.Errorf("%d path conflicts between allotments, set a priority and the \"allow\" conflicts policy to overwrite files on purpose", len(conflicts))
+		}
+	}
+
 	tmpFolder := filepath.Join(os.TempDir(), fmt.Sprintf("%x-field", c.indexHash))
 	if _, err := os.Stat(tmpFolder); err == nil {
 		os.RemoveAll(tmpFolder)
@@ -818,6 +1002,13 @@ func (c *containerImage) buildFiled(manifest filesystem.TwoDFsManifest) (filesys
 		return nil, fmt.Errorf("error during allotment build procedure")
 	}
 
+	if len(manifest.SelectionPriority) > 0 {
+		f.SetSelectionPriority(manifest.SelectionPriority)
+	}
+	if len(manifest.Rules) > 0 {
+		f.SetRules(manifest.Rules)
+	}
+
 	return f, nil
 }
 
@@ -839,7 +1030,11 @@ func (c *containerImage) buildAllotment(a filesystem.AllotmentManifest, f filesy
 			if err != nil {
 				log.Fatal(err)
 			}
-			diffID, compressedSha, err := GetFileSha(cacheKeys, a.Dst.List)
+			diffID, compressedSha, err := GetFileSha(cacheKeys, c.allotmentDestinations(a))
+			// a key outliving its layer, pruned or evicted, is a miss: the layer is rebuilt before being encrypted or listed
+			if err == nil && !c.blobCache.Check(compressedSha) {
+				err = fmt.Errorf("layer %s of the cache entry is missing", compressedSha)
+			}
 			if err == nil {
 				log.Printf("File %s [CACHED] \n", a.Src)
 				return compressedSha, diffID
@@ -855,71 +1050,109 @@ func (c *containerImage) buildAllotment(a filesystem.AllotmentManifest, f filesy
 	if compressedSha == "" {
 		log.Printf("File %s [COPY] \n", a.Src)
 
-		tarPath, err := compress.TarFile(a.Src.List, a.Dst.List)
+		tarPath, err := compress.TarFile(a.Src.List, a.Dst.List, a.Remove.List...)
 		if err != nil {
 			return err
 		}
-		tarReader, err := os.Open(tarPath)
-		if err != nil {
-			return err
-		}
-		defer tarReader.Close()
 		defer os.Remove(tarPath)
 
-		diffID = compress.CalculateSha256Digest(tarReader)
-		tarReader.Seek(0, 0)
-
 		log.Printf("File %s [COMPRESSING] \n", a.Src)
 
-		archiveName, err := compress.TarToGz(tarPath)
-		if err != nil {
-			return err
+		if c.buildOpts.EStargz {
+			diffID, compressedSha, err = c.storeEStargzLayer(tarPath)
+		} else {
+			diffID, compressedSha, err = c.storeTarLayer(tarPath)
 		}
-		archive, err := os.Open(archiveName)
 		if err != nil {
 			return err
 		}
-		defer archive.Close()
-		defer os.Remove(archiveName)
-		compressedSha = compress.CalculateSha256Digest(archive)
 
 		//add uncompressed allotment cache reference
 		c.cacheLock.Lock()
 		c.upsertCacheKey(fileSha, FileCacheKey{
 			DiffID:        diffID,
 			CompressedSha: compressedSha,
-		}, a.Dst.List)
+		}, c.allotmentDestinations(a))
 		c.cacheLock.Unlock()
 
-		if !c.blobCache.Check(compressedSha) {
-			blobWriter, err := c.blobCache.Add(compressedSha)
-			if err != nil {
-				return err
-			}
-			archive.Seek(0, 0)
-			copyBuffer := make([]byte, 1024*1024*100)
-			_, err = io.CopyBuffer(blobWriter, archive, copyBuffer)
-			blobWriter.Close()
-			archive.Close()
-			if err != nil {
-				c.blobCache.Del(compressedSha)
-				return err
-			}
-			log.Printf("Alltoment %d/%d %s [CREATED] \n", a.Row, a.Col, compressedSha)
+		log.Printf("Alltoment %d/%d %s [CREATED] \n", a.Row, a.Col, compressedSha)
+	}
+
+	// the files of encrypted allotments are not listed in clear and their layers are not lazy-pullable nor delta-encoded
+	if a.Encrypt {
+		if len(c.buildOpts.Recipients) == 0 {
+			return fmt.Errorf("allotment %d/%d must be encrypted but no recipient was given", a.Row, a.Col)
+		}
+		encryptedSha, annotations, err := c.encryptLayer(compressedSha, c.buildOpts.Recipients)
+		if err != nil {
+			return err
+		}
+		log.Printf("Alltoment %d/%d %s [ENCRYPTED] \n", a.Row, a.Col, encryptedSha)
+		f.AddAllotment(filesystem.Allotment{
+			Row:        a.Row,
+			Col:        a.Col,
+			Digest:     encryptedSha,
+			DiffID:     diffID,
+			Requires:   a.Requires,
+			Priority:   a.Priority,
+			Encryption: &filesystem.AllotmentEncryption{Annotations: annotations},
+		})
+		return nil
+	}
+
+	tocSha, err := c.allotmentTOC(compressedSha, diffID)
+	if err != nil {
+		return err
+	}
+	sbomSha, err := c.allotmentSBOM(compressedSha, diffID)
+	if err != nil {
+		return err
+	}
+	estargzTOC := ""
+	if c.buildOpts.EStargz {
+		estargzTOC, err = c.estargzTOCDigest(compressedSha)
+		if err != nil {
+			return err
+		}
+	}
+	var delta *filesystem.AllotmentDelta
+	if c.deltaBase != nil {
+		delta, err = c.allotmentDelta(a.Row, a.Col, compressedSha, diffID)
+		if err != nil {
+			return err
 		}
 	}
 
 	// add allotments
 	f.AddAllotment(filesystem.Allotment{
-		Row:    a.Row,
-		Col:    a.Col,
-		Digest: compressedSha,
-		DiffID: diffID,
+		Row:        a.Row,
+		Col:        a.Col,
+		Digest:     compressedSha,
+		DiffID:     diffID,
+		Requires:   a.Requires,
+		Priority:   a.Priority,
+		TOC:        tocSha,
+		SBOM:       sbomSha,
+		EStargzTOC: estargzTOC,
+		Delta:      delta,
 	})
 
 	return nil
 }
 
+// allotmentDestinations returns the destinations identifying an allotment cache entry: the destination paths plus the whiteouts.
+// eStargz layers are cached separately from plain gzip layers.
+func (c *containerImage) allotmentDestinations(a filesystem.AllotmentManifest) []string {
+	destinations := append([]string{}, a.Dst.List...)
+	for _, r := range a.Remove.List {
+		destinations = append(destinations, compress.WhiteoutPath(r))
+	}
+	if c.buildOpts.EStargz {
+		destinations = append(destinations, estargzDestination)
+	}
+	return destinations
+}
+
 func createFileWithDirs(p string) (*os.File, error) {
 	// Extract the directory path from the full path
 	dir := filepath.Dir(p)
@@ -1017,25 +1250,21 @@ func (c *containerImage) upsertCacheKey(fileSha string, cacheFile FileCacheKey,
 			return err
 		}
 		keyDigestReader.Close()
-		c.keyDigestCache.Del(fileSha)
 	}
 
-	cachekey.Keys = append(cachekey.Keys, cacheFile)
-	cachewriter, err := c.keyDigestCache.Add(fileSha)
-	if err != nil {
-		return err
+	// a key rebuilt after its layer went missing replaces the stale one
+	keys := []FileCacheKey{}
+	for _, key := range cachekey.Keys {
+		if key.Destination != destinationStr {
+			keys = append(keys, key)
+		}
 	}
-	defer cachewriter.Close()
+	cachekey.Keys = append(keys, cacheFile)
 	cacheKeyBytes, err := json.Marshal(cachekey)
 	if err != nil {
 		return err
 	}
-	_, err = cachewriter.Write(cacheKeyBytes)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return cache.WriteEntry(c.keyDigestCache, fileSha, cacheKeyBytes)
 }
 
 func ParseCacheKey(reader io.Reader) (CacheKeys, error) {
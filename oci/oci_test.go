@@ -1,8 +1,18 @@
 package oci
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -10,6 +20,10 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/compress"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
@@ -195,3 +209,582 @@ func TestDownloadBase64(t *testing.T) {
 	}
 
 }
+
+func TestCellsToPartitions(t *testing.T) {
+	cells := []filesystem.Cell{{Row: 1, Col: 1}, {Row: 0, Col: 1}, {Row: 0, Col: 0}, {Row: 1, Col: 3}, {Row: 0, Col: 0}}
+
+	semanticTag := formatPartitions(cellsToPartitions(cells))
+
+	expected := "--0.0.0.1--1.1.1.1--1.3.1.3"
+	if semanticTag != expected {
+		t.Errorf("Invalid canonical partition, expected %s, given %s", expected, semanticTag)
+	}
+}
+
+func TestBudgetByRectangle(t *testing.T) {
+	sizes := map[filesystem.Cell]int64{
+		{Row: 0, Col: 0}: 10,
+		{Row: 0, Col: 1}: 10,
+		{Row: 1, Col: 0}: 10,
+		{Row: 1, Col: 1}: 50,
+	}
+
+	rectangle, ok := budgetByRectangle(sizes, nil, 35)
+	if !ok {
+		t.Fatalf("expected a rectangle to fit the budget")
+	}
+	if (rectangle.x2+1)*(rectangle.y2+1) != 2 {
+		t.Errorf("Invalid rectangle, expected area 2, given %v", rectangle)
+	}
+
+	_, ok = budgetByRectangle(sizes, nil, 5)
+	if ok {
+		t.Errorf("expected no rectangle to fit the budget")
+	}
+}
+
+func TestBudgetByPriority(t *testing.T) {
+	sizes := map[filesystem.Cell]int64{
+		{Row: 0, Col: 0}: 10,
+		{Row: 0, Col: 1}: 30,
+		{Row: 1, Col: 0}: 10,
+	}
+	priority := []filesystem.Cell{{Row: 1, Col: 0}, {Row: 0, Col: 1}, {Row: 0, Col: 0}}
+
+	selected := budgetByPriority(priority, sizes, nil, 25)
+	if len(selected) != 1 || selected[0] != (filesystem.Cell{Row: 1, Col: 0}) {
+		t.Errorf("Invalid selection, expected [{1 0}], given %v", selected)
+	}
+}
+
+func TestMissingDependencies(t *testing.T) {
+	requires := map[filesystem.Cell][]filesystem.Cell{
+		{Row: 1, Col: 1}: {{Row: 0, Col: 1}},
+		{Row: 0, Col: 1}: {{Row: 0, Col: 0}},
+	}
+	selected := map[filesystem.Cell]bool{{Row: 1, Col: 1}: true}
+
+	missing := missingDependencies(selected, requires)
+
+	if len(missing) != 2 {
+		t.Fatalf("expected 2 missing cells, given %v", missing)
+	}
+	if missing[filesystem.Cell{Row: 0, Col: 0}] != (filesystem.Cell{Row: 0, Col: 1}) {
+		t.Errorf("expected 0/0 to be required by 0/1, given %v", missing)
+	}
+}
+
+func TestSelectionWithDependencies(t *testing.T) {
+	field := filesystem.GetField().
+		AddAllotment(filesystem.Allotment{Row: 0, Col: 0, Digest: "a"}).
+		AddAllotment(filesystem.Allotment{Row: 0, Col: 1, Digest: "b", Requires: []filesystem.Cell{{Row: 0, Col: 0}}}).
+		AddAllotment(filesystem.Allotment{Row: 1, Col: 1, Digest: "c", Requires: []filesystem.Cell{{Row: 0, Col: 1}}})
+	img := &containerImage{tag: "v1", partitionTag: "v1--1.1.1.1", field: field, partitions: []partition{{x1: 1, y1: 1, x2: 1, y2: 1}}}
+
+	if _, err := img.selectAllotments(); err == nil {
+		t.Fatalf("selection missing its dependencies accepted")
+	}
+	img.partitionOpts.IncludeDependencies = true
+	selected, err := img.selectAllotments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected) != 3 {
+		t.Fatalf("expected 3 allotments, given %v", selected)
+	}
+	// the name of the partition lists the included cells too
+	if img.partitionTag != "v1--1.1.1.1--0.0.0.1" {
+		t.Errorf("unexpected partition tag %s", img.partitionTag)
+	}
+}
+
+// streamingStore serves blobs without random access, as a remote store does
+type streamingStore struct {
+	cache.CacheStore
+}
+
+func (s streamingStore) Get(digest string) (io.ReadCloser, error) {
+	reader, err := s.CacheStore.Get(digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(reader)
+	reader.Close()
+	return io.NopCloser(bytes.NewReader(content)), err
+}
+
+func TestOpenStoreBlobAt(t *testing.T) {
+	blobCache, err := cache.NewCacheStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("allotment layer streamed from a remote cache")
+	sha := fmt.Sprintf("%x", sha256.Sum256(content))
+	if err := cache.WriteEntry(blobCache, sha, content); err != nil {
+		t.Fatal(err)
+	}
+	blob, size, err := openStoreBlobAt(streamingStore{blobCache}, sha)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	part := make([]byte, 6)
+	if _, err := blob.ReadAt(part, 10); err != nil || size != int64(len(content)) || string(part) != "layer " {
+		t.Fatalf("unexpected random access %q of %d bytes: %v", part, size, err)
+	}
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	recipient, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := bytes.Repeat([]byte("licensed weights "), 10000)
+
+	encrypted := bytes.Buffer{}
+	privOpts, pubOpts, err := encryptStream(bytes.NewReader(plain), &encrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	annotations, err := encryptionAnnotations(privOpts, pubOpts, []*ecdh.PublicKey{recipient.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := unwrapKey(annotations[EncryptionKeysAnnotation], other); ok {
+		t.Fatalf("layer key unwrapped with a key of another recipient")
+	}
+	unwrapped, ok := unwrapKey(annotations[EncryptionKeysAnnotation], recipient)
+	if !ok {
+		t.Fatalf("unable to unwrap the layer key")
+	}
+
+	decrypted := bytes.Buffer{}
+	ciphertext := encrypted.Bytes()
+	err = decryptStream(bytes.NewReader(ciphertext), int64(len(ciphertext)), unwrapped, pubOpts, &decrypted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted.Bytes(), plain) {
+		t.Errorf("decrypted content differs from the plaintext")
+	}
+
+	ciphertext[10] ^= 1
+	err = decryptStream(bytes.NewReader(ciphertext), int64(len(ciphertext)), unwrapped, pubOpts, io.Discard)
+	if err == nil {
+		t.Errorf("tampered layer decrypted")
+	}
+}
+
+func TestSignatureRoundTrip(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{"field":"sha256:00","owner":"team","allotments":[]}`)
+
+	for _, key := range []crypto.Signer{edKey, ecKey} {
+		signature, err := signPayload(payload, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := signature.verify(key.Public()); err != nil {
+			t.Errorf("%T: valid signature rejected: %v", key, err)
+		}
+		tampered := signature
+		tampered.Payload = []byte(`{"field":"sha256:01","owner":"team","allotments":[]}`)
+		if err := tampered.verify(key.Public()); err == nil {
+			t.Errorf("%T: tampered payload accepted", key)
+		}
+	}
+	edSignature, err := signPayload(payload, edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := edSignature.verify(ecKey.Public()); err == nil {
+		t.Errorf("signature accepted with the key of another publisher")
+	}
+}
+
+func TestSBOMMerge(t *testing.T) {
+	entries := []compress.TOCEntry{
+		{Path: "/opt/model.bin", Type: compress.TOCTypeFile, Size: 42, Digest: "aa"},
+		{Path: "/opt", Type: compress.TOCTypeDir},
+	}
+	packages := []compress.Package{{Name: "numpy", Version: "1.26.0", Type: compress.PackageTypePyPI, Path: "/numpy-1.26.0.dist-info/METADATA"}}
+	allotment := layerSBOM("layer", entries, packages)
+	if len(allotment.Files) != 1 || len(allotment.Packages) != 2 {
+		t.Fatalf("expected 1 file and 2 packages, got %+v", allotment)
+	}
+	if allotment.Packages[1].ExternalRefs[0].ReferenceLocator != "pkg:pypi/numpy@1.26.0" {
+		t.Fatalf("unexpected purl %s", allotment.Packages[1].ExternalRefs[0].ReferenceLocator)
+	}
+
+	base := newSBOM("base", "base", "2024-01-01T00:00:00Z")
+	base.Packages = append(base.Packages, SBOMPackage{SPDXID: "SPDXRef-Image", Name: "base"})
+	base.Relationships = append(base.Relationships, SBOMRelationship{spdxDocumentID, spdxDescribes, "SPDXRef-Image"})
+
+	merged := newSBOM("partition", "partition", "")
+	merged.merge(base, "Base-")
+	merged.merge(allotment, "Cell-0-1-")
+	if merged.CreationInfo.Created != "2024-01-01T00:00:00Z" {
+		t.Fatalf("expected the latest creation time, got %s", merged.CreationInfo.Created)
+	}
+	ids := map[string]bool{}
+	for _, p := range merged.Packages {
+		ids[p.SPDXID] = true
+	}
+	for _, f := range merged.Files {
+		ids[f.SPDXID] = true
+	}
+	for _, id := range []string{"SPDXRef-Base-Image", "SPDXRef-Cell-0-1-Allotment", "SPDXRef-Cell-0-1-File-0", "SPDXRef-Cell-0-1-Package-0"} {
+		if !ids[id] {
+			t.Fatalf("missing element %s", id)
+		}
+	}
+	for _, r := range merged.Relationships {
+		if r.RelationshipType == spdxDescribes {
+			t.Fatalf("merged documents must be contained by the partition, found %+v", r)
+		}
+		if !ids[r.SPDXElementID] && r.SPDXElementID != spdxPartitionID || !ids[r.RelatedSPDXElement] {
+			t.Fatalf("dangling relationship %+v", r)
+		}
+	}
+}
+
+func TestProvenanceVerify(t *testing.T) {
+	blobCache, err := cache.NewCacheStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := &containerImage{
+		blobCache: blobCache,
+		url:       "docker.io/library/app:v1",
+		index: v1.Index{
+			Manifests:   []v1.Descriptor{{Digest: digest.Digest("sha256:" + strings.Repeat("a", 64)), Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}}},
+			Annotations: map[string]string{},
+		},
+		buildOpts: BuildOptions{Provenance: ProvenanceOptions{BuilderVersion: "test", Parameters: map[string]string{"target": "app:v1"}}},
+	}
+	if err := img.verifyProvenance(); err == nil {
+		t.Fatalf("image without provenance accepted")
+	}
+	if err := img.storeProvenance([]ResourceDescriptor{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := img.verifyProvenance(); err != nil {
+		t.Fatalf("valid provenance rejected: %v", err)
+	}
+
+	// the statement no longer describes a rebuilt manifest
+	img.index.Manifests[0].Digest = digest.Digest("sha256:" + strings.Repeat("b", 64))
+	if err := img.verifyProvenance(); err == nil {
+		t.Fatalf("provenance of another manifest accepted")
+	}
+}
+
+func TestWalkReferences(t *testing.T) {
+	indexCache, err := cache.NewMetadataStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobCache, err := cache.NewCacheStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := func(content string) string {
+		sha := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
+		if err := cache.WriteEntry(blobCache, sha, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		return sha
+	}
+	allotment := strings.Repeat("1", 64)
+	toc := strings.Repeat("2", 64)
+	field := store(filesystem.GetField().AddAllotment(filesystem.Allotment{Row: 0, Col: 0, Digest: allotment, DiffID: "diff", TOC: toc}).Marshal())
+	manifestBytes, _ := json.Marshal(v1.Manifest{
+		Config: v1.Descriptor{Digest: digest.Digest("sha256:" + strings.Repeat("3", 64))},
+		Layers: []v1.Descriptor{
+			{MediaType: v1.MediaTypeImageLayerGzip, Digest: digest.Digest("sha256:" + strings.Repeat("4", 64))},
+			{MediaType: TwoDfsMediaType, Digest: digest.Digest("sha256:" + field)},
+		},
+	})
+	manifest := store(string(manifestBytes))
+	missing := strings.Repeat("5", 64)
+	indexBytes, _ := json.Marshal(v1.Index{
+		Manifests: []v1.Descriptor{
+			{Digest: digest.Digest("sha256:" + manifest), Platform: &v1.Platform{OS: "linux", Architecture: "amd64"}},
+			{Digest: digest.Digest("sha256:" + missing), Platform: &v1.Platform{OS: "linux", Architecture: "arm64"}},
+		},
+		Annotations: map[string]string{ImageNameAnnotation: "docker.io/library/app:v1", ProvenanceAnnotation: "sha256:" + strings.Repeat("6", 64)},
+	})
+	if err := cache.WriteEntry(indexCache, "app", indexBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	graph := WalkReferences(indexCache, blobCache)
+	if len(graph.Images) != 1 || graph.Images[0].Name != "docker.io/library/app:v1" {
+		t.Fatalf("unexpected images %v", graph.Images)
+	}
+	referenced := graph.Referenced()
+	for _, sha := range []string{manifest, missing, field, allotment, toc, strings.Repeat("3", 64), strings.Repeat("4", 64), strings.Repeat("6", 64)} {
+		if referenced[sha] != 1 {
+			t.Errorf("blob %s referenced %d times", sha, referenced[sha])
+		}
+	}
+	if len(referenced) != 8 {
+		t.Errorf("unexpected references %v", referenced)
+	}
+	if errors := graph.Errors(); len(errors) != 1 || !strings.Contains(errors[0], missing) {
+		t.Errorf("the missing manifest is not reported: %v", errors)
+	}
+}
+
+func TestTagImage(t *testing.T) {
+	indexCache, err := cache.NewMetadataStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobCache, err := cache.NewCacheStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestBytes, _ := json.Marshal(v1.Manifest{
+		Config:      v1.Descriptor{Digest: digest.Digest("sha256:" + strings.Repeat("3", 64)), Size: 10},
+		Layers:      []v1.Descriptor{{MediaType: v1.MediaTypeImageLayerGzip, Digest: digest.Digest("sha256:" + strings.Repeat("4", 64)), Size: 20}},
+		Annotations: map[string]string{"org.opencontainers.image.version": "v1"},
+	})
+	manifest := fmt.Sprintf("%x", sha256.Sum256(manifestBytes))
+	if err := cache.WriteEntry(blobCache, manifest, manifestBytes); err != nil {
+		t.Fatal(err)
+	}
+	idx := v1.Index{
+		Manifests: []v1.Descriptor{{
+			Digest:      digest.Digest("sha256:" + manifest),
+			Size:        int64(len(manifestBytes)),
+			Platform:    &v1.Platform{OS: "linux", Architecture: "amd64"},
+			Annotations: map[string]string{"org.opencontainers.image.version": "v1"},
+		}},
+		Annotations: map[string]string{ImageNameAnnotation: "docker.io/library/app:v1"},
+	}
+	indexBytes, _ := json.Marshal(idx)
+	srcHash := fmt.Sprintf("%x", sha256.Sum256([]byte("docker.io/library/app:v1")))
+	if err := cache.WriteEntry(indexCache, srcHash, indexBytes); err != nil {
+		t.Fatal(err)
+	}
+
+	dstHash, err := TagImage(indexCache, blobCache, "app:v1", "registry.local/team/app:stable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dstHash != fmt.Sprintf("%x", sha256.Sum256([]byte("registry.local/team/app:stable"))) {
+		t.Fatalf("unexpected index hash %s", dstHash)
+	}
+	reader, err := indexCache.Get(dstHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tagged, err := ReadIndex(reader)
+	reader.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tagged.Annotations[ImageNameAnnotation] != "registry.local/team/app:stable" || tagged.Manifests[0].Annotations["org.opencontainers.image.version"] != "stable" {
+		t.Fatalf("index not renamed: %v", tagged)
+	}
+	taggedManifest := tagged.Manifests[0].Digest.Encoded()
+	if taggedManifest == manifest || !blobCache.Check(taggedManifest) || !blobCache.Check(manifest) {
+		t.Fatalf("manifest digest not recomputed")
+	}
+	reader, _ = blobCache.Get(taggedManifest)
+	m, _, _, err := ReadManifest(reader)
+	reader.Close()
+	if err != nil || m.Annotations["org.opencontainers.image.version"] != "stable" || m.Layers[0].Digest.Encoded() != strings.Repeat("4", 64) {
+		t.Fatalf("unexpected tagged manifest %v, %v", m, err)
+	}
+
+	srcContent, err := ContentDigest(blobCache, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dstContent, err := ContentDigest(blobCache, tagged)
+	if err != nil || srcContent != dstContent {
+		t.Fatalf("aliases hold different content: %s %s %v", srcContent, dstContent, err)
+	}
+
+	record, err := ReadImageRecord(indexCache, blobCache, dstHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Kind != TaggedImage || record.Parent != srcHash || record.Name != "registry.local/team/app:stable" || record.Content != srcContent || record.Tag != "stable" {
+		t.Fatalf("unexpected record of the alias %+v", record)
+	}
+	// images stored without a record are described out of their blobs
+	record, err = ReadImageRecord(indexCache, blobCache, srcHash)
+	if err != nil || record.Name != "docker.io/library/app:v1" || record.Type != "OCI" || record.Size != int64(len(manifestBytes))+30 || len(record.Platforms) != 1 || record.Created.IsZero() {
+		t.Fatalf("unexpected record %+v, %v", record, err)
+	}
+
+	if _, err := TagImage(indexCache, blobCache, "app:v1", "app:v1--0.0.0.0"); err == nil {
+		t.Fatalf("semantic tag accepted as a name")
+	}
+	if _, err := TagImage(indexCache, blobCache, "missing:v1", "app:v2"); err == nil {
+		t.Fatalf("missing image tagged")
+	}
+}
+
+// useStores returns the context of an empty local store
+func useStores(t *testing.T) (context.Context, cache.CacheStore, cache.CacheStore) {
+	indexPath, blobPath, keysPath := t.TempDir(), t.TempDir(), t.TempDir()
+	indexCache, err := cache.NewMetadataStore(indexPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobCache, err := cache.NewCacheStore(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	ctx = context.WithValue(ctx, IndexStoreContextKey, indexPath)
+	ctx = context.WithValue(ctx, BlobStoreContextKey, blobPath)
+	ctx = context.WithValue(ctx, KeyStoreContextKey, keysPath)
+	return ctx, indexCache, blobCache
+}
+
+// storeBlob stores content in blobCache and returns its descriptor
+func storeBlob(t *testing.T, blobCache cache.CacheStore, mediaType string, content []byte) v1.Descriptor {
+	sha := fmt.Sprintf("%x", sha256.Sum256(content))
+	if err := cache.WriteEntry(blobCache, sha, content); err != nil {
+		t.Fatal(err)
+	}
+	return v1.Descriptor{MediaType: mediaType, Digest: digest.Digest("sha256:" + sha), Size: int64(len(content))}
+}
+
+// gzipped compresses content as a layer
+func gzipped(t *testing.T, content string) []byte {
+	buffer := bytes.Buffer{}
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write([]byte(content)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+// storeFieldImage stores a single platform image holding base and field as a local image named url
+func storeFieldImage(t *testing.T, indexCache cache.CacheStore, blobCache cache.CacheStore, url string, base v1.Descriptor, field filesystem.Field) {
+	configBytes, _ := json.Marshal(v1.Image{Platform: v1.Platform{OS: "linux", Architecture: "amd64"}})
+	config := storeBlob(t, blobCache, v1.MediaTypeImageConfig, configBytes)
+	fieldLayer := storeBlob(t, blobCache, TwoDfsMediaType, []byte(field.Marshal()))
+	manifestBytes, _ := json.Marshal(v1.Manifest{MediaType: v1.MediaTypeImageManifest, Config: config, Layers: []v1.Descriptor{base, fieldLayer}})
+	manifest := storeBlob(t, blobCache, v1.MediaTypeImageManifest, manifestBytes)
+	manifest.Platform = &v1.Platform{OS: "linux", Architecture: "amd64"}
+	indexBytes, _ := json.Marshal(v1.Index{
+		Manifests:   []v1.Descriptor{manifest},
+		Annotations: map[string]string{ImageNameAnnotation: url},
+	})
+	if err := cache.WriteEntry(indexCache, fmt.Sprintf("%x", sha256.Sum256([]byte(url))), indexBytes); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlanEncryptedPartition(t *testing.T) {
+	ctx, indexCache, blobCache := useStores(t)
+	base := storeBlob(t, blobCache, v1.MediaTypeImageLayerGzip, gzipped(t, "base layer"))
+	plain := storeBlob(t, blobCache, v1.MediaTypeImageLayerGzip, gzipped(t, "plain allotment"))
+	encrypted := storeBlob(t, blobCache, MediaTypeImageLayerGzipEncrypted, []byte("ciphertext, not gzip"))
+	field := filesystem.GetField().
+		AddAllotment(filesystem.Allotment{Row: 0, Col: 0, Digest: plain.Digest.Encoded(), DiffID: "plain"}).
+		AddAllotment(filesystem.Allotment{Row: 0, Col: 1, Digest: encrypted.Digest.Encoded(), DiffID: "encrypted",
+			Encryption: &filesystem.AllotmentEncryption{Annotations: map[string]string{EncryptionKeysAnnotation: "wrapped"}}})
+	storeFieldImage(t, indexCache, blobCache, "docker.io/library/app:v1", base, field)
+
+	// planned without the keys
+	plan, err := PlanPartition(ctx, "docker.io/library/app:v1--0.0.0.1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Allotments) != 2 {
+		t.Fatalf("unexpected allotments %v", plan.Allotments)
+	}
+	for _, a := range plan.Allotments {
+		if a.Encrypted != (a.Digest == encrypted.Digest.Encoded()) {
+			t.Errorf("allotment %d/%d encrypted %t", a.Row, a.Col, a.Encrypted)
+		}
+	}
+	if plan.AllotmentsSize != plain.Size+encrypted.Size || plan.AllotmentsUncompressedSize != int64(len("plain allotment")) {
+		t.Errorf("unexpected sizes %d, %d uncompressed", plan.AllotmentsSize, plan.AllotmentsUncompressedSize)
+	}
+}
+
+func TestPlanPartition(t *testing.T) {
+	ctx, indexCache, blobCache := useStores(t)
+	base := storeBlob(t, blobCache, v1.MediaTypeImageLayerGzip, gzipped(t, "base layer"))
+	first := storeBlob(t, blobCache, v1.MediaTypeImageLayerGzip, gzipped(t, "first allotment"))
+	second := storeBlob(t, blobCache, v1.MediaTypeImageLayerGzip, gzipped(t, "second allotment, larger"))
+	unselected := storeBlob(t, blobCache, v1.MediaTypeImageLayerGzip, gzipped(t, "unselected allotment"))
+	field := filesystem.GetField().
+		AddAllotment(filesystem.Allotment{Row: 0, Col: 0, Digest: first.Digest.Encoded(), DiffID: "first"}).
+		AddAllotment(filesystem.Allotment{Row: 0, Col: 1, Digest: second.Digest.Encoded(), DiffID: "second"}).
+		AddAllotment(filesystem.Allotment{Row: 1, Col: 1, Digest: unselected.Digest.Encoded(), DiffID: "unselected"})
+	storeFieldImage(t, indexCache, blobCache, "docker.io/library/app:v1", base, field)
+
+	tests := []struct {
+		name string
+		have []string
+		// present allotments
+		present  map[string]bool
+		transfer int64
+	}{
+		{"nothing", nil, map[string]bool{}, base.Size + first.Size + second.Size},
+		// both digest forms are accepted
+		{"base and first", []string{base.Digest.Encoded(), first.Digest.String()}, map[string]bool{first.Digest.Encoded(): true}, second.Size},
+		{"unrelated", []string{unselected.Digest.Encoded()}, map[string]bool{}, base.Size + first.Size + second.Size},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := PlanPartition(ctx, "docker.io/library/app:v1--0.0.0.1", tt.have)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(plan.Allotments) != 2 {
+				t.Fatalf("unexpected allotments %v", plan.Allotments)
+			}
+			for _, a := range plan.Allotments {
+				if a.Present != tt.present[a.Digest] {
+					t.Errorf("allotment %d/%d present %t", a.Row, a.Col, a.Present)
+				}
+			}
+			if plan.AllotmentsSize != first.Size+second.Size {
+				t.Errorf("unexpected allotments size %d", plan.AllotmentsSize)
+			}
+			if plan.AllotmentsUncompressedSize != int64(len("first allotment")+len("second allotment, larger")) {
+				t.Errorf("unexpected uncompressed size %d", plan.AllotmentsUncompressedSize)
+			}
+			if len(plan.Platforms) != 1 {
+				t.Fatalf("unexpected platforms %v", plan.Platforms)
+			}
+			p := plan.Platforms[0]
+			if p.Platform != "linux/amd64" || p.BaseSize != base.Size || p.TotalSize != base.Size+first.Size+second.Size {
+				t.Errorf("unexpected platform plan %+v", p)
+			}
+			if p.TransferSize != tt.transfer {
+				t.Errorf("unexpected transfer size %d, expected %d", p.TransferSize, tt.transfer)
+			}
+		})
+	}
+
+	if _, err := PlanPartition(ctx, "docker.io/library/app:v1", nil); err == nil {
+		t.Errorf("plan of a tag without partitions accepted")
+	}
+}
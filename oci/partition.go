@@ -0,0 +1,353 @@
+package oci
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/compress"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// PartitionOptions tunes how a semantic tag is materialized into OCI layers
+type PartitionOptions struct {
+	// Squash merges the selected allotments into a single layer instead of one layer per allotment
+	Squash bool
+	// Budget, if greater than zero, selects automatically the partition whose compressed size fits the given bytes
+	Budget int64
+	// Platform restricts the budget computation to the given os/arch. Default: the largest platform
+	Platform string
+	// IncludeDependencies adds the cells transitively required by the selection instead of rejecting it
+	IncludeDependencies bool
+	// DecryptKeys decrypt the encrypted allotments wrapped for them, the other encrypted allotments stay encrypted
+	DecryptKeys []*ecdh.PrivateKey
+}
+
+// partitionLayer is a layer generated out of the field that is appended to the base image layers
+type partitionLayer struct {
+	descriptor v1.Descriptor
+	diffID     string
+	// allotments materialized by the layer
+	allotments []filesystem.Allotment
+}
+
+// selectAllotments returns the non-empty allotments matched by the image partitions, without duplicates and in layer order:
+// ascending priority, then row-major.
+// Cells required by the selection are added if the partition options allow it, otherwise the selection is rejected.
+func (c *containerImage) selectAllotments() ([]filesystem.Allotment, error) {
+	selected := []filesystem.Allotment{}
+	if c.field == nil {
+		return selected, nil
+	}
+
+	allotments := []filesystem.Allotment{}
+	selectedCells := make(map[filesystem.Cell]bool)
+	requires := make(map[filesystem.Cell][]filesystem.Cell)
+	for allotment := range c.field.IterateAllotments() {
+		//skip empty allotments
+		if allotment.Digest == "" {
+			continue
+		}
+		allotments = append(allotments, allotment)
+		cell := filesystem.Cell{Row: allotment.Row, Col: allotment.Col}
+		requires[cell] = allotment.Requires
+		for _, p := range c.partitions {
+			if p.contains(allotment.Row, allotment.Col) {
+				selectedCells[cell] = true
+				break
+			}
+		}
+	}
+
+	missing := missingDependencies(selectedCells, requires)
+	if len(missing) > 0 {
+		if !c.partitionOpts.IncludeDependencies {
+			return nil, fmt.Errorf("the partition is missing required cells: %s. Add them to the semantic tag or use --with-dependencies", formatMissing(missing))
+		}
+		included := sortedCells(missing)
+		for _, cell := range included {
+			requiredBy := missing[cell]
+			if _, ok := requires[cell]; !ok {
+				return nil, fmt.Errorf("cell %d/%d required by %d/%d has no allotment", cell.Row, cell.Col, requiredBy.Row, requiredBy.Col)
+			}
+			fmt.Printf("Dependency %d/%d of %d/%d [INCLUDED]\n", cell.Row, cell.Col, requiredBy.Row, requiredBy.Col)
+			selectedCells[cell] = true
+		}
+		// the partition is named after every cell it holds, a selection with dependencies never shares the name of one without
+		c.partitions = append(c.partitions, cellsToPartitions(included)...)
+		c.partitionTag = c.tag + formatPartitions(c.partitions)
+		fmt.Printf("Selected partition %s/%s:%s\n", c.registry, c.repository, c.partitionTag)
+	}
+
+	for _, allotment := range allotments {
+		if selectedCells[filesystem.Cell{Row: allotment.Row, Col: allotment.Col}] {
+			selected = append(selected, allotment)
+		}
+	}
+
+	// layers with higher priority go on top, row-major order breaks ties
+	sort.SliceStable(selected, func(i, j int) bool {
+		return selected[i].Priority < selected[j].Priority
+	})
+	return selected, nil
+}
+
+// missingDependencies returns the cells transitively required by the selection that are not part of it, each mapped to the cell requiring it
+func missingDependencies(selected map[filesystem.Cell]bool, requires map[filesystem.Cell][]filesystem.Cell) map[filesystem.Cell]filesystem.Cell {
+	missing := make(map[filesystem.Cell]filesystem.Cell)
+	visited := make(map[filesystem.Cell]bool)
+	queue := []filesystem.Cell{}
+	for cell, ok := range selected {
+		if ok {
+			visited[cell] = true
+			queue = append(queue, cell)
+		}
+	}
+	for len(queue) > 0 {
+		cell := queue[0]
+		queue = queue[1:]
+		for _, required := range requires[cell] {
+			if visited[required] {
+				continue
+			}
+			visited[required] = true
+			missing[required] = cell
+			queue = append(queue, required)
+		}
+	}
+	return missing
+}
+
+// sortedCells returns the keys of the given cell map in row-major order
+func sortedCells[V any](cells map[filesystem.Cell]V) []filesystem.Cell {
+	sorted := make([]filesystem.Cell, 0, len(cells))
+	for cell := range cells {
+		sorted = append(sorted, cell)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Row != sorted[j].Row {
+			return sorted[i].Row < sorted[j].Row
+		}
+		return sorted[i].Col < sorted[j].Col
+	})
+	return sorted
+}
+
+// formatMissing lists missing cells in row-major order, e.g. 0/0 (required by 1/1)
+func formatMissing(missing map[filesystem.Cell]filesystem.Cell) string {
+	result := []string{}
+	for _, cell := range sortedCells(missing) {
+		result = append(result, fmt.Sprintf("%d/%d (required by %d/%d)", cell.Row, cell.Col, missing[cell].Row, missing[cell].Col))
+	}
+	return strings.Join(result, ", ")
+}
+
+// partitionLayers generates the layers that materialize the selected allotments
+func (c *containerImage) partitionLayers() ([]partitionLayer, error) {
+	allotments, err := c.selectAllotments()
+	if err != nil {
+		return nil, err
+	}
+	if len(allotments) == 0 {
+		return nil, nil
+	}
+	for i, a := range allotments {
+		allotments[i], err = c.plainAllotment(a)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.partitionOpts.Squash && len(allotments) > 1 {
+		layer, err := c.squashAllotments(allotments)
+		if err != nil {
+			return nil, err
+		}
+		return []partitionLayer{layer}, nil
+	}
+
+	layers := []partitionLayer{}
+	for _, a := range allotments {
+		blobSize, err := c.blobCache.GetSize(a.Digest)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("Partition %s [CREATING]\n", a.Digest)
+		descriptor := v1.Descriptor{
+			MediaType: v1.MediaTypeImageLayerGzip,
+			Digest:    digest.Digest(fmt.Sprintf("sha256:%s", a.Digest)),
+			Size:      blobSize,
+		}
+		// lazy-pulling snapshotters locate the files of eStargz layers through the TOC
+		if a.EStargzTOC != "" {
+			descriptor.Annotations = map[string]string{compress.EStargzTOCDigestAnnotation: a.EStargzTOC}
+		}
+		// encrypted layers are decrypted by the runtime holding one of the recipient keys
+		if a.Encryption != nil {
+			descriptor.MediaType = MediaTypeImageLayerGzipEncrypted
+			descriptor.Annotations = maps.Clone(a.Encryption.Annotations)
+		}
+		layers = append(layers, partitionLayer{
+			descriptor: descriptor,
+			diffID:     a.DiffID,
+			allotments: []filesystem.Allotment{a},
+		})
+	}
+	return layers, nil
+}
+
+// squashAllotments merges the given allotments into a single layer. Overlapping paths are resolved following the allotments order.
+// Allotments built as eStargz are squashed into an eStargz layer, so that the partition stays lazy-pullable.
+// The result is cached by the canonical identity of the partition, so squashing the same selection twice is free.
+func (c *containerImage) squashAllotments(allotments []filesystem.Allotment) (partitionLayer, error) {
+	estargz := false
+	for _, a := range allotments {
+		if a.Encryption != nil {
+			return partitionLayer{}, fmt.Errorf("allotment %d/%d is encrypted, squashing it requires one of its keys", a.Row, a.Col)
+		}
+		estargz = estargz || a.EStargzTOC != ""
+	}
+	identity := partitionIdentity(allotments)
+	derivation := []string{squashDestination}
+	if estargz {
+		derivation = append(derivation, estargzDestination)
+	}
+
+	diffID, compressedSha, cached := c.cachedDerivedBlob(identity, derivation...)
+	if cached {
+		fmt.Printf("Squashed partition %s [CACHED]\n", compressedSha)
+	} else {
+		fmt.Printf("Squashing %d allotments [CREATING]\n", len(allotments))
+		layers := []io.Reader{}
+		for _, a := range allotments {
+			blobReader, err := c.blobCache.Get(a.Digest)
+			if err != nil {
+				return partitionLayer{}, err
+			}
+			defer blobReader.Close()
+			layers = append(layers, blobReader)
+		}
+		tarPath, err := compress.MergeTarGz(layers)
+		if err != nil {
+			return partitionLayer{}, err
+		}
+		defer os.Remove(tarPath)
+
+		if estargz {
+			diffID, compressedSha, err = c.storeEStargzLayer(tarPath)
+		} else {
+			diffID, compressedSha, err = c.storeTarLayer(tarPath)
+		}
+		if err != nil {
+			return partitionLayer{}, err
+		}
+
+		c.cacheDerivedBlob(identity, diffID, compressedSha, derivation...)
+		fmt.Printf("Squashed partition %s [CREATED]\n", compressedSha)
+	}
+
+	blobSize, err := c.blobCache.GetSize(compressedSha)
+	if err != nil {
+		return partitionLayer{}, err
+	}
+	descriptor := v1.Descriptor{
+		MediaType: v1.MediaTypeImageLayerGzip,
+		Digest:    digest.Digest(fmt.Sprintf("sha256:%s", compressedSha)),
+		Size:      blobSize,
+	}
+	if estargz {
+		tocDigest, err := c.estargzTOCDigest(compressedSha)
+		if err != nil {
+			return partitionLayer{}, err
+		}
+		descriptor.Annotations = map[string]string{compress.EStargzTOCDigestAnnotation: tocDigest}
+	}
+	return partitionLayer{
+		descriptor: descriptor,
+		diffID:     diffID,
+		allotments: allotments,
+	}, nil
+}
+
+// storeTarLayer compresses the given tar, adds it to the blob cache and returns its DiffID and compressed digest
+func (c *containerImage) storeTarLayer(tarPath string) (string, string, error) {
+	tarReader, err := os.Open(tarPath)
+	if err != nil {
+		return "", "", err
+	}
+	diffID := compress.CalculateSha256Digest(tarReader)
+	tarReader.Close()
+
+	archiveName, err := compress.TarToGz(tarPath)
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(archiveName)
+	compressedSha, err := c.storeArchive(archiveName)
+	if err != nil {
+		return "", "", err
+	}
+	return diffID, compressedSha, nil
+}
+
+// storeArchive adds the given compressed layer to the blob cache and returns its digest
+func (c *containerImage) storeArchive(archiveName string) (string, error) {
+	archive, err := os.Open(archiveName)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+	compressedSha := compress.CalculateSha256Digest(archive)
+
+	if !c.blobCache.Check(compressedSha) {
+		blobWriter, err := c.blobCache.Add(compressedSha)
+		if err != nil {
+			return "", err
+		}
+		archive.Seek(0, 0)
+		copyBuffer := make([]byte, 1024*1024)
+		_, err = io.CopyBuffer(blobWriter, archive, copyBuffer)
+		if err != nil {
+			blobWriter.Abort()
+			return "", err
+		}
+		err = blobWriter.Commit()
+		if err != nil {
+			return "", err
+		}
+	}
+	return compressedSha, nil
+}
+
+// partitionIdentity returns the canonical identity of an ordered allotment selection
+func partitionIdentity(allotments []filesystem.Allotment) string {
+	digests := make([]string, 0, len(allotments))
+	for _, a := range allotments {
+		digests = append(digests, a.Digest)
+	}
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(digests, ","))))
+}
+
+// contains returns true if the allotment at row,col belongs to the partition
+func (p partition) contains(row int, col int) bool {
+	return row >= p.x1 && row <= p.x2 && col >= p.y1 && col <= p.y2
+}
+
+// loadField reads the field referenced by the image manifests, if any
+func (c *containerImage) loadField() error {
+	for _, manifest := range c.manifests {
+		for _, layer := range manifest.Layers {
+			if layer.MediaType == TwoDfsMediaType {
+				return c.readField(layer.Digest.Encoded())
+			}
+		}
+	}
+	return nil
+}
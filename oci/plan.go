@@ -0,0 +1,156 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/compress"
+)
+
+// PartitionPlan describes the cost of materializing a semantic tag without performing the partitioning
+type PartitionPlan struct {
+	Reference      string          `json:"reference"`
+	Allotments     []AllotmentPlan `json:"allotments"`
+	AllotmentsSize int64           `json:"allotments_size"`
+	// AllotmentsUncompressedSize does not count the encrypted allotments
+	AllotmentsUncompressedSize int64          `json:"allotments_uncompressed_size"`
+	Platforms                  []PlatformPlan `json:"platforms"`
+}
+
+// AllotmentPlan describes an allotment selected by the semantic tag
+type AllotmentPlan struct {
+	Row              int    `json:"row"`
+	Col              int    `json:"col"`
+	Digest           string `json:"digest"`
+	DiffID           string `json:"diffid"`
+	CompressedSize   int64  `json:"compressed_size"`
+	UncompressedSize int64  `json:"uncompressed_size"`
+	Present          bool   `json:"present"`
+	// Encrypted allotments are planned without the keys, their uncompressed size is unknown
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// LayerPlan describes a base image layer
+type LayerPlan struct {
+	Digest  string `json:"digest"`
+	Size    int64  `json:"size"`
+	Present bool   `json:"present"`
+}
+
+// PlatformPlan summarizes the partition cost for a single platform of the image
+type PlatformPlan struct {
+	Platform   string      `json:"platform"`
+	BaseLayers []LayerPlan `json:"base_layers"`
+	BaseSize   int64       `json:"base_size"`
+	// TotalSize is the compressed size of the base layers plus the selected allotments
+	TotalSize int64 `json:"total_size"`
+	// TransferSize is the part of TotalSize the target device does not have yet
+	TransferSize int64 `json:"transfer_size"`
+}
+
+/*
+PlanPartition computes sizes and costs of the partition requested by a semantic tag of a local image.
+have: digests of the blobs the target device already has. Both "sha256:<hex>" and "<hex>" forms are accepted.
+*/
+func PlanPartition(ctx context.Context, reference string, have []string) (PartitionPlan, error) {
+	plan := PartitionPlan{
+		Reference:  reference,
+		Allotments: []AllotmentPlan{},
+		Platforms:  []PlatformPlan{},
+	}
+
+	img, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return plan, err
+	}
+	if len(img.partitions) == 0 {
+		return plan, fmt.Errorf("%s is not a semantic tag, expected a reference like image:tag--x1.y1.x2.y2", reference)
+	}
+	err = img.loadField()
+	if err != nil {
+		return plan, err
+	}
+	if img.field == nil {
+		return plan, fmt.Errorf("no 2DFS field found. Make sure the image has format OCI+2DFS")
+	}
+
+	haveSet := make(map[string]bool)
+	for _, h := range have {
+		haveSet[strings.TrimPrefix(h, "sha256:")] = true
+	}
+
+	selected, err := img.selectAllotments()
+	if err != nil {
+		return plan, err
+	}
+	transferAllotments := int64(0)
+	for _, a := range selected {
+		compressedSize, err := img.blobCache.GetSize(a.Digest)
+		if err != nil {
+			return plan, err
+		}
+		uncompressedSize, err := func() (int64, error) {
+			if a.Encryption != nil {
+				return 0, nil
+			}
+			blobReader, err := img.blobCache.Get(a.Digest)
+			if err != nil {
+				return 0, err
+			}
+			defer blobReader.Close()
+			return compress.UncompressedSize(blobReader)
+		}()
+		if err != nil {
+			return plan, err
+		}
+		allotmentPlan := AllotmentPlan{
+			Row:              a.Row,
+			Col:              a.Col,
+			Digest:           a.Digest,
+			DiffID:           a.DiffID,
+			CompressedSize:   compressedSize,
+			UncompressedSize: uncompressedSize,
+			Present:          haveSet[a.Digest],
+			Encrypted:        a.Encryption != nil,
+		}
+		plan.Allotments = append(plan.Allotments, allotmentPlan)
+		plan.AllotmentsSize += compressedSize
+		plan.AllotmentsUncompressedSize += uncompressedSize
+		if !allotmentPlan.Present {
+			transferAllotments += compressedSize
+		}
+	}
+	if len(plan.Allotments) == 0 {
+		return plan, fmt.Errorf("no 2DFS partitions found. Make sure the partition matches the allotments")
+	}
+
+	for i, manifest := range img.manifests {
+		platformPlan := PlatformPlan{
+			BaseLayers:   []LayerPlan{},
+			TransferSize: transferAllotments,
+		}
+		if p := img.index.Manifests[i].Platform; p != nil {
+			platformPlan.Platform = fmt.Sprintf("%s/%s", p.OS, p.Architecture)
+		}
+		for _, layer := range manifest.Layers {
+			if layer.MediaType == TwoDfsMediaType {
+				continue
+			}
+			layerPlan := LayerPlan{
+				Digest:  layer.Digest.Encoded(),
+				Size:    layer.Size,
+				Present: haveSet[layer.Digest.Encoded()],
+			}
+			platformPlan.BaseLayers = append(platformPlan.BaseLayers, layerPlan)
+			platformPlan.BaseSize += layer.Size
+			if !layerPlan.Present {
+				platformPlan.TransferSize += layer.Size
+			}
+		}
+		platformPlan.TotalSize = platformPlan.BaseSize + plan.AllotmentsSize
+		plan.Platforms = append(plan.Platforms, platformPlan)
+	}
+
+	return plan, nil
+}
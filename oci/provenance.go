@@ -0,0 +1,236 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// InTotoMediaType is the media type of the provenance statement blob
+	InTotoMediaType = "application/vnd.in-toto+json"
+	// ProvenanceAnnotation on the image index references the provenance statement of the build
+	ProvenanceAnnotation = "org.2dfs.provenance"
+
+	inTotoStatementType = "https://in-toto.io/Statement/v1"
+	slsaProvenanceType  = "https://slsa.dev/provenance/v1"
+	tdfsBuildType       = "https://github.com/2DFS/2dfs-builder/build/v1"
+	tdfsBuilderID       = "https://github.com/2DFS/2dfs-builder"
+)
+
+// ProvenanceOptions describes the build invocation recorded in the provenance statement
+type ProvenanceOptions struct {
+	// BuilderVersion is the version of the tdfs binary
+	BuilderVersion string
+	// ManifestPath and ManifestDigest identify the 2dfs manifest file
+	ManifestPath   string
+	ManifestDigest string
+	// Parameters are the build flags
+	Parameters map[string]string
+}
+
+// ProvenanceStatement is an in-toto statement with a SLSA provenance predicate
+type ProvenanceStatement struct {
+	Type          string               `json:"_type"`
+	Subject       []ResourceDescriptor `json:"subject"`
+	PredicateType string               `json:"predicateType"`
+	Predicate     SLSAProvenance       `json:"predicate"`
+}
+
+// ResourceDescriptor identifies an artifact by name or uri and digest
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type SLSAProvenance struct {
+	BuildDefinition SLSABuildDefinition `json:"buildDefinition"`
+	RunDetails      SLSARunDetails      `json:"runDetails"`
+}
+
+type SLSABuildDefinition struct {
+	BuildType            string               `json:"buildType"`
+	ExternalParameters   map[string]string    `json:"externalParameters"`
+	ResolvedDependencies []ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// SLSARunDetails leaves out the build timestamps, so that rebuilding an image gives the same statement
+type SLSARunDetails struct {
+	Builder SLSABuilder `json:"builder"`
+}
+
+type SLSABuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version"`
+}
+
+// baseDependencies returns the platform manifests of the base image, they must be collected before the field is added
+func (c *containerImage) baseDependencies() []ResourceDescriptor {
+	dependencies := []ResourceDescriptor{}
+	for _, manifest := range c.index.Manifests {
+		dependency := ResourceDescriptor{
+			URI:    "oci://" + c.url,
+			Digest: map[string]string{"sha256": manifest.Digest.Encoded()},
+		}
+		if platform := platformOf(manifest); platform != "" {
+			dependency.Annotations = map[string]string{"platform": platform}
+		}
+		dependencies = append(dependencies, dependency)
+	}
+	return dependencies
+}
+
+// sourceDependencies returns the digest of every source file of the manifest, in manifest order and without duplicates
+func sourceDependencies(manifest filesystem.TwoDFsManifest) ([]ResourceDescriptor, error) {
+	dependencies := []ResourceDescriptor{}
+	seen := map[string]bool{}
+	for _, a := range manifest.Allotments {
+		for _, src := range a.Src.List {
+			if seen[src] {
+				continue
+			}
+			seen[src] = true
+			srcDigest, err := fileDigest(src)
+			if err != nil {
+				return nil, err
+			}
+			dependencies = append(dependencies, ResourceDescriptor{
+				URI:         "file:" + src,
+				Digest:      map[string]string{"sha256": srcDigest},
+				Annotations: map[string]string{"cell": fmt.Sprintf("%d/%d", a.Row, a.Col)},
+			})
+		}
+	}
+	return dependencies, nil
+}
+
+// storeProvenance writes the provenance statement of the image manifests and references it from the index annotations
+func (c *containerImage) storeProvenance(dependencies []ResourceDescriptor) error {
+	opts := c.buildOpts.Provenance
+	statement := ProvenanceStatement{
+		Type:          inTotoStatementType,
+		Subject:       []ResourceDescriptor{},
+		PredicateType: slsaProvenanceType,
+		Predicate: SLSAProvenance{
+			BuildDefinition: SLSABuildDefinition{
+				BuildType:            tdfsBuildType,
+				ExternalParameters:   opts.Parameters,
+				ResolvedDependencies: dependencies,
+			},
+			RunDetails: SLSARunDetails{
+				Builder: SLSABuilder{ID: tdfsBuilderID, Version: map[string]string{"tdfs": opts.BuilderVersion}},
+			},
+		},
+	}
+	if statement.Predicate.BuildDefinition.ExternalParameters == nil {
+		statement.Predicate.BuildDefinition.ExternalParameters = map[string]string{}
+	}
+	for _, manifest := range c.index.Manifests {
+		subject := ResourceDescriptor{
+			Name:   c.url,
+			Digest: map[string]string{"sha256": manifest.Digest.Encoded()},
+		}
+		if platform := platformOf(manifest); platform != "" {
+			subject.Annotations = map[string]string{"platform": platform}
+		}
+		statement.Subject = append(statement.Subject, subject)
+	}
+
+	statementBytes, err := json.Marshal(statement)
+	if err != nil {
+		return err
+	}
+	statementDigest := fmt.Sprintf("%x", sha256.Sum256(statementBytes))
+	if !c.blobCache.Check(statementDigest) {
+		err = cache.WriteEntry(c.blobCache, statementDigest, statementBytes)
+		if err != nil {
+			return err
+		}
+	}
+	c.index.Annotations[ProvenanceAnnotation] = "sha256:" + statementDigest
+	fmt.Printf("Provenance %s [CREATED]\n", statementDigest)
+	return nil
+}
+
+// readProvenance reads the provenance statement referenced by the index, checking its digest
+func (c *containerImage) readProvenance() (ProvenanceStatement, string, error) {
+	statement := ProvenanceStatement{}
+	statementDigest := strings.TrimPrefix(c.index.Annotations[ProvenanceAnnotation], "sha256:")
+	if statementDigest == "" {
+		return statement, "", fmt.Errorf("the image has no provenance statement, rebuild it to generate one")
+	}
+	reader, err := c.blobCache.Get(statementDigest)
+	if err != nil {
+		return statement, statementDigest, fmt.Errorf("provenance %s not found: %w", statementDigest, err)
+	}
+	defer reader.Close()
+	statementBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return statement, statementDigest, err
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(statementBytes)) != statementDigest {
+		return statement, statementDigest, fmt.Errorf("provenance %s is corrupted", statementDigest)
+	}
+	err = json.Unmarshal(statementBytes, &statement)
+	return statement, statementDigest, err
+}
+
+// verifyProvenance checks that the provenance statement of the index is a SLSA provenance whose subjects are the image manifests
+func (c *containerImage) verifyProvenance() error {
+	statement, statementDigest, err := c.readProvenance()
+	if err != nil {
+		return err
+	}
+	if statement.Type != inTotoStatementType || statement.PredicateType != slsaProvenanceType {
+		return fmt.Errorf("provenance %s is not a SLSA provenance statement", statementDigest)
+	}
+	if statement.Predicate.BuildDefinition.BuildType != tdfsBuildType {
+		return fmt.Errorf("provenance %s has unknown build type %s", statementDigest, statement.Predicate.BuildDefinition.BuildType)
+	}
+
+	subjects := []string{}
+	for _, subject := range statement.Subject {
+		subjects = append(subjects, subject.Digest["sha256"])
+	}
+	manifests := []string{}
+	for _, manifest := range c.index.Manifests {
+		manifests = append(manifests, manifest.Digest.Encoded())
+	}
+	sort.Strings(subjects)
+	sort.Strings(manifests)
+	if strings.Join(subjects, ",") != strings.Join(manifests, ",") {
+		return fmt.Errorf("provenance %s does not describe the manifests of the image", statementDigest)
+	}
+	return nil
+}
+
+// downloadProvenance fetches the provenance statement of a pulled index, images without a reachable statement are still usable
+func (c *containerImage) downloadProvenance() {
+	statementDigest := c.index.Annotations[ProvenanceAnnotation]
+	if statementDigest == "" || c.blobCache.Check(strings.TrimPrefix(statementDigest, "sha256:")) {
+		return
+	}
+	err := c.downloadAndCache(digest.Digest(statementDigest), InTotoMediaType)
+	if err != nil {
+		log.Printf("Provenance %s [SKIPPED]: %v", statementDigest, err)
+	}
+}
+
+// platformOf formats the platform of a descriptor, empty if not set
+func platformOf(descriptor v1.Descriptor) string {
+	if descriptor.Platform == nil {
+		return ""
+	}
+	return descriptor.Platform.OS + "/" + descriptor.Platform.Architecture
+}
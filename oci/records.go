@@ -0,0 +1,172 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Kinds of images, telling how they entered the local store
+const (
+	PulledImage    = "pulled"
+	BuiltImage     = "built"
+	PartitionImage = "partition"
+	TaggedImage    = "tag"
+)
+
+// ImageRecord is what the index store knows about a local image. It is kept next to the index and replaced with it,
+// so that images are listed without reading any blob.
+type ImageRecord struct {
+	Name      string   `json:"name"`
+	IndexHash string   `json:"index"`
+	Tag       string   `json:"tag"`
+	Type      string   `json:"type"`
+	Platforms []string `json:"platforms"`
+	// Content identifies the configs and layers of the image, aliases share it
+	Content string `json:"content"`
+	// Size of the manifests, configs and layers, every blob counted once
+	Size int64 `json:"size"`
+	// FieldSize of the 2dfs fields, the allotments they list are not counted
+	FieldSize int64     `json:"fieldSize"`
+	Kind      string    `json:"kind,omitempty"`
+	Created   time.Time `json:"created"`
+	// BuildDuration is the time taken to add the field
+	BuildDuration time.Duration `json:"buildDuration,omitempty"`
+	// SourceManifestDigest is the sha256 of the 2dfs manifest file the field was built from
+	SourceManifestDigest string `json:"sourceManifestDigest,omitempty"`
+	// Base and BaseDigest are the reference and the index digest of the image the field was added to
+	Base       string `json:"base,omitempty"`
+	BaseDigest string `json:"baseDigest,omitempty"`
+	// Parent is the index hash of the image this one was built, partitioned or tagged from
+	Parent string `json:"parent,omitempty"`
+	// Partition is the semantic tag of a partition
+	Partition string `json:"partition,omitempty"`
+}
+
+// describe fills the fields of the record that derive from the index and its manifests
+func (r *ImageRecord) describe(idx v1.Index, manifests []v1.Manifest) {
+	r.Name = idx.Annotations[ImageNameAnnotation]
+	r.Type = "OCI"
+	r.Platforms = []string{}
+	r.Size = 0
+	r.FieldSize = 0
+	if len(idx.Manifests) > 0 {
+		r.Tag = idx.Manifests[0].Annotations["org.opencontainers.image.version"]
+	}
+	counted := map[string]bool{}
+	count := func(descriptor v1.Descriptor) bool {
+		if counted[descriptor.Digest.Encoded()] {
+			return false
+		}
+		counted[descriptor.Digest.Encoded()] = true
+		r.Size += descriptor.Size
+		return true
+	}
+	for i, descriptor := range idx.Manifests {
+		if platform := platformOf(descriptor); platform != "" {
+			r.Platforms = append(r.Platforms, platform)
+		}
+		count(descriptor)
+		count(manifests[i].Config)
+		for _, l := range manifests[i].Layers {
+			if !count(l) || l.MediaType != TwoDfsMediaType {
+				continue
+			}
+			r.Type = "OCI+2DFS"
+			r.FieldSize += l.Size
+		}
+	}
+	sort.Strings(r.Platforms)
+	r.Content = contentDigest(idx.Manifests, manifests)
+}
+
+// contentDigest hashes the platforms, configs and layers of the manifests
+func contentDigest(descriptors []v1.Descriptor, manifests []v1.Manifest) string {
+	contents := []string{}
+	for i, descriptor := range descriptors {
+		content := []string{platformOf(descriptor), manifests[i].Config.Digest.Encoded()}
+		for _, l := range manifests[i].Layers {
+			content = append(content, l.Digest.Encoded())
+		}
+		contents = append(contents, strings.Join(content, ","))
+	}
+	sort.Strings(contents)
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(contents, "\n"))))
+}
+
+// readManifests reads the manifests of idx from blobStore
+func readManifests(blobStore cache.CacheStore, idx v1.Index) ([]v1.Manifest, error) {
+	manifests := []v1.Manifest{}
+	for _, descriptor := range idx.Manifests {
+		reader, err := blobStore.Get(descriptor.Digest.Encoded())
+		if err != nil {
+			return nil, err
+		}
+		manifest, _, _, err := ReadManifest(reader)
+		reader.Close()
+		if err != nil {
+			return nil, err
+		}
+		manifests = append(manifests, manifest)
+	}
+	return manifests, nil
+}
+
+// ReadImageRecord returns the record of the index indexHash. Images stored before records existed, or whose
+// manifests were not downloaded when their index was stored, are described out of their blobs and recorded.
+func ReadImageRecord(indexStore cache.CacheStore, blobStore cache.CacheStore, indexHash string) (ImageRecord, error) {
+	record := ImageRecord{}
+	err := cache.ReadRecord(indexStore, indexHash, &record)
+	if err == nil && record.Content != "" {
+		return record, nil
+	}
+	reader, err := indexStore.Get(indexHash)
+	if err != nil {
+		return record, err
+	}
+	idx, err := ReadIndex(reader)
+	reader.Close()
+	if err != nil {
+		return record, err
+	}
+	manifests, err := readManifests(blobStore, idx)
+	if err != nil {
+		return record, err
+	}
+	record.IndexHash = indexHash
+	record.describe(idx, manifests)
+	if record.Created.IsZero() {
+		record.Created = cache.ModTime(indexStore, indexHash)
+	}
+	// in a read-only store the record is rebuilt every time
+	err = cache.WriteRecord(indexStore, indexHash, record)
+	if err != nil && !errors.Is(err, cache.ErrReadOnly) {
+		log.Printf("unable to record image %s: %v", indexHash, err)
+	}
+	return record, nil
+}
+
+// writeRecord records the index just stored. Failures are logged, they only cost describing the image again when listed.
+func (c *containerImage) writeRecord() {
+	record := c.record
+	record.IndexHash = c.indexHash
+	if record.Created.IsZero() {
+		record.Created = time.Now()
+	}
+	if len(c.manifests) == len(c.index.Manifests) {
+		record.describe(c.index, c.manifests)
+	} else {
+		record.Name = c.index.Annotations[ImageNameAnnotation]
+	}
+	err := cache.WriteRecord(c.indexCache, c.indexHash, record)
+	if err != nil {
+		log.Printf("unable to record image %s: %v", record.Name, err)
+	}
+}
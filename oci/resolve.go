@@ -0,0 +1,64 @@
+package oci
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/2DFS/2dfs-builder/filesystem"
+)
+
+/*
+ResolvePartition evaluates the rules stored in the field of a local image against a device profile
+and returns the reference of the resulting partition in semantic tag form, e.g. registry/repo:tag--0.0.1.2
+*/
+func ResolvePartition(ctx context.Context, reference string, profile map[string]interface{}) (string, error) {
+	img, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return "", err
+	}
+	if len(img.partitions) > 0 {
+		return "", fmt.Errorf("%s is already a semantic tag, use the image reference without partitions", reference)
+	}
+	err = img.loadField()
+	if err != nil {
+		return "", err
+	}
+	if img.field == nil {
+		return "", fmt.Errorf("no 2DFS field found. Make sure the image has format OCI+2DFS")
+	}
+	rules := img.field.GetRules()
+	if len(rules) == 0 {
+		return "", fmt.Errorf("the image field does not declare any rule")
+	}
+
+	matched := []filesystem.PartitionRule{}
+	for _, rule := range rules {
+		ok, err := filesystem.EvaluateRule(rule.When, profile)
+		if err != nil {
+			return "", fmt.Errorf("rule %q: %w", rule.When, err)
+		}
+		if ok {
+			log.Printf("Rule %q [MATCHED]", rule.When)
+			matched = append(matched, rule)
+		}
+	}
+
+	cells := []filesystem.Cell{}
+	for allotment := range img.field.IterateAllotments() {
+		if allotment.Digest == "" {
+			continue
+		}
+		for _, rule := range matched {
+			if rule.Selects(allotment.Row, allotment.Col) {
+				cells = append(cells, filesystem.Cell{Row: allotment.Row, Col: allotment.Col})
+				break
+			}
+		}
+	}
+	if len(cells) == 0 {
+		return "", fmt.Errorf("no allotment selected for the given profile")
+	}
+
+	return fmt.Sprintf("%s/%s:%s%s", img.registry, img.repository, img.tag, formatPartitions(cellsToPartitions(cells))), nil
+}
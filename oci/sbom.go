@@ -0,0 +1,382 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/compress"
+	"github.com/2DFS/2dfs-builder/filesystem"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// SBOMMediaType is the media type of the SPDX documents describing allotments and partitions
+	SBOMMediaType = "application/spdx+json"
+	// SBOMAnnotation on an image manifest references the SPDX document describing its layers
+	SBOMAnnotation = "org.2dfs.sbom"
+
+	spdxVersion      = "SPDX-2.3"
+	spdxNamespace    = "https://github.com/2DFS/2dfs-builder/spdx/"
+	spdxNoAssertion  = "NOASSERTION"
+	spdxDocumentID   = "SPDXRef-DOCUMENT"
+	spdxAllotmentID  = "SPDXRef-Allotment"
+	spdxPartitionID  = "SPDXRef-Partition"
+	spdxCreator      = "Tool: tdfs"
+	spdxContains     = "CONTAINS"
+	spdxDescribes    = "DESCRIBES"
+	spdxSHA256       = "SHA256"
+	spdxPackageRef   = "PACKAGE-MANAGER"
+	spdxPURLRef      = "purl"
+	spdxCreatedEpoch = "1970-01-01T00:00:00Z"
+)
+
+// SBOM is an SPDX 2.3 document, restricted to the fields written by the builder
+type SBOM struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      SBOMCreationInfo   `json:"creationInfo"`
+	Packages          []SBOMPackage      `json:"packages"`
+	Files             []SBOMFile         `json:"files,omitempty"`
+	Relationships     []SBOMRelationship `json:"relationships"`
+}
+
+type SBOMCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type SBOMPackage struct {
+	SPDXID           string            `json:"SPDXID"`
+	Name             string            `json:"name"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []SBOMChecksum    `json:"checksums,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	ExternalRefs     []SBOMExternalRef `json:"externalRefs,omitempty"`
+	Comment          string            `json:"comment,omitempty"`
+}
+
+type SBOMFile struct {
+	SPDXID    string         `json:"SPDXID"`
+	FileName  string         `json:"fileName"`
+	Checksums []SBOMChecksum `json:"checksums"`
+	// Comment carries the file size, SPDX 2.3 has no field for it
+	Comment string `json:"comment,omitempty"`
+}
+
+type SBOMChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type SBOMExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type SBOMRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// newSBOM returns an empty document. created is kept deterministic so that rebuilding an image gives the same SBOM digests
+func newSBOM(name string, namespace string, created string) SBOM {
+	if created == "" {
+		created = spdxCreatedEpoch
+	}
+	return SBOM{
+		SPDXVersion:       spdxVersion,
+		DataLicense:       "CC0-1.0",
+		SPDXID:            spdxDocumentID,
+		Name:              name,
+		DocumentNamespace: spdxNamespace + namespace,
+		CreationInfo:      SBOMCreationInfo{Created: created, Creators: []string{spdxCreator}},
+		Packages:          []SBOMPackage{},
+		Relationships:     []SBOMRelationship{},
+	}
+}
+
+// layerSBOM describes the files and the detected packages of an allotment layer. The allotment is the package SPDXRef-Allotment.
+func layerSBOM(layerDigest string, entries []compress.TOCEntry, packages []compress.Package) SBOM {
+	sbom := newSBOM("allotment-"+layerDigest, "allotment/"+layerDigest, "")
+	sbom.Packages = append(sbom.Packages, SBOMPackage{
+		SPDXID:           spdxAllotmentID,
+		Name:             "sha256:" + layerDigest,
+		DownloadLocation: spdxNoAssertion,
+		FilesAnalyzed:    true,
+		Checksums:        []SBOMChecksum{{Algorithm: spdxSHA256, ChecksumValue: layerDigest}},
+	})
+	sbom.Relationships = append(sbom.Relationships, SBOMRelationship{spdxDocumentID, spdxDescribes, spdxAllotmentID})
+
+	for _, entry := range entries {
+		// whiteouts and directories carry no content
+		if entry.Type != compress.TOCTypeFile {
+			continue
+		}
+		fileID := fmt.Sprintf("SPDXRef-File-%d", len(sbom.Files))
+		sbom.Files = append(sbom.Files, SBOMFile{
+			SPDXID:    fileID,
+			FileName:  "." + entry.Path,
+			Checksums: []SBOMChecksum{{Algorithm: spdxSHA256, ChecksumValue: entry.Digest}},
+			Comment:   fmt.Sprintf("size: %d", entry.Size),
+		})
+		sbom.Relationships = append(sbom.Relationships, SBOMRelationship{spdxAllotmentID, spdxContains, fileID})
+	}
+
+	for i, p := range packages {
+		packageID := fmt.Sprintf("SPDXRef-Package-%d", i)
+		sbom.Packages = append(sbom.Packages, SBOMPackage{
+			SPDXID:           packageID,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: spdxNoAssertion,
+			SourceInfo:       "declared by " + p.Path,
+			ExternalRefs:     []SBOMExternalRef{{spdxPackageRef, spdxPURLRef, p.PURL()}},
+		})
+		sbom.Relationships = append(sbom.Relationships, SBOMRelationship{spdxAllotmentID, spdxContains, packageID})
+	}
+	return sbom
+}
+
+// allotmentSBOM returns the digest of the SBOM blob of an allotment layer, creating it if needed.
+// The SBOM digest is cached in the uncompressed-keys store by the allotment layer digest.
+func (c *containerImage) allotmentSBOM(compressedSha string, diffID string) (string, error) {
+	if _, sbomSha, ok := c.cachedDerivedBlob(compressedSha, sbomDestination); ok {
+		return sbomSha, nil
+	}
+
+	blobReader, err := c.blobCache.Get(compressedSha)
+	if err != nil {
+		return "", err
+	}
+	entries, err := compress.TableOfContentsTarGz(blobReader)
+	blobReader.Close()
+	if err != nil {
+		return "", err
+	}
+	blobReader, err = c.blobCache.Get(compressedSha)
+	if err != nil {
+		return "", err
+	}
+	packages, err := compress.DetectPackagesTarGz(blobReader)
+	blobReader.Close()
+	if err != nil {
+		return "", err
+	}
+
+	sbomSha, err := c.storeSBOM(layerSBOM(compressedSha, entries, packages))
+	if err != nil {
+		return "", err
+	}
+	c.cacheDerivedBlob(compressedSha, diffID, sbomSha, sbomDestination)
+	return sbomSha, nil
+}
+
+// storeSBOM adds the document to the blob cache and returns its digest
+func (c *containerImage) storeSBOM(sbom SBOM) (string, error) {
+	sbomBytes, err := json.Marshal(sbom)
+	if err != nil {
+		return "", err
+	}
+	sbomSha := fmt.Sprintf("%x", sha256.Sum256(sbomBytes))
+	if c.blobCache.Check(sbomSha) {
+		return sbomSha, nil
+	}
+	err = cache.WriteEntry(c.blobCache, sbomSha, sbomBytes)
+	if err != nil {
+		return "", err
+	}
+	return sbomSha, nil
+}
+
+// readSBOM reads an SBOM blob, the reference is a digest with or without algorithm
+func (c *containerImage) readSBOM(sbomDigest string) (SBOM, error) {
+	sbom := SBOM{}
+	sbomDigest = strings.TrimPrefix(sbomDigest, "sha256:")
+	reader, err := c.blobCache.Get(sbomDigest)
+	if err != nil {
+		return sbom, fmt.Errorf("SBOM %s not found: %w", sbomDigest, err)
+	}
+	defer reader.Close()
+	sbomBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return sbom, err
+	}
+	err = json.Unmarshal(sbomBytes, &sbom)
+	return sbom, err
+}
+
+/*
+partitionSBOM merges into one document the SBOM declared by the base image manifest, if any, and the SBOMs of the given allotments.
+Each source keeps its elements under its own SPDX ID prefix: SPDXRef-Base- for the base image, SPDXRef-Cell-<row>-<col>- for the
+allotments. Encrypted allotments are listed without their content.
+*/
+func (c *containerImage) partitionSBOM(name string, base string, created string, allotments []filesystem.Allotment) (SBOM, error) {
+	sources := []string{base}
+	for _, a := range allotments {
+		sources = append(sources, a.Digest)
+	}
+	namespace := fmt.Sprintf("partition/%x", sha256.Sum256([]byte(strings.Join(sources, ","))))
+	sbom := newSBOM(name, namespace, created)
+	sbom.Packages = append(sbom.Packages, SBOMPackage{
+		SPDXID:           spdxPartitionID,
+		Name:             name,
+		DownloadLocation: spdxNoAssertion,
+	})
+	sbom.Relationships = append(sbom.Relationships, SBOMRelationship{spdxDocumentID, spdxDescribes, spdxPartitionID})
+
+	if base != "" {
+		baseSBOM, err := c.readSBOM(base)
+		if err != nil {
+			log.Printf("Base image SBOM %s [SKIPPED]: %v\n", base, err)
+		} else {
+			sbom.merge(baseSBOM, "Base-")
+		}
+	}
+
+	for _, a := range allotments {
+		if a.Encryption != nil {
+			allotmentID := fmt.Sprintf("SPDXRef-Cell-%d-%d-Allotment", a.Row, a.Col)
+			sbom.Packages = append(sbom.Packages, SBOMPackage{
+				SPDXID:           allotmentID,
+				Name:             "sha256:" + a.Digest,
+				DownloadLocation: spdxNoAssertion,
+				Checksums:        []SBOMChecksum{{Algorithm: spdxSHA256, ChecksumValue: a.Digest}},
+				Comment:          fmt.Sprintf("allotment %d/%d is encrypted, its content is not listed", a.Row, a.Col),
+			})
+			sbom.Relationships = append(sbom.Relationships, SBOMRelationship{spdxPartitionID, spdxContains, allotmentID})
+			continue
+		}
+		// decrypted allotments have no SBOM in the field, their plaintext layer is described here
+		sbomDigest := a.SBOM
+		if sbomDigest == "" || !c.blobCache.Check(sbomDigest) {
+			var err error
+			sbomDigest, err = c.allotmentSBOM(a.Digest, a.DiffID)
+			if err != nil {
+				return sbom, err
+			}
+		}
+		allotmentSBOM, err := c.readSBOM(sbomDigest)
+		if err != nil {
+			return sbom, err
+		}
+		sbom.merge(allotmentSBOM, fmt.Sprintf("Cell-%d-%d-", a.Row, a.Col))
+	}
+	return sbom, nil
+}
+
+// merge copies the elements of other prefixing their IDs, the elements other describes become part of the partition
+func (s *SBOM) merge(other SBOM, prefix string) {
+	rename := func(id string) string {
+		return "SPDXRef-" + prefix + strings.TrimPrefix(id, "SPDXRef-")
+	}
+	for _, p := range other.Packages {
+		p.SPDXID = rename(p.SPDXID)
+		s.Packages = append(s.Packages, p)
+	}
+	for _, f := range other.Files {
+		f.SPDXID = rename(f.SPDXID)
+		s.Files = append(s.Files, f)
+	}
+	for _, r := range other.Relationships {
+		if r.SPDXElementID == spdxDocumentID && r.RelationshipType == spdxDescribes {
+			s.Relationships = append(s.Relationships, SBOMRelationship{spdxPartitionID, spdxContains, rename(r.RelatedSPDXElement)})
+			continue
+		}
+		// references to other documents are kept as they are
+		if strings.HasPrefix(r.RelatedSPDXElement, "SPDXRef-") {
+			r.RelatedSPDXElement = rename(r.RelatedSPDXElement)
+		}
+		r.SPDXElementID = rename(r.SPDXElementID)
+		s.Relationships = append(s.Relationships, r)
+	}
+	if other.CreationInfo.Created > s.CreationInfo.Created {
+		s.CreationInfo.Created = other.CreationInfo.Created
+	}
+}
+
+// manifestSBOM merges the SBOM declared by a manifest with the SBOMs of the given allotments
+func (c *containerImage) manifestSBOM(i int, allotments []filesystem.Allotment) (SBOM, error) {
+	created := ""
+	if c.configs[i].Created != nil {
+		created = c.configs[i].Created.UTC().Format(time.RFC3339)
+	}
+	name := c.registry + "/" + c.repository + ":" + c.partitionTag
+	return c.partitionSBOM(name, c.manifests[i].Annotations[SBOMAnnotation], created, allotments)
+}
+
+// annotateSBOM stores the merged SBOM of the partition layers of a manifest and references it from the manifest annotations
+func (c *containerImage) annotateSBOM(i int, layers []partitionLayer) error {
+	allotments := []filesystem.Allotment{}
+	for _, layer := range layers {
+		allotments = append(allotments, layer.allotments...)
+	}
+	sbom, err := c.manifestSBOM(i, allotments)
+	if err != nil {
+		return err
+	}
+	sbomDigest, err := c.storeSBOM(sbom)
+	if err != nil {
+		return err
+	}
+	if c.manifests[i].Annotations == nil {
+		c.manifests[i].Annotations = map[string]string{}
+	}
+	c.manifests[i].Annotations[SBOMAnnotation] = "sha256:" + sbomDigest
+	fmt.Printf("SBOM %s [CREATED]\n", sbomDigest)
+	return nil
+}
+
+// downloadSBOM fetches the SBOM declared by a manifest of a pulled image, images without a reachable SBOM are still usable
+func (c *containerImage) downloadSBOM(manifest v1.Manifest) {
+	sbomDigest := manifest.Annotations[SBOMAnnotation]
+	if sbomDigest == "" || c.blobCache.Check(strings.TrimPrefix(sbomDigest, "sha256:")) {
+		return
+	}
+	err := c.downloadAndCache(digest.Digest(sbomDigest), SBOMMediaType)
+	if err != nil {
+		log.Printf("SBOM %s [SKIPPED]: %v", sbomDigest, err)
+	}
+}
+
+/*
+ImageSBOM returns the SBOM of a local image: the merged SBOM of the base image and of the given cells, or of the partition
+selected by the semantic tag, or of the whole field. Partitions get the SBOM their export is annotated with.
+*/
+func ImageSBOM(ctx context.Context, reference string, cells ...filesystem.Cell) (SBOM, error) {
+	img, err := loadFieldImage(ctx, reference)
+	if err != nil {
+		return SBOM{}, err
+	}
+	allotments := []filesystem.Allotment{}
+	if len(cells) == 0 && len(img.partitions) > 0 {
+		allotments, err = img.selectAllotments()
+		if err != nil {
+			return SBOM{}, err
+		}
+	} else {
+		for allotment := range img.field.IterateAllotments() {
+			if allotment.Digest != "" && img.selects(allotment, cells) {
+				allotments = append(allotments, allotment)
+			}
+		}
+	}
+	if len(allotments) == 0 {
+		return SBOM{}, fmt.Errorf("no allotment found for %s", reference)
+	}
+	return img.manifestSBOM(0, allotments)
+}
@@ -0,0 +1,265 @@
+package oci
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/filesystem"
+)
+
+const (
+	// TwoDfsSignatureMediaType is the media type of the detached signature blob of a field
+	TwoDfsSignatureMediaType = "application/vnd.2dfs.field.signature.v1+json"
+	// FieldSignatureAnnotation on the field layer descriptor references the signature blob
+	FieldSignatureAnnotation = "org.2dfs.field.signature"
+
+	signatureEd25519 = "ed25519"
+	signatureECDSA   = "ecdsa-sha256"
+)
+
+// SignedField is the payload of a field signature: the field blob, its owner and the digest of every allotment
+type SignedField struct {
+	Field      string            `json:"field"`
+	Owner      string            `json:"owner"`
+	Allotments []SignedAllotment `json:"allotments"`
+}
+
+// SignedAllotment binds an allotment layer to its cell
+type SignedAllotment struct {
+	Row    int    `json:"row"`
+	Col    int    `json:"col"`
+	Digest string `json:"digest"`
+}
+
+// FieldSignature is the detached signature blob of a field
+type FieldSignature struct {
+	Algorithm string `json:"algorithm"`
+	// Payload is the marshalled SignedField, kept as signed
+	Payload   []byte `json:"payload"`
+	Signature []byte `json:"signature"`
+}
+
+// ReadSigningKey reads a PEM encoded ed25519 or ECDSA private key, in PKCS8 or SEC1 format
+func ReadSigningKey(keyPath string) (crypto.Signer, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		ecKey, ecErr := x509.ParseECPrivateKey(block.Bytes)
+		if ecErr != nil {
+			return nil, fmt.Errorf("%s: %w", keyPath, err)
+		}
+		return ecKey, nil
+	}
+	switch signer := key.(type) {
+	case ed25519.PrivateKey:
+		return signer, nil
+	case *ecdsa.PrivateKey:
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("%s is not an ed25519 or ECDSA private key", keyPath)
+	}
+}
+
+// ReadVerifyKey reads a PEM encoded ed25519 or ECDSA public key
+func ReadVerifyKey(keyPath string) (crypto.PublicKey, error) {
+	block, err := readPEM(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyPath, err)
+	}
+	switch key.(type) {
+	case ed25519.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%s is not an ed25519 or ECDSA public key", keyPath)
+	}
+}
+
+// KeyFingerprint identifies a public key: the sha256 of its PKIX encoding
+func KeyFingerprint(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(der)), nil
+}
+
+// signedField returns the signature payload of a field blob
+func signedField(fieldDigest string, field filesystem.Field) SignedField {
+	payload := SignedField{
+		Field:      "sha256:" + fieldDigest,
+		Owner:      field.GetOwner(),
+		Allotments: []SignedAllotment{},
+	}
+	for allotment := range field.IterateAllotments() {
+		if allotment.Digest == "" {
+			continue
+		}
+		payload.Allotments = append(payload.Allotments, SignedAllotment{Row: allotment.Row, Col: allotment.Col, Digest: allotment.Digest})
+	}
+	return payload
+}
+
+// signField signs the field blob and its allotments, stores the signature blob and returns its digest
+func (c *containerImage) signField(fieldDigest string, key crypto.Signer) (string, error) {
+	payload, err := json.Marshal(signedField(fieldDigest, c.field))
+	if err != nil {
+		return "", err
+	}
+	signature, err := signPayload(payload, key)
+	if err != nil {
+		return "", err
+	}
+
+	signatureBytes, err := json.Marshal(signature)
+	if err != nil {
+		return "", err
+	}
+	signatureDigest := fmt.Sprintf("%x", sha256.Sum256(signatureBytes))
+	err = cache.WriteEntry(c.blobCache, signatureDigest, signatureBytes)
+	if err != nil {
+		return "", err
+	}
+	fmt.Printf("Signature %s [CREATED]\n", signatureDigest)
+	return signatureDigest, nil
+}
+
+// signPayload signs the payload with an ed25519 or ECDSA key
+func signPayload(payload []byte, key crypto.Signer) (FieldSignature, error) {
+	var err error
+	signature := FieldSignature{Payload: payload}
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		signature.Algorithm = signatureEd25519
+		signature.Signature, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	case *ecdsa.PrivateKey:
+		signature.Algorithm = signatureECDSA
+		hash := sha256.Sum256(payload)
+		signature.Signature, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	default:
+		return signature, fmt.Errorf("unsupported signing key %T", key)
+	}
+	return signature, err
+}
+
+// verify checks that the signature was made by key over the payload
+func (s FieldSignature) verify(key crypto.PublicKey) error {
+	switch publicKey := key.(type) {
+	case ed25519.PublicKey:
+		if s.Algorithm != signatureEd25519 || !ed25519.Verify(publicKey, s.Payload, s.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	case *ecdsa.PublicKey:
+		hash := sha256.Sum256(s.Payload)
+		if s.Algorithm != signatureECDSA || !ecdsa.VerifyASN1(publicKey, hash[:], s.Signature) {
+			return fmt.Errorf("invalid signature")
+		}
+	default:
+		return fmt.Errorf("unsupported verification key %T", key)
+	}
+	return nil
+}
+
+/*
+verifyFieldSignature checks that every field layer of the image is signed by key and that the signed allotments are the ones of the field.
+Unsigned fields are rejected.
+*/
+func (c *containerImage) verifyFieldSignature(key crypto.PublicKey) error {
+	verified := 0
+	for _, manifest := range c.manifests {
+		for _, layer := range manifest.Layers {
+			if layer.MediaType != TwoDfsMediaType {
+				continue
+			}
+			signatureDigest := layer.Annotations[FieldSignatureAnnotation]
+			if signatureDigest == "" {
+				return fmt.Errorf("field %s is not signed", layer.Digest.Encoded())
+			}
+			signature, err := c.readSignature(signatureDigest)
+			if err != nil {
+				return err
+			}
+			if err := signature.verify(key); err != nil {
+				return fmt.Errorf("field %s: %w", layer.Digest.Encoded(), err)
+			}
+
+			// the signed payload must describe the field in the store
+			signed := SignedField{}
+			if err := json.Unmarshal(signature.Payload, &signed); err != nil {
+				return err
+			}
+			field, err := c.readVerifiedField(layer.Digest.Encoded())
+			if err != nil {
+				return err
+			}
+			expected, err := json.Marshal(signedField(layer.Digest.Encoded(), field))
+			if err != nil {
+				return err
+			}
+			actual, err := json.Marshal(signed)
+			if err != nil {
+				return err
+			}
+			if string(expected) != string(actual) {
+				return fmt.Errorf("field %s does not match its signature", layer.Digest.Encoded())
+			}
+			verified++
+		}
+	}
+	if verified == 0 {
+		return fmt.Errorf("no 2DFS field to verify")
+	}
+	return nil
+}
+
+// readVerifiedField reads a field blob checking its digest
+func (c *containerImage) readVerifiedField(fieldDigest string) (filesystem.Field, error) {
+	reader, err := c.blobCache.Get(fieldDigest)
+	if err != nil {
+		return nil, fmt.Errorf("field %s not found: %w", fieldDigest, err)
+	}
+	defer reader.Close()
+	fieldBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(fieldBytes)) != fieldDigest {
+		return nil, fmt.Errorf("field %s was tampered with", fieldDigest)
+	}
+	return filesystem.GetField().Unmarshal(string(fieldBytes))
+}
+
+// readSignature reads a signature blob, the reference is a digest with or without algorithm
+func (c *containerImage) readSignature(signatureDigest string) (FieldSignature, error) {
+	signature := FieldSignature{}
+	signatureDigest = strings.TrimPrefix(signatureDigest, "sha256:")
+	reader, err := c.blobCache.Get(signatureDigest)
+	if err != nil {
+		return signature, fmt.Errorf("signature %s not found: %w", signatureDigest, err)
+	}
+	defer reader.Close()
+	signatureBytes, err := io.ReadAll(reader)
+	if err != nil {
+		return signature, err
+	}
+	if fmt.Sprintf("%x", sha256.Sum256(signatureBytes)) != signatureDigest {
+		return signature, fmt.Errorf("signature blob %s is corrupted", signatureDigest)
+	}
+	err = json.Unmarshal(signatureBytes, &signature)
+	return signature, err
+}
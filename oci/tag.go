@@ -0,0 +1,121 @@
+package oci
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// TagImage stores the local image src under the name dst too, without rebuilding it. The manifests keep their
+// configs and layers, only their url and version annotations are rewritten. It returns the index hash of dst.
+func TagImage(indexStore cache.CacheStore, blobStore cache.CacheStore, src string, dst string) (string, error) {
+	srcHash, err := ResolveIndex(indexStore, src)
+	if err != nil {
+		return "", err
+	}
+	target := &containerImage{}
+	target.updateImageInfo(dst)
+	if len(target.partitions) > 0 {
+		return "", fmt.Errorf("%s: a semantic tag with partitions can't name an image", dst)
+	}
+
+	// the alias inherits how the image was built
+	record, err := ReadImageRecord(indexStore, blobStore, srcHash)
+	if err != nil {
+		return "", err
+	}
+	reader, err := indexStore.Get(srcHash)
+	if err != nil {
+		return "", err
+	}
+	idx, err := ReadIndex(reader)
+	reader.Close()
+	if err != nil {
+		return "", err
+	}
+	manifests, err := readManifests(blobStore, idx)
+	if err != nil {
+		return "", err
+	}
+
+	for i, manifest := range manifests {
+		target.annotate(idx.Manifests[i].Annotations)
+		// manifests without url or version annotations keep their digest and are shared as they are
+		if !target.annotate(manifest.Annotations) {
+			continue
+		}
+		marshalledManifest, err := json.Marshal(manifest)
+		if err != nil {
+			return "", err
+		}
+		manifestDigest := fmt.Sprintf("%x", sha256.Sum256(marshalledManifest))
+		if !blobStore.Check(manifestDigest) {
+			err = cache.WriteEntry(blobStore, manifestDigest, marshalledManifest)
+			if err != nil {
+				return "", err
+			}
+		}
+		idx.Manifests[i].Digest = digest.Digest(fmt.Sprintf("sha256:%s", manifestDigest))
+		idx.Manifests[i].Size = int64(len(marshalledManifest))
+		manifests[i] = manifest
+	}
+
+	if idx.Annotations == nil {
+		idx.Annotations = make(map[string]string)
+	}
+	idx.Annotations[ImageNameAnnotation] = target.url
+	indexBytes, err := json.Marshal(idx)
+	if err != nil {
+		return "", err
+	}
+	// the index commits the record, a record never describes an older index
+	err = cache.DelRecord(indexStore, target.indexHash)
+	if err != nil {
+		return "", err
+	}
+	err = cache.WriteEntry(indexStore, target.indexHash, indexBytes)
+	if err != nil {
+		return "", err
+	}
+	cache.Touch(indexStore, target.indexHash)
+	record.IndexHash = target.indexHash
+	record.Kind = TaggedImage
+	record.Parent = srcHash
+	record.Created = time.Now()
+	record.describe(idx, manifests)
+	err = cache.WriteRecord(indexStore, target.indexHash, record)
+	if err != nil {
+		return "", err
+	}
+	return target.indexHash, nil
+}
+
+// annotate rewrites the url and version annotations of a manifest to the name of the image, as AddField does.
+// It returns false if there is nothing to rewrite.
+func (c *containerImage) annotate(annotations map[string]string) bool {
+	changed := false
+	if url, ok := annotations["org.opencontainers.image.url"]; ok {
+		annotations["org.opencontainers.image.url"] = fmt.Sprintf("https://%s/%s", c.registry, c.repository)
+		changed = changed || url != annotations["org.opencontainers.image.url"]
+	}
+	if version, ok := annotations["org.opencontainers.image.version"]; ok {
+		annotations["org.opencontainers.image.version"] = c.tag
+		changed = changed || version != c.tag
+	}
+	return changed
+}
+
+// ContentDigest identifies what an index holds regardless of the names it is tagged with: the platforms,
+// configs and layers of its manifests. Aliases created by TagImage share it.
+func ContentDigest(blobStore cache.CacheStore, idx v1.Index) (string, error) {
+	manifests, err := readManifests(blobStore, idx)
+	if err != nil {
+		return "", err
+	}
+	return contentDigest(idx.Manifests, manifests), nil
+}
@@ -0,0 +1,210 @@
+package oci
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/2DFS/2dfs-builder/cache"
+	"github.com/2DFS/2dfs-builder/compress"
+	"github.com/2DFS/2dfs-builder/filesystem"
+)
+
+const (
+	// TwoDfsTOCMediaType is the media type of the blobs listing the files of an allotment
+	TwoDfsTOCMediaType = "application/vnd.2dfs.allotment.toc.v1+json"
+)
+
+// TableOfContents lists the files of an allotment layer
+type TableOfContents struct {
+	Entries []compress.TOCEntry `json:"entries"`
+}
+
+// AllotmentFiles is the table of contents of the allotment at Row, Col
+type AllotmentFiles struct {
+	Row    int                 `json:"row"`
+	Col    int                 `json:"col"`
+	Digest string              `json:"digest"`
+	Files  []compress.TOCEntry `json:"files"`
+}
+
+// allotmentTOC returns the digest of the table of contents blob of an allotment layer, creating it if needed.
+// The TOC digest is cached in the uncompressed-keys store by the allotment layer digest.
+func (c *containerImage) allotmentTOC(compressedSha string, diffID string) (string, error) {
+	if _, tocSha, ok := c.cachedDerivedBlob(compressedSha, tocDestination); ok {
+		return tocSha, nil
+	}
+
+	blobReader, err := c.blobCache.Get(compressedSha)
+	if err != nil {
+		return "", err
+	}
+	defer blobReader.Close()
+	entries, err := compress.TableOfContentsTarGz(blobReader)
+	if err != nil {
+		return "", err
+	}
+	tocBytes, err := json.Marshal(TableOfContents{Entries: entries})
+	if err != nil {
+		return "", err
+	}
+	tocSha := fmt.Sprintf("%x", sha256.Sum256(tocBytes))
+
+	if !c.blobCache.Check(tocSha) {
+		err = cache.WriteEntry(c.blobCache, tocSha, tocBytes)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	c.cacheDerivedBlob(compressedSha, diffID, tocSha, tocDestination)
+	return tocSha, nil
+}
+
+// readTOC reads the table of contents blob of an allotment
+func (c *containerImage) readTOC(a filesystem.Allotment) (TableOfContents, error) {
+	toc := TableOfContents{}
+	if a.Encryption != nil {
+		return toc, fmt.Errorf("allotment %d/%d is encrypted, its files are not listed", a.Row, a.Col)
+	}
+	if a.TOC == "" {
+		return toc, fmt.Errorf("allotment %d/%d has no table of contents, rebuild the image to generate it", a.Row, a.Col)
+	}
+	tocReader, err := c.blobCache.Get(a.TOC)
+	if err != nil {
+		return toc, fmt.Errorf("table of contents %s of allotment %d/%d not found: %w", a.TOC, a.Row, a.Col, err)
+	}
+	defer tocReader.Close()
+	tocBytes, err := io.ReadAll(tocReader)
+	if err != nil {
+		return toc, err
+	}
+	err = json.Unmarshal(tocBytes, &toc)
+	return toc, err
+}
+
+// loadFieldImage loads a local image that must contain a field
+func loadFieldImage(ctx context.Context, reference string) (*containerImage, error) {
+	img, err := loadLocalImage(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	err = img.loadField()
+	if err != nil {
+		return nil, err
+	}
+	if img.field == nil {
+		return nil, fmt.Errorf("no 2DFS field found. Make sure the image has format OCI+2DFS")
+	}
+	return img, nil
+}
+
+/*
+ListFiles returns the files of the allotments of a local image, reading only their tables of contents.
+cells: allotments to list, default: all the allotments of the partition if reference is a semantic tag, otherwise the whole field.
+*/
+func ListFiles(ctx context.Context, reference string, cells ...filesystem.Cell) ([]AllotmentFiles, error) {
+	img, err := loadFieldImage(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []AllotmentFiles{}
+	for allotment := range img.field.IterateAllotments() {
+		if allotment.Digest == "" || !img.selects(allotment, cells) {
+			continue
+		}
+		// encrypted allotments fail only if requested explicitly
+		if allotment.Encryption != nil && len(cells) == 0 {
+			log.Printf("Allotment %d/%d [ENCRYPTED] not listed\n", allotment.Row, allotment.Col)
+			continue
+		}
+		toc, err := img.readTOC(allotment)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, AllotmentFiles{
+			Row:    allotment.Row,
+			Col:    allotment.Col,
+			Digest: allotment.Digest,
+			Files:  toc.Entries,
+		})
+	}
+	if len(cells) > 0 && len(result) == 0 {
+		return nil, fmt.Errorf("no allotment found at %s", formatCells(cells))
+	}
+	return result, nil
+}
+
+/*
+WhichFile returns the allotments providing the given path, or removing it with a whiteout, reading only their tables of contents.
+Each result lists the single matching entry. If reference is a semantic tag only the allotments of the partition are searched.
+*/
+func WhichFile(ctx context.Context, reference string, filePath string) ([]AllotmentFiles, error) {
+	img, err := loadFieldImage(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+
+	target := path.Clean("/" + filePath)
+	result := []AllotmentFiles{}
+	for allotment := range img.field.IterateAllotments() {
+		if allotment.Digest == "" || !img.selects(allotment, nil) {
+			continue
+		}
+		if allotment.Encryption != nil {
+			log.Printf("Allotment %d/%d [ENCRYPTED] not searched\n", allotment.Row, allotment.Col)
+			continue
+		}
+		toc, err := img.readTOC(allotment)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range toc.Entries {
+			if entry.Path == target {
+				result = append(result, AllotmentFiles{
+					Row:    allotment.Row,
+					Col:    allotment.Col,
+					Digest: allotment.Digest,
+					Files:  []compress.TOCEntry{entry},
+				})
+			}
+		}
+	}
+	return result, nil
+}
+
+// selects returns true if the allotment is one of the given cells or, if no cells are given, part of the image partitions (if any)
+func (c *containerImage) selects(a filesystem.Allotment, cells []filesystem.Cell) bool {
+	if len(cells) > 0 {
+		for _, cell := range cells {
+			if cell.Row == a.Row && cell.Col == a.Col {
+				return true
+			}
+		}
+		return false
+	}
+	if len(c.partitions) == 0 {
+		return true
+	}
+	for _, p := range c.partitions {
+		if p.contains(a.Row, a.Col) {
+			return true
+		}
+	}
+	return false
+}
+
+// formatCells lists cells as row/col
+func formatCells(cells []filesystem.Cell) string {
+	result := []string{}
+	for _, cell := range cells {
+		result = append(result, fmt.Sprintf("%d/%d", cell.Row, cell.Col))
+	}
+	return strings.Join(result, ", ")
+}